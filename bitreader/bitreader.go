@@ -154,7 +154,10 @@ type BitReader interface {
 	Peeker64
 	Skipper
 	Aligner
-	//Offset() int
+	ExpGolombReader
+	SliceReader
+	Positioner
+	Marker
 }
 
 // NewBitReader returns the default implementation of a BitReader
@@ -168,23 +171,27 @@ type bitreader struct {
 	buffer    uint64
 	remaining uint
 	raw       [8]uint8
+	pos       int64 // bytes fetched into buffer or returned by Read
+	mark      *mark
+	record    []byte // bytes fetched since mark
+	replay    []byte // bytes to return again after Reset
+	err       error  // returned by the source along with data, reported by the next read
 }
 
 func (br *bitreader) Read(p []byte) (int, error) {
 	br.Align()
-	count := int((br.remaining + 7) >> 3)
-	if count > len(p) {
-		count = len(p)
+	// hand out the buffered bytes, then read straight into p
+	i := 0
+	for ; i < len(p) && br.remaining > 0; i++ {
+		p[i] = uint8(br.buffer >> 56)
+		br.buffer <<= 8
+		br.remaining -= 8
 	}
-	for i := 0; i < count; i++ {
-		val, err := br.Read8(8)
-		if err != nil {
-			return i, err
-		}
-		p[i] = val
+	if i == len(p) {
+		return i, nil
 	}
-	n, err := br.r.Read(p[count:])
-	return count + n, err
+	n, err := br.readSource(p[i:])
+	return i + n, err
 }
 
 func (br *bitreader) Skip(n uint) error {
@@ -282,10 +289,13 @@ func (br *bitreader) fill() error {
 
 	// 这里边传入的br.raw[:total]是一个输出参数，是一个slice
 	// Read函数内部根据slice的长度输出数据的长度
-	n, err := br.r.Read(br.raw[:total]) // r是标准库的byteReader
-	if err != nil {
+	n, err := br.readSource(br.raw[:total]) // r是标准库的byteReader
+	if n == 0 && err != nil {
 		return err
 	}
+	// io.Reader may return the last bytes together with the error; use
+	// them first
+	br.err = err
 	// n是读出来个字节数
 	ir := br.remaining
 	// 这里是把读取出来的8个字节的slice转换成int64
@@ -326,6 +336,19 @@ func (br *bitreader) peek(n uint) (uint64, error) {
 }
 
 func (br *bitreader) skip(n uint) error {
+	if n <= br.remaining || n < bulkSkipBits {
+		return br.skipBits(n)
+	}
+	// drop the buffer, then skip whole bytes in the source
+	n -= br.remaining
+	br.buffer, br.remaining = 0, 0
+	if err := br.skipBytes(n >> 3); err != nil {
+		return err
+	}
+	return br.skipBits(n & 0x7)
+}
+
+func (br *bitreader) skipBits(n uint) error {
 	for n > 0 {
 		len := n
 		if len > br.remaining {
@@ -349,7 +372,7 @@ func (br *bitreader) skip(n uint) error {
 // Len是没有被读的byte数
 func (br *bitreader) Len() int {
 	// 每次读取8个字节，有可能int64 buffer里面还没有读出来的数据
-	return br.r.Len() + int(br.remaining/8)
+	return br.r.Len() + len(br.replay) + int(br.remaining/8)
 }
 
 // size是总长度
@@ -0,0 +1,129 @@
+package bitreader
+
+import (
+	"errors"
+	"io"
+)
+
+const (
+	// bulkSkipBits is the skip length from which whole bytes are skipped
+	// in the source instead of going through the 64 bit buffer.
+	bulkSkipBits = 128
+	discardSize  = 32 * 1024
+	// maxEmptyReads is how many reads returning neither data nor an error
+	// skipBytes takes before giving up on the source
+	maxEmptyReads = 100
+)
+
+// SliceReader is the interface that wraps the ReadSlice method.
+//
+// ReadSlice realigns the bit stream and returns the next n bytes. For
+// readers created by NewBytesReader the result aliases the input slice;
+// other readers return a copy.
+type SliceReader interface {
+	ReadSlice(n int) ([]byte, error)
+}
+
+// NewBytesReader returns a BitReader reading b in place.
+func NewBytesReader(b []byte) BitReader {
+	return NewReader(&sliceReader{b: b})
+}
+
+// sliceReader is a ByteReader over a byte slice that lets the bit reader
+// hand out sub-slices instead of copying.
+type sliceReader struct {
+	b   []byte
+	off int
+}
+
+func (s *sliceReader) Read(p []byte) (int, error) {
+	if s.off >= len(s.b) {
+		return 0, io.EOF
+	}
+	n := copy(p, s.b[s.off:])
+	s.off += n
+	return n, nil
+}
+
+func (s *sliceReader) Len() int {
+	return len(s.b) - s.off
+}
+
+func (s *sliceReader) Size() int64 {
+	return int64(len(s.b))
+}
+
+func (s *sliceReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += int64(s.off)
+	case io.SeekEnd:
+		offset += int64(len(s.b))
+	}
+	if offset < 0 {
+		return 0, errors.New("bitreader: negative position")
+	}
+	if offset > int64(len(s.b)) {
+		offset = int64(len(s.b))
+	}
+	s.off = int(offset)
+	return offset, nil
+}
+
+func (br *bitreader) ReadSlice(n int) ([]byte, error) {
+	if n < 0 {
+		return nil, errors.New("bitreader: negative count")
+	}
+	br.Align()
+	s, ok := br.r.(*sliceReader)
+	if !ok || br.mark != nil || len(br.replay) > 0 {
+		p := make([]byte, n)
+		if _, err := io.ReadFull(br, p); err != nil {
+			return nil, checkEOF(err)
+		}
+		return p, nil
+	}
+	// the buffered bytes are the ones just before s.off
+	buffered := int(br.remaining >> 3)
+	start := s.off - buffered
+	if n > len(s.b)-start {
+		return nil, io.ErrUnexpectedEOF
+	}
+	br.buffer, br.remaining = 0, 0
+	s.off = start + n
+	br.pos += int64(n - buffered)
+	return s.b[start:s.off:s.off], nil
+}
+
+// skipBytes skips n whole bytes of the source, seeking when the source
+// can and the bytes are known to be there.
+func (br *bitreader) skipBytes(n uint) error {
+	if s, ok := br.r.(io.Seeker); ok && br.mark == nil && len(br.replay) == 0 && n <= uint(br.r.Len()) {
+		if _, err := s.Seek(int64(n), io.SeekCurrent); err == nil {
+			br.pos += int64(n)
+			return nil
+		}
+	}
+	size := uint(discardSize)
+	if n < size {
+		size = n
+	}
+	buf := make([]byte, size)
+	empty := 0
+	for n > 0 {
+		if n < size {
+			buf = buf[:n]
+		}
+		m, err := br.readSource(buf)
+		n -= uint(m)
+		if err != nil && n > 0 {
+			return checkEOF(err)
+		}
+		if m > 0 || err != nil {
+			empty = 0
+		} else if empty++; empty >= maxEmptyReads {
+			return io.ErrNoProgress
+		}
+	}
+	return nil
+}
@@ -0,0 +1,208 @@
+package bitreader
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func testData(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i*7 + i>>8)
+	}
+	return b
+}
+
+func TestReadSliceAliases(t *testing.T) {
+	data := testData(64)
+	br := NewBytesReader(data)
+	if _, err := br.Read8(3); err != nil {
+		t.Fatal(err)
+	}
+	// realigns to byte 1, with bytes of the source still buffered
+	s, err := br.(SliceReader).ReadSlice(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(s, data[1:11]) {
+		t.Fatalf("got % x, want % x", s, data[1:11])
+	}
+	if &s[0] != &data[1] {
+		t.Error("ReadSlice copied the input")
+	}
+	if cap(s) != len(s) {
+		t.Errorf("cap %d, appending would overwrite the input", cap(s))
+	}
+	if v, err := br.Read8(8); err != nil || v != data[11] {
+		t.Errorf("after ReadSlice read 0x%x, %v, want 0x%x", v, err, data[11])
+	}
+	if off := br.(Positioner).ByteOffset(); off != 12 {
+		t.Errorf("offset %d, want 12", off)
+	}
+	if _, err := br.(SliceReader).ReadSlice(len(data)); err != io.ErrUnexpectedEOF {
+		t.Errorf("past the end: %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+func TestReadSliceCopies(t *testing.T) {
+	data := testData(64)
+	for name, br := range map[string]BitReader{
+		"bytes.Reader": NewReader(bytes.NewReader(data)),
+		"marked":       NewBytesReader(data),
+	} {
+		if name == "marked" {
+			br.(Marker).Mark()
+		}
+		br.Read8(8)
+		s, err := br.(SliceReader).ReadSlice(4)
+		if err != nil || !bytes.Equal(s, data[1:5]) {
+			t.Fatalf("%s: got % x, %v", name, s, err)
+		}
+		s[0]++
+		if data[1] == s[0] {
+			t.Errorf("%s: ReadSlice aliases the input", name)
+		}
+	}
+}
+
+func TestSeek(t *testing.T) {
+	data := testData(1 << 12)
+	for name, br := range map[string]BitReader{
+		"slice":        NewBytesReader(data),
+		"bytes.Reader": NewReader(bytes.NewReader(data)),
+	} {
+		p := br.(Positioner)
+		for _, off := range []int64{0, 13, 8 * 100, 8*4000 + 3, 7, 8 * 2048} {
+			if err := p.SeekBit(off); err != nil {
+				t.Fatalf("%s: seek %d: %v", name, off, err)
+			}
+			if p.BitOffset() != off {
+				t.Errorf("%s: seek %d: at %d", name, off, p.BitOffset())
+			}
+			v, err := br.Read16(16)
+			i := off / 8
+			want := uint16(data[i])<<8 | uint16(data[i+1])
+			if s := uint(off % 8); s != 0 {
+				want = want<<s | uint16(data[i+2])>>(8-s)
+			}
+			if err != nil || v != want {
+				t.Errorf("%s: seek %d: read 0x%04x, %v, want 0x%04x", name, off, v, err, want)
+			}
+		}
+	}
+
+	s := &sliceReader{b: data}
+	if off, err := s.Seek(-10, io.SeekEnd); err != nil || off != int64(len(data)-10) || s.Len() != 10 {
+		t.Errorf("seek from end: %d, %v, len %d", off, err, s.Len())
+	}
+	if off, err := s.Seek(100, io.SeekCurrent); err != nil || off != int64(len(data)) || s.Len() != 0 {
+		t.Errorf("seek past the end: %d, %v, len %d", off, err, s.Len())
+	}
+	if _, err := s.Seek(-1, io.SeekStart); err == nil {
+		t.Error("negative position: no error")
+	}
+}
+
+// emptyReader returns no data and no error.
+type emptyReader struct{}
+
+func (emptyReader) Read(p []byte) (int, error) { return 0, nil }
+
+func TestSkipNoProgress(t *testing.T) {
+	br := NewStreamReader(emptyReader{})
+	if err := br.Skip(1 << 20); err != io.ErrNoProgress {
+		t.Errorf("got %v, want %v", err, io.ErrNoProgress)
+	}
+}
+
+const (
+	benchSize = 1 << 20
+	benchStep = 64 << 10
+)
+
+// BenchmarkSkip skips 1MiB of a bytes.Reader in 64KiB steps, with the bulk
+// path and with the bit at a time path through the 64 bit buffer.
+func BenchmarkSkip(b *testing.B) {
+	data := testData(benchSize)
+	run := func(b *testing.B, skip func(br *bitreader, n uint) error) {
+		b.SetBytes(benchSize)
+		for i := 0; i < b.N; i++ {
+			br := NewReader(bytes.NewReader(data)).(*bitreader)
+			br.Read8(3)
+			for n := 0; n+benchStep < benchSize; n += benchStep {
+				if err := skip(br, benchStep*8); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	}
+	b.Run("bulk", func(b *testing.B) { run(b, (*bitreader).skip) })
+	b.Run("bits", func(b *testing.B) { run(b, (*bitreader).skipBits) })
+}
+
+// BenchmarkRead reads 1MiB in 64KiB blocks, with Read and one byte at a
+// time with Read8.
+func BenchmarkRead(b *testing.B) {
+	data := testData(benchSize)
+	p := make([]byte, benchStep)
+	b.Run("bulk", func(b *testing.B) {
+		b.SetBytes(benchSize)
+		for i := 0; i < b.N; i++ {
+			br := NewReader(bytes.NewReader(data))
+			for {
+				if _, err := io.ReadFull(br, p); err != nil {
+					break
+				}
+			}
+		}
+	})
+	b.Run("bytes", func(b *testing.B) {
+		b.SetBytes(benchSize)
+		for i := 0; i < b.N; i++ {
+			br := NewReader(bytes.NewReader(data))
+			for n := 0; n < benchSize; n += benchStep {
+				for j := range p {
+					v, err := br.Read8(8)
+					if err != nil {
+						b.Fatal(err)
+					}
+					p[j] = v
+				}
+			}
+		}
+	})
+}
+
+// BenchmarkReadSlice takes 1MiB in 64KiB slices, in place with
+// NewBytesReader and copied one byte at a time with Read8.
+func BenchmarkReadSlice(b *testing.B) {
+	data := testData(benchSize)
+	b.Run("alias", func(b *testing.B) {
+		b.SetBytes(benchSize)
+		for i := 0; i < b.N; i++ {
+			br := NewBytesReader(data).(SliceReader)
+			for n := 0; n < benchSize; n += benchStep {
+				if _, err := br.ReadSlice(benchStep); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run("bytes", func(b *testing.B) {
+		b.SetBytes(benchSize)
+		for i := 0; i < b.N; i++ {
+			br := NewBytesReader(data)
+			for n := 0; n < benchSize; n += benchStep {
+				p := make([]byte, benchStep)
+				for j := range p {
+					v, err := br.Read8(8)
+					if err != nil {
+						b.Fatal(err)
+					}
+					p[j] = v
+				}
+			}
+		}
+	})
+}
@@ -0,0 +1,52 @@
+package bitreader
+
+import "errors"
+
+var errGolombOverflow = errors.New("exp-golomb overflow")
+
+// ExpGolombReader is the interface that wraps the ReadUE and ReadSE methods
+// used by H.264/H.265 syntax elements.
+//
+// ReadUE reads an unsigned Exp-Golomb code, ue(v), of up to 32 bits of
+// value. ReadSE reads a signed Exp-Golomb code, se(v).
+type ExpGolombReader interface {
+	ReadUE() (uint32, error)
+	ReadSE() (int32, error)
+}
+
+func (br *bitreader) ReadUE() (uint32, error) {
+	leadingZeros := uint(0)
+	for {
+		bit, err := br.Read1()
+		if err != nil {
+			return 0, err
+		}
+		if bit {
+			break
+		}
+		leadingZeros++
+		if leadingZeros > 31 {
+			return 0, errGolombOverflow
+		}
+	}
+	if leadingZeros == 0 {
+		return 0, nil
+	}
+	val, err := br.Read32(leadingZeros)
+	if err != nil {
+		return 0, err
+	}
+	return 1<<leadingZeros - 1 + val, nil
+}
+
+func (br *bitreader) ReadSE() (int32, error) {
+	val, err := br.ReadUE()
+	if err != nil {
+		return 0, err
+	}
+	// codeNum k maps to (-1)^(k+1) * Ceil(k/2)
+	if val&1 == 1 {
+		return int32(val/2 + 1), nil
+	}
+	return -int32(val / 2), nil
+}
@@ -0,0 +1,87 @@
+package bitreader
+
+import (
+	"strings"
+	"testing"
+)
+
+// fromBits packs a string of 0s and 1s, spaces ignored, into bytes padded
+// with 1s, so that a reader running past the end sees no leading zeros.
+func fromBits(s string) []byte {
+	s = strings.Replace(s, " ", "", -1)
+	b := make([]byte, (len(s)+7)/8)
+	for i := range b {
+		b[i] = 0xff
+	}
+	for i, c := range s {
+		if c == '0' {
+			b[i/8] &^= 0x80 >> uint(i%8)
+		}
+	}
+	return b
+}
+
+// codes of ITU-T H.264 Table 9-2 and 9-3
+var golombTests = []struct {
+	bits string
+	ue   uint32
+	se   int32
+}{
+	{"1", 0, 0},
+	{"010", 1, 1},
+	{"011", 2, -1},
+	{"00100", 3, 2},
+	{"00101", 4, -2},
+	{"00110", 5, 3},
+	{"00111", 6, -3},
+	{"0001000", 7, 4},
+	{"0001110", 13, 7},
+	{"000011111", 30, -15},
+	{"0000000 10000000", 127, 64},
+	{"00000000 000000001 00000000 00000000", 65535, 32768},
+	{"00000000 00000000 00000000 0000000 1 11111111 11111111 11111111 1111111", 0xfffffffe, -0x7fffffff},
+}
+
+func TestReadUE(t *testing.T) {
+	for _, tt := range golombTests {
+		br := NewBytesReader(fromBits(tt.bits))
+		if v, err := br.ReadUE(); err != nil || v != tt.ue {
+			t.Errorf("ue(%s) = %d, %v, want %d", tt.bits, v, err, tt.ue)
+		}
+		br = NewBytesReader(fromBits(tt.bits))
+		if v, err := br.ReadSE(); err != nil || v != tt.se {
+			t.Errorf("se(%s) = %d, %v, want %d", tt.bits, v, err, tt.se)
+		}
+	}
+}
+
+func TestReadUESequence(t *testing.T) {
+	// the codes back to back, as in a slice header
+	var bits string
+	for _, tt := range golombTests {
+		bits += strings.Replace(tt.bits, " ", "", -1)
+	}
+	br := NewBytesReader(fromBits(bits)).(*bitreader)
+	for _, tt := range golombTests {
+		if v, err := br.ReadUE(); err != nil || v != tt.ue {
+			t.Fatalf("ue(%s) = %d, %v, want %d", tt.bits, v, err, tt.ue)
+		}
+	}
+	if br.BitOffset() != int64(len(bits)) {
+		t.Errorf("read %d bits, want %d", br.BitOffset(), len(bits))
+	}
+}
+
+func TestReadUEErrors(t *testing.T) {
+	// 32 leading zeros don't fit in 32 bits
+	if _, err := NewBytesReader([]byte{0, 0, 0, 0, 0x80}).ReadUE(); err != errGolombOverflow {
+		t.Errorf("32 leading zeros: %v, want %v", err, errGolombOverflow)
+	}
+	// the stream ends in the suffix
+	if _, err := NewBytesReader([]byte{0x00, 0x01}).ReadUE(); err == nil {
+		t.Error("truncated code: no error")
+	}
+	if _, err := NewBytesReader(nil).ReadSE(); err == nil {
+		t.Error("empty stream: no error")
+	}
+}
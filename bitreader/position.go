@@ -0,0 +1,132 @@
+package bitreader
+
+import (
+	"errors"
+	"io"
+)
+
+var (
+	ErrNotSeekable = errors.New("bitreader: underlying reader can't seek backwards")
+	ErrNoMark      = errors.New("bitreader: reset without mark")
+)
+
+// Positioner is the interface that reports and moves the position in the
+// bit stream.
+//
+// BitOffset() returns the number of bits consumed so far; ByteOffset()
+// is the same in whole bytes.
+//
+// SeekBit() moves to an absolute bit offset. Seeking forward always
+// works; seeking backward requires the underlying reader to be an
+// io.Seeker and drops any mark.
+type Positioner interface {
+	BitOffset() int64
+	ByteOffset() int64
+	SeekBit(offset int64) error
+}
+
+// Marker is the interface that allows a decoder to backtrack after a
+// failed speculative parse.
+//
+// Mark() remembers the current position. Bytes fetched from the
+// underlying reader after it are kept by the bit reader, so the
+// underlying reader is never rewound.
+//
+// Reset() returns to the marked position; the mark stays set, so it can
+// be reset to again. Unmark() forgets the mark and the kept bytes.
+type Marker interface {
+	Mark()
+	Reset() error
+	Unmark()
+}
+
+type mark struct {
+	buffer    uint64
+	remaining uint
+	pos       int64
+}
+
+func (br *bitreader) BitOffset() int64 {
+	return br.pos*8 - int64(br.remaining)
+}
+
+func (br *bitreader) ByteOffset() int64 {
+	return br.BitOffset() / 8
+}
+
+func (br *bitreader) SeekBit(offset int64) error {
+	cur := br.BitOffset()
+	if offset >= cur {
+		return br.skip64(offset - cur)
+	}
+	s, ok := br.r.(io.Seeker)
+	if !ok {
+		return ErrNotSeekable
+	}
+	// the underlying reader is ahead of pos by the bytes queued for replay
+	delta := offset/8 - (br.pos + int64(len(br.replay)))
+	if _, err := s.Seek(delta, io.SeekCurrent); err != nil {
+		return err
+	}
+	br.pos = offset / 8
+	br.buffer, br.remaining = 0, 0
+	br.replay = nil
+	br.err = nil
+	br.Unmark()
+	return br.skip(uint(offset % 8))
+}
+
+func (br *bitreader) skip64(n int64) error {
+	const chunk = 1 << 30
+	for n > chunk {
+		if err := br.skip(chunk); err != nil {
+			return err
+		}
+		n -= chunk
+	}
+	return br.skip(uint(n))
+}
+
+func (br *bitreader) Mark() {
+	br.mark = &mark{buffer: br.buffer, remaining: br.remaining, pos: br.pos}
+	br.record = br.record[:0]
+}
+
+func (br *bitreader) Reset() error {
+	if br.mark == nil {
+		return ErrNoMark
+	}
+	br.buffer, br.remaining, br.pos = br.mark.buffer, br.mark.remaining, br.mark.pos
+	replay := make([]byte, 0, len(br.record)+len(br.replay))
+	replay = append(replay, br.record...)
+	br.replay = append(replay, br.replay...)
+	br.record = br.record[:0]
+	return nil
+}
+
+func (br *bitreader) Unmark() {
+	br.mark = nil
+	br.record = nil
+}
+
+// readSource reads from the bytes kept by Reset first, then reports an
+// error held back by fill, then reads from the underlying reader,
+// recording what it returns while a mark is set.
+func (br *bitreader) readSource(p []byte) (int, error) {
+	var n int
+	var err error
+	switch {
+	case len(br.replay) > 0:
+		n = copy(p, br.replay)
+		br.replay = br.replay[n:]
+	case br.err != nil:
+		err, br.err = br.err, nil
+	default:
+		n, err = br.r.Read(p)
+	}
+	if br.mark != nil {
+		br.record = append(br.record, p[:n]...)
+	}
+	br.pos += int64(n)
+	return n, err
+}
@@ -0,0 +1,61 @@
+package bitreader
+
+// UnescapeRBSP removes every emulation_prevention_three_byte (the 0x03 in
+// 0x000003) from the bytes of a NAL unit, returning its raw byte sequence
+// payload. The input is not modified.
+func UnescapeRBSP(ebsp []byte) []byte {
+	rbsp := make([]byte, 0, len(ebsp))
+	zeros := 0
+	for _, b := range ebsp {
+		if zeros >= 2 && b == 0x03 {
+			zeros = 0
+			continue
+		}
+		rbsp = append(rbsp, b)
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return rbsp
+}
+
+// RBSPReader is a BitReader over the payload of a NAL unit with the
+// emulation prevention bytes stripped. It knows where the payload ends,
+// so it can answer more_rbsp_data().
+type RBSPReader struct {
+	*bitreader
+	// stopBit is the bit offset of rbsp_stop_one_bit, or -1 if the
+	// payload has no trailing bits.
+	stopBit int64
+}
+
+// NewRBSPReader returns an RBSPReader over ebsp, the bytes of a NAL unit
+// following its header.
+func NewRBSPReader(ebsp []byte) *RBSPReader {
+	rbsp := UnescapeRBSP(ebsp)
+	r := &RBSPReader{
+		bitreader: &bitreader{r: &sliceReader{b: rbsp}},
+		stopBit:   -1,
+	}
+	// rbsp_stop_one_bit is the last bit set; cabac_zero_words may follow
+	for i := len(rbsp) - 1; i >= 0; i-- {
+		if b := rbsp[i]; b != 0 {
+			n := int64(0)
+			for b&1 == 0 {
+				b >>= 1
+				n++
+			}
+			r.stopBit = int64(i)*8 + 7 - n
+			break
+		}
+	}
+	return r
+}
+
+// MoreRBSPData implements more_rbsp_data(): it reports whether there is
+// more data before the rbsp_trailing_bits.
+func (r *RBSPReader) MoreRBSPData() bool {
+	return r.BitOffset() < r.stopBit
+}
@@ -0,0 +1,76 @@
+package bitreader
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestUnescapeRBSP(t *testing.T) {
+	tests := []struct {
+		ebsp, rbsp []byte
+	}{
+		{[]byte{0x65, 0x88, 0x84}, []byte{0x65, 0x88, 0x84}},
+		{[]byte{0x00, 0x00, 0x03, 0x00}, []byte{0x00, 0x00, 0x00}},
+		{[]byte{0x00, 0x00, 0x03, 0x01}, []byte{0x00, 0x00, 0x01}},
+		{[]byte{0x00, 0x00, 0x03, 0x02}, []byte{0x00, 0x00, 0x02}},
+		{[]byte{0x00, 0x00, 0x03, 0x03}, []byte{0x00, 0x00, 0x03}},
+		// the zero count starts over after an emulation prevention byte
+		{[]byte{0x00, 0x00, 0x03, 0x00, 0x00, 0x03, 0x00}, []byte{0x00, 0x00, 0x00, 0x00, 0x00}},
+		{[]byte{0x00, 0x00, 0x03, 0x00, 0x03}, []byte{0x00, 0x00, 0x00, 0x03}},
+		// a 03 after a single zero is data
+		{[]byte{0x01, 0x00, 0x03, 0x00}, []byte{0x01, 0x00, 0x03, 0x00}},
+		// appended when the payload ends in a zero byte (7.4.1)
+		{[]byte{0x80, 0x00, 0x00, 0x03}, []byte{0x80, 0x00, 0x00}},
+		// from an H.264 SPS
+		{[]byte{0x42, 0xc0, 0x1e, 0x00, 0x00, 0x03, 0x00, 0x80, 0x00, 0x00, 0x19},
+			[]byte{0x42, 0xc0, 0x1e, 0x00, 0x00, 0x00, 0x80, 0x00, 0x00, 0x19}},
+		{nil, []byte{}},
+	}
+	for _, tt := range tests {
+		in := append([]byte(nil), tt.ebsp...)
+		if got := UnescapeRBSP(in); !bytes.Equal(got, tt.rbsp) {
+			t.Errorf("UnescapeRBSP(% x) = % x, want % x", tt.ebsp, got, tt.rbsp)
+		}
+		if !bytes.Equal(in, tt.ebsp) {
+			t.Errorf("UnescapeRBSP(% x) modified its input", tt.ebsp)
+		}
+	}
+}
+
+func TestMoreRBSPData(t *testing.T) {
+	tests := []struct {
+		name string
+		ebsp []byte
+		data int // bits before rbsp_stop_one_bit
+	}{
+		{"trailing bits", []byte{0xa0}, 2},
+		{"stop bit alone", []byte{0x80}, 0},
+		{"stop bit last", []byte{0xff, 0x01}, 15},
+		{"zero bytes after", []byte{0x5c, 0x00}, 5},
+		// cabac_zero_words with their emulation prevention bytes
+		{"cabac_zero_words", []byte{0xb4, 0x00, 0x00, 0x03, 0x00, 0x00, 0x03}, 5},
+		{"escaped data", []byte{0x00, 0x00, 0x03, 0x01, 0x80}, 24},
+	}
+	for _, tt := range tests {
+		r := NewRBSPReader(tt.ebsp)
+		for i := 0; i < tt.data; i++ {
+			if !r.MoreRBSPData() {
+				t.Errorf("%s: no more data after %d bits, want %d", tt.name, i, tt.data)
+				break
+			}
+			if _, err := r.Read1(); err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+		}
+		if r.MoreRBSPData() {
+			t.Errorf("%s: more data after %d bits", tt.name, tt.data)
+		}
+		if stop, err := r.Read1(); err != nil || !stop {
+			t.Errorf("%s: rbsp_stop_one_bit = %t, %v", tt.name, stop, err)
+		}
+	}
+	// no stop bit at all
+	if NewRBSPReader([]byte{0, 0}).MoreRBSPData() {
+		t.Error("all zero payload: more data")
+	}
+}
@@ -0,0 +1,39 @@
+package bitreader
+
+import "io"
+
+// NewStreamReader returns a BitReader over any io.Reader, such as a pipe,
+// a socket or a bufio.Reader. Readers that already implement ByteReader,
+// like bytes.Reader, are used directly.
+//
+// The total length of a stream is unknown, so for a plain io.Reader Size()
+// reports the bytes consumed from r so far and Len() only the bytes the
+// bit reader holds but has not returned yet. Size()-Len() is still the
+// read position, as ByteOffset() is.
+func NewStreamReader(r io.Reader) BitReader {
+	if br, ok := r.(ByteReader); ok {
+		return NewReader(br)
+	}
+	return NewReader(&streamReader{r: r})
+}
+
+// streamReader adapts an io.Reader to ByteReader by counting the bytes
+// read from it.
+type streamReader struct {
+	r io.Reader
+	n int64
+}
+
+func (s *streamReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	s.n += int64(n)
+	return n, err
+}
+
+func (s *streamReader) Len() int {
+	return 0
+}
+
+func (s *streamReader) Size() int64 {
+	return s.n
+}
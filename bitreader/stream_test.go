@@ -0,0 +1,72 @@
+package bitreader
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+// chunkReader returns its chunks one per Read, the last one together with
+// err.
+type chunkReader struct {
+	chunks [][]byte
+	err    error
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	if len(c.chunks) == 0 {
+		return 0, c.err
+	}
+	n := copy(p, c.chunks[0])
+	if c.chunks[0] = c.chunks[0][n:]; len(c.chunks[0]) == 0 {
+		c.chunks = c.chunks[1:]
+	}
+	if len(c.chunks) == 0 {
+		return n, c.err
+	}
+	return n, nil
+}
+
+func TestStreamReaderDataWithError(t *testing.T) {
+	data := testData(21)
+	errBroken := errors.New("broken")
+	for _, tt := range []struct {
+		name string
+		r    io.Reader
+		err  error
+	}{
+		{"eof", iotest.DataErrReader(bytes.NewReader(data)), io.ErrUnexpectedEOF},
+		{"one byte eof", iotest.DataErrReader(iotest.OneByteReader(bytes.NewReader(data))), io.ErrUnexpectedEOF},
+		{"error", &chunkReader{chunks: [][]byte{data[:5], data[5:]}, err: errBroken}, errBroken},
+	} {
+		br := NewStreamReader(tt.r)
+		for i, want := range data {
+			v, err := br.Read8(8)
+			if err != nil || v != want {
+				t.Fatalf("%s: byte %d: 0x%02x, %v, want 0x%02x", tt.name, i, v, err, want)
+			}
+		}
+		if _, err := br.Read8(8); err != tt.err {
+			t.Errorf("%s: after the data: %v, want %v", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestStreamReaderMarkDataWithError(t *testing.T) {
+	data := testData(12)
+	br := NewStreamReader(iotest.DataErrReader(bytes.NewReader(data)))
+	br.(Marker).Mark()
+	if _, err := br.Read64(64); err != nil {
+		t.Fatal(err)
+	}
+	if err := br.(Marker).Reset(); err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range data {
+		if v, err := br.Read8(8); err != nil || v != want {
+			t.Fatalf("byte %d: 0x%02x, %v, want 0x%02x", i, v, err, want)
+		}
+	}
+}
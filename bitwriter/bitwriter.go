@@ -0,0 +1,237 @@
+// Package bitwriter provides basic interfaces to write an io.Writer as a
+// stream of bits, rather than a stream of bytes. It mirrors the bitreader
+// package.
+package bitwriter
+
+import (
+	"bytes"
+	"errors"
+	"io"
+)
+
+// Writer is the interface that wraps the basic Write1 method.
+//
+// Write1 appends one bit, set if val is true, to the bit stream.
+type Writer interface {
+	Write1(val bool) error
+}
+
+type Writer8 interface {
+	Writer
+	Write8(n uint, val uint8) error
+}
+
+type Writer16 interface {
+	Writer8
+	Write16(n uint, val uint16) error
+}
+
+// Writer32 is the interface that wraps the basic Write32 method.
+//
+// Write32 appends the n (1 <= n <= 32) low bits of val to the bit stream,
+// most significant bit first.
+type Writer32 interface {
+	Writer16
+	Write32(n uint, val uint32) error
+}
+
+type Writer64 interface {
+	Writer32
+	Write64(n uint, val uint64) error
+}
+
+// Aligner is the interface that allows for byte realignment.
+//
+// IsAligned() returns true if the bit stream is currently
+// aligned to a byte boundary.
+//
+// Align() will write zero bits to realign the bit stream to a byte
+// boundary. It returns the number of bits written (0 <= n < 8).
+type Aligner interface {
+	IsAligned() bool
+	Align() (n uint, err error)
+}
+
+// ExpGolombWriter is the interface that wraps the WriteUE and WriteSE
+// methods used by H.264/H.265 syntax elements.
+type ExpGolombWriter interface {
+	WriteUE(val uint32) error
+	WriteSE(val int32) error
+}
+
+type BitWriter interface {
+	io.Writer
+	Writer64
+	Aligner
+	ExpGolombWriter
+	// WriteTrailingBits writes rbsp_trailing_bits(): a one bit followed by
+	// zero bits up to the next byte boundary.
+	WriteTrailingBits() error
+	// Flush writes the buffered whole bytes to the underlying writer. A
+	// partial byte stays buffered until the stream is aligned.
+	Flush() error
+}
+
+// NewWriter returns the default implementation of a BitWriter.
+func NewWriter(w io.Writer) BitWriter {
+	return &bitwriter{w: w}
+}
+
+type bitwriter struct {
+	w      io.Writer
+	buffer uint64
+	used   uint // number of bits in buffer, from the most significant bit
+	raw    [8]uint8
+}
+
+func (bw *bitwriter) Write(p []byte) (int, error) {
+	if !bw.IsAligned() {
+		for i, b := range p {
+			if err := bw.Write8(8, b); err != nil {
+				return i, err
+			}
+		}
+		return len(p), nil
+	}
+	if err := bw.Flush(); err != nil {
+		return 0, err
+	}
+	return bw.w.Write(p)
+}
+
+func (bw *bitwriter) IsAligned() bool {
+	return bw.used&0x7 == 0
+}
+
+func (bw *bitwriter) Align() (n uint, err error) {
+	n = (8 - bw.used&0x7) & 0x7
+	return n, bw.write(n, 0)
+}
+
+func (bw *bitwriter) Write1(val bool) error {
+	if val {
+		return bw.write(1, 1)
+	}
+	return bw.write(1, 0)
+}
+
+func (bw *bitwriter) Write8(n uint, val uint8) error {
+	if n > 8 {
+		return errors.New("overflow")
+	}
+	return bw.write(n, uint64(val))
+}
+
+func (bw *bitwriter) Write16(n uint, val uint16) error {
+	if n > 16 {
+		return errors.New("overflow")
+	}
+	return bw.write(n, uint64(val))
+}
+
+func (bw *bitwriter) Write32(n uint, val uint32) error {
+	if n > 32 {
+		return errors.New("overflow")
+	}
+	return bw.write(n, uint64(val))
+}
+
+func (bw *bitwriter) Write64(n uint, val uint64) error {
+	if n > 64 {
+		return errors.New("overflow")
+	}
+	return bw.write(n, val)
+}
+
+func (bw *bitwriter) WriteUE(val uint32) error {
+	// codeNum+1 written with as many leading zeros as it has bits minus one
+	v := uint64(val) + 1
+	n := uint(0)
+	for t := v; t > 1; t >>= 1 {
+		n++
+	}
+	if err := bw.write(n, 0); err != nil {
+		return err
+	}
+	return bw.write(n+1, v)
+}
+
+func (bw *bitwriter) WriteSE(val int32) error {
+	if val > 0 {
+		return bw.WriteUE(uint32(val)*2 - 1)
+	}
+	return bw.WriteUE(uint32(-int64(val)) * 2)
+}
+
+func (bw *bitwriter) WriteTrailingBits() error {
+	if err := bw.write(1, 1); err != nil {
+		return err
+	}
+	_, err := bw.Align()
+	return err
+}
+
+func (bw *bitwriter) Flush() error {
+	count := bw.used >> 3
+	if count == 0 {
+		return nil
+	}
+	for i := uint(0); i < count; i++ {
+		bw.raw[i] = uint8(bw.buffer >> (56 - i*8))
+	}
+	if _, err := bw.w.Write(bw.raw[:count]); err != nil {
+		return err
+	}
+	bw.buffer <<= count * 8
+	bw.used -= count * 8
+	return nil
+}
+
+// write appends the n low bits of val, flushing the buffer when it fills up.
+func (bw *bitwriter) write(n uint, val uint64) error {
+	for n > 0 {
+		free := 64 - bw.used
+		k := n
+		if k > free {
+			k = free
+		}
+		bits := val >> (n - k)
+		if k < 64 {
+			bits &= 1<<k - 1
+		}
+		bw.buffer |= bits << (free - k)
+		bw.used += k
+		n -= k
+		if bw.used == 64 {
+			if err := bw.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Buffer is a BitWriter that writes to a growable in-memory buffer.
+type Buffer struct {
+	bitwriter
+	buf bytes.Buffer
+}
+
+// NewBuffer returns an empty Buffer.
+func NewBuffer() *Buffer {
+	b := &Buffer{}
+	b.w = &b.buf
+	return b
+}
+
+// Bytes returns the whole bytes written so far. Call Align first to
+// include a trailing partial byte.
+func (b *Buffer) Bytes() []byte {
+	b.Flush()
+	return b.buf.Bytes()
+}
+
+// Len returns the number of bits written so far.
+func (b *Buffer) Len() int {
+	return b.buf.Len()*8 + int(b.used)
+}
@@ -0,0 +1,174 @@
+package bitwriter
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"mpegps-parser/bitreader"
+)
+
+// toBits formats the first n bits of b as a string of 0s and 1s.
+func toBits(b []byte, n int) string {
+	var s strings.Builder
+	for i := 0; i < n; i++ {
+		if b[i/8]&(0x80>>uint(i%8)) != 0 {
+			s.WriteByte('1')
+		} else {
+			s.WriteByte('0')
+		}
+	}
+	return s.String()
+}
+
+// codes of ITU-T H.264 Table 9-2 and 9-3
+var golombTests = []struct {
+	bits string
+	ue   uint32
+	se   int32
+}{
+	{"1", 0, 0},
+	{"010", 1, 1},
+	{"011", 2, -1},
+	{"00100", 3, 2},
+	{"00101", 4, -2},
+	{"00110", 5, 3},
+	{"00111", 6, -3},
+	{"0001000", 7, 4},
+	{"0001110", 13, 7},
+	{"000011111", 30, -15},
+	{"000000010000000", 127, 64},
+	{"00000000000000001" + "0000000000000000", 65535, 32768},
+	{strings.Repeat("0", 31) + strings.Repeat("1", 32), 0xfffffffe, -0x7fffffff},
+}
+
+func TestWriteUE(t *testing.T) {
+	for _, tt := range golombTests {
+		b := NewBuffer()
+		if err := b.WriteUE(tt.ue); err != nil {
+			t.Fatal(err)
+		}
+		n := b.Len()
+		b.Align()
+		if got := toBits(b.Bytes(), n); got != tt.bits {
+			t.Errorf("ue(%d) = %s, want %s", tt.ue, got, tt.bits)
+		}
+
+		b = NewBuffer()
+		if err := b.WriteSE(tt.se); err != nil {
+			t.Fatal(err)
+		}
+		n = b.Len()
+		b.Align()
+		if got := toBits(b.Bytes(), n); got != tt.bits {
+			t.Errorf("se(%d) = %s, want %s", tt.se, got, tt.bits)
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	b := NewBuffer()
+	must := func(err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// fields of every width, unaligned, crossing the 64 bit buffer
+	must(b.Write1(true))
+	must(b.Write8(3, 5))
+	must(b.Write16(12, 0xabc))
+	must(b.Write32(27, 0x5a5a5a5))
+	must(b.Write64(64, 0x0123456789abcdef))
+	must(b.Write64(33, 1<<32|0x9abc))
+	for _, tt := range golombTests {
+		must(b.WriteUE(tt.ue))
+		must(b.WriteSE(tt.se))
+	}
+	if b.IsAligned() {
+		t.Fatal("aligned after 1+3+12+27+64+33 bits and golomb codes")
+	}
+	pad, err := b.Align()
+	must(err)
+	if !b.IsAligned() || b.Len()%8 != 0 || pad == 0 || pad > 7 {
+		t.Fatalf("Align wrote %d bits, %d bits in total", pad, b.Len())
+	}
+	if n, err := b.Align(); n != 0 || err != nil {
+		t.Errorf("Align when aligned wrote %d bits, %v", n, err)
+	}
+	// bytes written aligned go straight through, unaligned ones are shifted
+	_, err = b.Write([]byte{0x12, 0x34})
+	must(err)
+	must(b.Write8(4, 0xf))
+	_, err = b.Write([]byte{0x56, 0x78})
+	must(err)
+	must(b.WriteTrailingBits())
+
+	r := bitreader.NewBytesReader(b.Bytes())
+	read := func(n uint, want uint64) {
+		// the reader takes at most 56 bits when unaligned
+		got, err := r.Read64(n - n/2)
+		if err == nil && n > 1 {
+			var low uint64
+			low, err = r.Read64(n / 2)
+			got = got<<(n/2) | low
+		}
+		if err != nil || got != want {
+			t.Errorf("Read64(%d) = 0x%x, %v, want 0x%x", n, got, err, want)
+		}
+	}
+	read(1, 1)
+	read(3, 5)
+	read(12, 0xabc)
+	read(27, 0x5a5a5a5)
+	read(64, 0x0123456789abcdef)
+	read(33, 1<<32|0x9abc)
+	for _, tt := range golombTests {
+		if v, err := r.ReadUE(); err != nil || v != tt.ue {
+			t.Errorf("ReadUE() = %d, %v, want %d", v, err, tt.ue)
+		}
+		if v, err := r.ReadSE(); err != nil || v != tt.se {
+			t.Errorf("ReadSE() = %d, %v, want %d", v, err, tt.se)
+		}
+	}
+	read(uint(pad), 0)
+	read(16, 0x1234)
+	read(4, 0xf)
+	read(16, 0x5678)
+	// rbsp_trailing_bits
+	read(4, 0x8)
+	if !r.IsAligned() || r.Len() != 0 {
+		t.Errorf("%d bytes left, aligned %t", r.Len(), r.IsAligned())
+	}
+}
+
+func TestTrailingBits(t *testing.T) {
+	tests := []struct {
+		bits uint
+		want []byte
+	}{
+		{0, []byte{0x80}},
+		{1, []byte{0xc0}},
+		{7, []byte{0xff}},
+		{8, []byte{0xff, 0x80}},
+	}
+	for _, tt := range tests {
+		b := NewBuffer()
+		b.Write64(tt.bits, 1<<tt.bits-1)
+		if err := b.WriteTrailingBits(); err != nil {
+			t.Fatal(err)
+		}
+		if got := b.Bytes(); !bytes.Equal(got, tt.want) {
+			t.Errorf("%d bits: % x, want % x", tt.bits, got, tt.want)
+		}
+	}
+}
+
+func TestOverflow(t *testing.T) {
+	b := NewBuffer()
+	if b.Write8(9, 0) == nil || b.Write16(17, 0) == nil || b.Write32(33, 0) == nil || b.Write64(65, 0) == nil {
+		t.Error("writing more bits than the value holds accepted")
+	}
+	if b.Len() != 0 {
+		t.Errorf("%d bits written by the failed writes", b.Len())
+	}
+}
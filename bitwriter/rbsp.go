@@ -0,0 +1,60 @@
+package bitwriter
+
+import "io"
+
+// EscapeRBSP inserts an emulation_prevention_three_byte wherever two zero
+// bytes are followed by a byte <= 0x03, turning a raw byte sequence payload
+// into the bytes of a NAL unit. It is the inverse of
+// bitreader.UnescapeRBSP.
+func EscapeRBSP(rbsp []byte) []byte {
+	ebsp := make([]byte, 0, len(rbsp)+len(rbsp)/64)
+	zeros := 0
+	for _, b := range rbsp {
+		if zeros >= 2 && b <= 0x03 {
+			ebsp = append(ebsp, 0x03)
+			zeros = 0
+		}
+		ebsp = append(ebsp, b)
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return ebsp
+}
+
+// epbWriter inserts emulation prevention bytes into the stream written
+// through it.
+type epbWriter struct {
+	w     io.Writer
+	zeros int
+	buf   []byte
+}
+
+func (e *epbWriter) Write(p []byte) (int, error) {
+	e.buf = e.buf[:0]
+	for _, b := range p {
+		if e.zeros >= 2 && b <= 0x03 {
+			e.buf = append(e.buf, 0x03)
+			e.zeros = 0
+		}
+		e.buf = append(e.buf, b)
+		if b == 0 {
+			e.zeros++
+		} else {
+			e.zeros = 0
+		}
+	}
+	if _, err := e.w.Write(e.buf); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// NewRBSPWriter returns a BitWriter whose output has emulation prevention
+// bytes inserted, ready to follow a NAL unit header. Finish the payload
+// with WriteTrailingBits and Flush.
+func NewRBSPWriter(w io.Writer) BitWriter {
+	return &bitwriter{w: &epbWriter{w: w}}
+}
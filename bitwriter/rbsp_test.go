@@ -0,0 +1,98 @@
+package bitwriter
+
+import (
+	"bytes"
+	"testing"
+
+	"mpegps-parser/bitreader"
+)
+
+func TestEscapeRBSP(t *testing.T) {
+	tests := []struct {
+		rbsp, ebsp []byte
+	}{
+		{[]byte{0x65, 0x88, 0x84}, []byte{0x65, 0x88, 0x84}},
+		{[]byte{0x00, 0x00, 0x00}, []byte{0x00, 0x00, 0x03, 0x00}},
+		{[]byte{0x00, 0x00, 0x01}, []byte{0x00, 0x00, 0x03, 0x01}},
+		{[]byte{0x00, 0x00, 0x02}, []byte{0x00, 0x00, 0x03, 0x02}},
+		{[]byte{0x00, 0x00, 0x03}, []byte{0x00, 0x00, 0x03, 0x03}},
+		// a byte above 03 needs no escape
+		{[]byte{0x00, 0x00, 0x04}, []byte{0x00, 0x00, 0x04}},
+		{[]byte{0x00, 0x00}, []byte{0x00, 0x00}},
+		// the zero count starts over after an emulation prevention byte
+		{[]byte{0x00, 0x00, 0x00, 0x00, 0x00}, []byte{0x00, 0x00, 0x03, 0x00, 0x00, 0x03, 0x00}},
+		{[]byte{0x00, 0x00, 0x00, 0x03}, []byte{0x00, 0x00, 0x03, 0x00, 0x03}},
+		{[]byte{0x01, 0x00, 0x03, 0x00}, []byte{0x01, 0x00, 0x03, 0x00}},
+		// from an H.264 SPS
+		{[]byte{0x42, 0xc0, 0x1e, 0x00, 0x00, 0x00, 0x80, 0x00, 0x00, 0x19},
+			[]byte{0x42, 0xc0, 0x1e, 0x00, 0x00, 0x03, 0x00, 0x80, 0x00, 0x00, 0x19}},
+		{nil, []byte{}},
+	}
+	for _, tt := range tests {
+		got := EscapeRBSP(tt.rbsp)
+		if !bytes.Equal(got, tt.ebsp) {
+			t.Errorf("EscapeRBSP(% x) = % x, want % x", tt.rbsp, got, tt.ebsp)
+		}
+		if back := bitreader.UnescapeRBSP(got); !bytes.Equal(back, tt.rbsp) {
+			t.Errorf("UnescapeRBSP(% x) = % x, want % x", got, back, tt.rbsp)
+		}
+	}
+}
+
+func TestRBSPWriter(t *testing.T) {
+	// zero runs that straddle the flushes of the 64 bit buffer, so the
+	// escaping has to carry its zero count from one write to the next
+	var ebsp bytes.Buffer
+	w := NewRBSPWriter(&ebsp)
+	raw := NewBuffer()
+	for _, v := range []struct {
+		n   uint
+		val uint64
+	}{
+		{48, 0x000000010203}, {16, 0}, {8, 1},
+		{7, 0}, {64, 0x0000000300000000}, {9, 0x1ff},
+		{12, 0x800}, {20, 0},
+	} {
+		if err := w.Write64(v.n, v.val); err != nil {
+			t.Fatal(err)
+		}
+		raw.Write64(v.n, v.val)
+	}
+	// a golomb code run through the escaping too
+	if err := w.WriteUE(0); err != nil {
+		t.Fatal(err)
+	}
+	raw.WriteUE(0)
+	if err := w.WriteTrailingBits(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	raw.WriteTrailingBits()
+	plain := raw.Bytes()
+
+	if want := EscapeRBSP(plain); !bytes.Equal(ebsp.Bytes(), want) {
+		t.Errorf("RBSP writer output\n% x\nwant\n% x", ebsp.Bytes(), want)
+	}
+	for i := 2; i < ebsp.Len(); i++ {
+		if b := ebsp.Bytes(); b[i-2] == 0 && b[i-1] == 0 && b[i] <= 0x02 {
+			t.Errorf("start code emulation 00 00 %02x at %d", b[i], i)
+		}
+	}
+
+	// read back up to rbsp_trailing_bits
+	r := bitreader.NewRBSPReader(ebsp.Bytes())
+	if v, err := r.Read64(48); err != nil || v != 0x000000010203 {
+		t.Errorf("first field 0x%x, %v", v, err)
+	}
+	if err := r.Skip(16 + 8 + 7 + 64 + 9 + 12 + 20); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := r.ReadUE(); err != nil || v != 0 {
+		t.Errorf("ue %d, %v", v, err)
+	}
+	if r.MoreRBSPData() {
+		t.Error("more data before rbsp_trailing_bits")
+	}
+}
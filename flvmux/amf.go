@@ -0,0 +1,60 @@
+package flvmux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+)
+
+// AMF0 type markers
+const (
+	amfNumber    = 0x00
+	amfString    = 0x02
+	amfECMAArray = 0x08
+	amfObjectEnd = 0x09
+)
+
+// amfWriter encodes the AMF0 values of a script tag.
+type amfWriter struct {
+	bytes.Buffer
+}
+
+func (w *amfWriter) u8(v uint8) {
+	w.WriteByte(v)
+}
+
+func (w *amfWriter) u32(v uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	w.Write(b[:])
+}
+
+// key writes a property name, which has no type marker.
+func (w *amfWriter) key(s string) {
+	w.WriteByte(uint8(len(s) >> 8))
+	w.WriteByte(uint8(len(s)))
+	w.WriteString(s)
+}
+
+func (w *amfWriter) string(s string) {
+	w.u8(amfString)
+	w.key(s)
+}
+
+// number writes the property name and its value and returns the offset of
+// the value, so it can be rewritten.
+func (w *amfWriter) number(name string, v float64) int {
+	w.key(name)
+	w.u8(amfNumber)
+	off := w.Len()
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], math.Float64bits(v))
+	w.Write(b[:])
+	return off
+}
+
+// end writes the end of an object or ECMA array.
+func (w *amfWriter) end() {
+	w.key("")
+	w.u8(amfObjectEnd)
+}
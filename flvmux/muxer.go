@@ -0,0 +1,385 @@
+// Package flvmux writes H.264/H.265 video and AAC/G.711 audio as FLV tags,
+// either as an FLV file or as a bare tag stream for RTMP style pipelines.
+package flvmux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+
+	"mpegps-parser/mp4mux"
+	"mpegps-parser/psdemux"
+)
+
+var (
+	ErrUnsupportedCodec = errors.New("unsupported codec")
+)
+
+const (
+	TagTypeAudio  = 8
+	TagTypeVideo  = 9
+	TagTypeScript = 18
+
+	// CodecID of the video tag header; 12 is the H.265 extension used by
+	// most Chinese CDNs and servers
+	CodecIDAVC  = 7
+	CodecIDHEVC = 12
+
+	// SoundFormat of the audio tag header
+	SoundFormatG711A = 7
+	SoundFormatG711U = 8
+	SoundFormatAAC   = 10
+
+	frameTypeKey   = 1
+	frameTypeInter = 2
+
+	packetTypeSequenceHeader = 0
+	packetTypeNALU           = 1 // AACPacketType raw uses the same value
+)
+
+// Options configures a Muxer.
+type Options struct {
+	// VideoCodec is psdemux.CodecH264 or psdemux.CodecH265; any other
+	// value means no video.
+	VideoCodec psdemux.Codec
+	// AudioStreamType is psdemux.StreamTypeAAC, StreamTypeG711A or
+	// StreamTypeG711U; any other value means no audio.
+	AudioStreamType uint8
+}
+
+// Muxer turns access units and audio frames into FLV tags. Timestamps
+// passed to it are in 90kHz units; tags carry milliseconds from the first
+// timestamp written.
+type Muxer struct {
+	w    io.Writer
+	opts Options
+	// header is written before the first tag of a file
+	header  bool
+	base    int64
+	hasBase bool
+	// video decoder configuration last sent in a sequence header
+	vps, sps, pps []byte
+	seqHeader     []byte
+	aacConfig     []byte
+	buf           bytes.Buffer
+	pos           int64  // bytes written
+	lastTS        uint32 // latest tag timestamp
+	// file offsets of the onMetaData values Close fills in, 0 if absent
+	durationPos, widthPos, heightPos int64
+}
+
+// NewMuxer returns a Muxer writing an FLV file: the FLV header, an
+// onMetaData script tag and the other tags, each with its PreviousTagSize.
+// If w is an io.WriteSeeker, Close fills in the duration and picture size
+// of onMetaData.
+func NewMuxer(w io.Writer, opts *Options) *Muxer {
+	return &Muxer{w: w, opts: *opts, header: true}
+}
+
+// NewTagMuxer returns a Muxer writing only tags, each followed by its
+// PreviousTagSize, e.g. to feed an RTMP publisher or an HTTP-FLV
+// connection that already sent the header.
+func NewTagMuxer(w io.Writer, opts *Options) *Muxer {
+	return &Muxer{w: w, opts: *opts}
+}
+
+func (m *Muxer) hasVideo() bool {
+	return m.opts.VideoCodec == psdemux.CodecH264 || m.opts.VideoCodec == psdemux.CodecH265
+}
+
+func (m *Muxer) soundFormat() (uint8, bool) {
+	switch m.opts.AudioStreamType {
+	case psdemux.StreamTypeAAC:
+		return SoundFormatAAC, true
+	case psdemux.StreamTypeG711A:
+		return SoundFormatG711A, true
+	case psdemux.StreamTypeG711U:
+		return SoundFormatG711U, true
+	}
+	return 0, false
+}
+
+// timestamp maps a 90kHz timestamp to FLV milliseconds.
+func (m *Muxer) timestamp(ts uint64) uint32 {
+	if !m.hasBase {
+		m.base, m.hasBase = int64(ts), true
+	}
+	if t := int64(ts) - m.base; t > 0 {
+		return uint32(t / 90)
+	}
+	return 0
+}
+
+// WriteVideo writes one access unit in Annex B format as a NALU tag,
+// preceded by a sequence header whenever the parameter sets change.
+// Frames before the first sequence header are dropped.
+func (m *Muxer) WriteVideo(au []byte, pts, dts uint64) error {
+	if !m.hasVideo() {
+		return ErrUnsupportedCodec
+	}
+	var data []byte
+	key := false
+	for _, nalu := range psdemux.SplitNALUnits(au) {
+		if m.opts.VideoCodec == psdemux.CodecH265 {
+			hdr, ok := psdemux.ParseH265NalHeader(nalu)
+			if !ok {
+				continue
+			}
+			switch {
+			case hdr.Type == psdemux.H265NalVps:
+				m.vps = append(m.vps[:0], nalu...)
+				continue
+			case hdr.Type == psdemux.H265NalSps:
+				m.sps = append(m.sps[:0], nalu...)
+				continue
+			case hdr.Type == psdemux.H265NalPps:
+				m.pps = append(m.pps[:0], nalu...)
+				continue
+			case hdr.Type == psdemux.H265NalAud:
+				continue
+			case hdr.IsIRAP():
+				key = true
+			}
+		} else {
+			hdr, ok := psdemux.ParseH264NalHeader(nalu)
+			if !ok {
+				continue
+			}
+			switch hdr.Type {
+			case psdemux.H264NalSPS:
+				m.sps = append(m.sps[:0], nalu...)
+				continue
+			case psdemux.H264NalPPS:
+				m.pps = append(m.pps[:0], nalu...)
+				continue
+			case psdemux.H264NalAUD:
+				continue
+			case psdemux.H264NalIDR:
+				key = true
+			}
+		}
+		var size [4]byte
+		binary.BigEndian.PutUint32(size[:], uint32(len(nalu)))
+		data = append(data, size[:]...)
+		data = append(data, nalu...)
+	}
+	codecID := uint8(CodecIDAVC)
+	if m.opts.VideoCodec == psdemux.CodecH265 {
+		codecID = CodecIDHEVC
+	}
+	ts := m.timestamp(dts)
+	if err := m.writeSequenceHeader(codecID, ts); err != nil {
+		return err
+	}
+	if m.seqHeader == nil || len(data) == 0 {
+		return nil
+	}
+	frameType := uint8(frameTypeInter)
+	if key {
+		frameType = frameTypeKey
+	}
+	cts := int32(int64(pts)-int64(dts)) / 90
+	hdr := []byte{frameType<<4 | codecID, packetTypeNALU, byte(cts >> 16), byte(cts >> 8), byte(cts)}
+	return m.writeTag(TagTypeVideo, ts, hdr, data)
+}
+
+// writeSequenceHeader sends the decoder configuration record when the
+// parameter sets are complete and differ from the last ones sent.
+func (m *Muxer) writeSequenceHeader(codecID uint8, ts uint32) error {
+	if m.sps == nil || m.pps == nil {
+		return nil
+	}
+	var record []byte
+	if m.opts.VideoCodec == psdemux.CodecH265 {
+		if m.vps == nil {
+			return nil
+		}
+		record = mp4mux.HEVCDecoderConfigurationRecord(m.vps, m.sps, m.pps)
+	} else {
+		record = mp4mux.AVCDecoderConfigurationRecord(m.sps, m.pps)
+	}
+	if bytes.Equal(record, m.seqHeader) {
+		return nil
+	}
+	m.seqHeader = record
+	hdr := []byte{frameTypeKey<<4 | codecID, packetTypeSequenceHeader, 0, 0, 0}
+	return m.writeTag(TagTypeVideo, ts, hdr, record)
+}
+
+// WriteAudio writes audio data: one or more ADTS frames for AAC, sent as
+// raw AAC after an AudioSpecificConfig sequence header, or a block of
+// G.711 samples. pts is the time of the first frame.
+func (m *Muxer) WriteAudio(data []byte, pts uint64) error {
+	format, ok := m.soundFormat()
+	if !ok {
+		return ErrUnsupportedCodec
+	}
+	ts := m.timestamp(pts)
+	if format != SoundFormatAAC {
+		// 5.5kHz rate, 16 bit, mono: the rate field does not apply to G.711
+		return m.writeTag(TagTypeAudio, ts, []byte{format<<4 | 0x2}, data)
+	}
+	elapsed := uint64(0)
+	for len(data) > 0 {
+		h, err := psdemux.ParseADTSHeader(data)
+		if err != nil {
+			return err
+		}
+		if h.FrameLength > len(data) || h.SampleRate() == 0 {
+			return psdemux.ErrADTSHeader
+		}
+		// AAC is always flagged 44kHz, 16 bit, stereo; the real values
+		// are in the AudioSpecificConfig
+		tagHdr := byte(SoundFormatAAC<<4 | 0xf)
+		config := h.AudioSpecificConfig()
+		ts := m.timestamp(pts + elapsed*90000/uint64(h.SampleRate()))
+		if !bytes.Equal(config, m.aacConfig) {
+			m.aacConfig = config
+			if err := m.writeTag(TagTypeAudio, ts, []byte{tagHdr, packetTypeSequenceHeader}, config); err != nil {
+				return err
+			}
+		}
+		if err := m.writeTag(TagTypeAudio, ts, []byte{tagHdr, packetTypeNALU}, data[h.HeaderLength():h.FrameLength]); err != nil {
+			return err
+		}
+		elapsed += uint64(h.Samples())
+		data = data[h.FrameLength:]
+	}
+	return nil
+}
+
+// writeTag writes one FLV tag and its PreviousTagSize, preceded by the
+// FLV header and onMetaData for the first tag of a file.
+func (m *Muxer) writeTag(tagType uint8, ts uint32, hdr, data []byte) error {
+	buf := &m.buf
+	buf.Reset()
+	if m.header {
+		m.header = false
+		flags := uint8(0)
+		if _, ok := m.soundFormat(); ok {
+			flags |= 0x04
+		}
+		if m.hasVideo() {
+			flags |= 0x01
+		}
+		buf.Write([]byte{'F', 'L', 'V', 1, flags, 0, 0, 0, 9})
+		buf.Write([]byte{0, 0, 0, 0}) // PreviousTagSize0
+		m.appendMetadata()
+	}
+	if ts > m.lastTS {
+		m.lastTS = ts
+	}
+	appendTag(buf, tagType, ts, hdr, data)
+	n, err := m.w.Write(buf.Bytes())
+	m.pos += int64(n)
+	return err
+}
+
+// appendTag appends one FLV tag and its PreviousTagSize to buf.
+func appendTag(buf *bytes.Buffer, tagType uint8, ts uint32, hdr, data []byte) {
+	size := len(hdr) + len(data)
+	buf.Write([]byte{
+		tagType,
+		byte(size >> 16), byte(size >> 8), byte(size),
+		byte(ts >> 16), byte(ts >> 8), byte(ts), byte(ts >> 24),
+		0, 0, 0, // StreamID
+	})
+	buf.Write(hdr)
+	buf.Write(data)
+	var prev [4]byte
+	binary.BigEndian.PutUint32(prev[:], uint32(11+size))
+	buf.Write(prev[:])
+}
+
+// appendMetadata appends the onMetaData script tag to m.buf. The duration
+// is not known yet and the picture size only if the SPS came before the
+// first tag; Close fills them in.
+func (m *Muxer) appendMetadata() {
+	var amf amfWriter
+	amf.string("onMetaData")
+	fields := uint32(1)
+	if m.hasVideo() {
+		fields += 3
+	}
+	if _, ok := m.soundFormat(); ok {
+		fields++
+	}
+	amf.u8(amfECMAArray)
+	amf.u32(fields)
+	duration := amf.number("duration", 0)
+	var width, height int
+	if m.hasVideo() {
+		width, height = m.size()
+		codecID := CodecIDAVC
+		if m.opts.VideoCodec == psdemux.CodecH265 {
+			codecID = CodecIDHEVC
+		}
+		m.widthPos = int64(amf.number("width", float64(width)))
+		m.heightPos = int64(amf.number("height", float64(height)))
+		amf.number("videocodecid", float64(codecID))
+	}
+	if format, ok := m.soundFormat(); ok {
+		amf.number("audiocodecid", float64(format))
+	}
+	amf.end()
+	// the values are at these offsets of the tag data
+	start := m.pos + int64(m.buf.Len()) + 11
+	m.durationPos = start + int64(duration)
+	if m.hasVideo() {
+		m.widthPos += start
+		m.heightPos += start
+	}
+	appendTag(&m.buf, TagTypeScript, 0, nil, amf.Bytes())
+}
+
+// size returns the picture size from the last SPS, or 0, 0.
+func (m *Muxer) size() (int, int) {
+	if m.sps == nil {
+		return 0, 0
+	}
+	var p *psdemux.VideoParams
+	var err error
+	if m.opts.VideoCodec == psdemux.CodecH265 {
+		p, err = psdemux.ParseH265SPS(m.sps)
+	} else {
+		p, err = psdemux.ParseH264SPS(m.sps)
+	}
+	if err != nil {
+		return 0, 0
+	}
+	return p.Width, p.Height
+}
+
+// Close fills in the duration and picture size of onMetaData if the
+// writer is an io.WriteSeeker. It does not close the writer.
+func (m *Muxer) Close() error {
+	ws, ok := m.w.(io.WriteSeeker)
+	if !ok || m.durationPos == 0 {
+		return nil
+	}
+	patch := func(pos int64, v float64) error {
+		if _, err := ws.Seek(pos, io.SeekStart); err != nil {
+			return err
+		}
+		var b [8]byte
+		binary.BigEndian.PutUint64(b[:], math.Float64bits(v))
+		_, err := ws.Write(b[:])
+		return err
+	}
+	if err := patch(m.durationPos, float64(m.lastTS)/1000); err != nil {
+		return err
+	}
+	if m.widthPos != 0 {
+		width, height := m.size()
+		if err := patch(m.widthPos, float64(width)); err != nil {
+			return err
+		}
+		if err := patch(m.heightPos, float64(height)); err != nil {
+			return err
+		}
+	}
+	_, err := ws.Seek(0, io.SeekEnd)
+	return err
+}
@@ -0,0 +1,233 @@
+package flvmux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"math"
+	"testing"
+
+	"mpegps-parser/psdemux"
+)
+
+func mustHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+var (
+	// 1920x1080 H.264 high profile and H.265 main profile parameter sets
+	h264SPS = mustHex("67640028acca501e0089f970110000030001000003003284")
+	h264PPS = mustHex("68ce3c80")
+	h265VPS = mustHex("40010c")
+	h265SPS = mustHex("420101016000000300b00000030000030078a003c0801107cb96b924c9af77ff8002000180800001f480003a9810")
+	h265PPS = mustHex("4401c1")
+)
+
+// annexB joins NAL units with start codes.
+func annexB(nalus ...[]byte) []byte {
+	var b []byte
+	for _, nalu := range nalus {
+		b = append(append(b, 0, 0, 0, 1), nalu...)
+	}
+	return b
+}
+
+type tag struct {
+	typ  uint8
+	ts   uint32
+	data []byte
+}
+
+// parseTags splits the tags following the FLV header, checking that every
+// PreviousTagSize matches the tag before it.
+func parseTags(t *testing.T, b []byte) []tag {
+	if binary.BigEndian.Uint32(b) != 0 {
+		t.Fatalf("PreviousTagSize0 % x", b[:4])
+	}
+	b = b[4:]
+	var tags []tag
+	for len(b) > 0 {
+		if len(b) < 15 {
+			t.Fatalf("%d bytes left after %d tags", len(b), len(tags))
+		}
+		size := int(b[1])<<16 | int(b[2])<<8 | int(b[3])
+		ts := uint32(b[7])<<24 | uint32(b[4])<<16 | uint32(b[5])<<8 | uint32(b[6])
+		if prev := int(binary.BigEndian.Uint32(b[11+size:])); prev != 11+size {
+			t.Fatalf("tag %d: PreviousTagSize %d, want %d", len(tags), prev, 11+size)
+		}
+		tags = append(tags, tag{b[0], ts, b[11 : 11+size]})
+		b = b[15+size:]
+	}
+	return tags
+}
+
+// seekBuffer is an in-memory io.WriteSeeker.
+type seekBuffer struct {
+	b   []byte
+	pos int
+}
+
+func (s *seekBuffer) Write(p []byte) (int, error) {
+	if n := s.pos + len(p); n > len(s.b) {
+		s.b = append(s.b, make([]byte, n-len(s.b))...)
+	}
+	copy(s.b[s.pos:], p)
+	s.pos += len(p)
+	return len(p), nil
+}
+
+func (s *seekBuffer) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += int64(s.pos)
+	case io.SeekEnd:
+		offset += int64(len(s.b))
+	}
+	s.pos = int(offset)
+	return offset, nil
+}
+
+// metadataNumber returns the value of a number property of onMetaData.
+func metadataNumber(t *testing.T, data []byte, name string) float64 {
+	key := append([]byte{0, uint8(len(name))}, name...)
+	i := bytes.Index(data, append(key, amfNumber))
+	if i < 0 {
+		t.Fatalf("no %s in onMetaData", name)
+	}
+	return math.Float64frombits(binary.BigEndian.Uint64(data[i+len(key)+1:]))
+}
+
+func TestVideo(t *testing.T) {
+	tests := []struct {
+		codec   psdemux.Codec
+		codecID uint8
+		params  [][]byte
+		key     []byte
+		inter   []byte
+	}{
+		{psdemux.CodecH264, CodecIDAVC, [][]byte{h264SPS, h264PPS}, []byte{0x65, 0x88}, []byte{0x41, 0x9a}},
+		{psdemux.CodecH265, CodecIDHEVC, [][]byte{h265VPS, h265SPS, h265PPS}, []byte{0x26, 0x01, 0xaf}, []byte{0x02, 0x01, 0xd0}},
+	}
+	for _, tt := range tests {
+		w := &seekBuffer{}
+		m := NewMuxer(w, &Options{VideoCodec: tt.codec})
+		key := annexB(append(tt.params, tt.key)...)
+		if err := m.WriteVideo(key, 3600+3600, 3600); err != nil {
+			t.Fatal(err)
+		}
+		// past the 24 bits of the timestamp field, 5 hours later
+		late := uint64(3600 + 5*3600*90000)
+		if err := m.WriteVideo(annexB(tt.inter), late, late); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.Close(); err != nil {
+			t.Fatal(err)
+		}
+		b := w.b
+		if !bytes.Equal(b[:9], []byte{'F', 'L', 'V', 1, 0x01, 0, 0, 0, 9}) {
+			t.Errorf("%s: flv header % x", tt.codec, b[:9])
+		}
+		tags := parseTags(t, b[9:])
+		if len(tags) != 4 {
+			t.Fatalf("%s: %d tags, want onMetaData, sequence header and 2 frames", tt.codec, len(tags))
+		}
+
+		meta := tags[0]
+		if meta.typ != TagTypeScript || !bytes.HasPrefix(meta.data, []byte("\x02\x00\x0aonMetaData\x08")) {
+			t.Errorf("%s: first tag %d % x, want onMetaData", tt.codec, meta.typ, meta.data)
+		}
+		for name, want := range map[string]float64{"duration": 5 * 3600, "width": 1920, "height": 1080, "videocodecid": float64(tt.codecID)} {
+			if got := metadataNumber(t, meta.data, name); got != want {
+				t.Errorf("%s: onMetaData %s %v, want %v", tt.codec, name, got, want)
+			}
+		}
+
+		seq := tags[1]
+		if seq.typ != TagTypeVideo || seq.data[0] != frameTypeKey<<4|tt.codecID || seq.data[1] != packetTypeSequenceHeader {
+			t.Errorf("%s: sequence header % x", tt.codec, seq.data[:5])
+		}
+		// configurationVersion and the profile from the SPS
+		record := seq.data[5:]
+		if tt.codec == psdemux.CodecH264 && (record[0] != 1 || record[1] != h264SPS[1]) {
+			t.Errorf("h264: AVCDecoderConfigurationRecord % x", record[:4])
+		}
+		if tt.codec == psdemux.CodecH265 && (record[0] != 1 || record[1]&0x1f != 1) {
+			t.Errorf("h265: HEVCDecoderConfigurationRecord % x", record[:4])
+		}
+
+		frame := tags[2]
+		if frame.typ != TagTypeVideo || frame.ts != 0 || frame.data[0] != frameTypeKey<<4|tt.codecID || frame.data[1] != packetTypeNALU {
+			t.Errorf("%s: key frame ts %d % x", tt.codec, frame.ts, frame.data[:5])
+		}
+		// composition time 40ms, then one length prefixed NAL unit
+		if cts := int(frame.data[2])<<16 | int(frame.data[3])<<8 | int(frame.data[4]); cts != 40 {
+			t.Errorf("%s: composition time %d, want 40", tt.codec, cts)
+		}
+		if want := append([]byte{0, 0, 0, uint8(len(tt.key))}, tt.key...); !bytes.Equal(frame.data[5:], want) {
+			t.Errorf("%s: key frame data % x, want % x", tt.codec, frame.data[5:], want)
+		}
+		frame = tags[3]
+		if frame.ts != 5*3600*1000 || frame.data[0] != frameTypeInter<<4|tt.codecID {
+			t.Errorf("%s: inter frame ts %d % x", tt.codec, frame.ts, frame.data[:5])
+		}
+		// the top 8 bits of the timestamp go to TimestampExtended
+		if ext := b[len(b)-4-len(frame.data)-4]; ext != uint8(frame.ts>>24) || ext == 0 {
+			t.Errorf("%s: TimestampExtended %d", tt.codec, ext)
+		}
+	}
+}
+
+func TestAAC(t *testing.T) {
+	// AAC LC 48kHz stereo, two frames
+	adts := func(n int) []byte {
+		f := []byte{0xff, 0xf1, 0x4c, 0x80 | uint8(n>>11), uint8(n >> 3), uint8(n&7)<<5 | 0x1f, 0xfc}
+		return append(f, bytes.Repeat([]byte{0x21}, n-len(f))...)
+	}
+	var b bytes.Buffer
+	m := NewMuxer(&b, &Options{AudioStreamType: psdemux.StreamTypeAAC})
+	if err := m.WriteAudio(append(adts(100), adts(120)...), 9000); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b.Bytes()[:9], []byte{'F', 'L', 'V', 1, 0x04, 0, 0, 0, 9}) {
+		t.Errorf("flv header % x", b.Bytes()[:9])
+	}
+	tags := parseTags(t, b.Bytes()[9:])
+	if len(tags) != 4 {
+		t.Fatalf("%d tags, want onMetaData, sequence header and 2 frames", len(tags))
+	}
+	if got := metadataNumber(t, tags[0].data, "audiocodecid"); got != SoundFormatAAC {
+		t.Errorf("audiocodecid %v", got)
+	}
+	// AudioSpecificConfig: object type 2, sampling index 3, 2 channels
+	if seq := tags[1]; seq.typ != TagTypeAudio || !bytes.Equal(seq.data, []byte{0xaf, 0, 0x11, 0x90}) {
+		t.Errorf("aac sequence header % x", seq.data)
+	}
+	for i, n := range []int{100, 120} {
+		frame := tags[2+i]
+		if frame.data[0] != 0xaf || frame.data[1] != packetTypeNALU || len(frame.data) != 2+n-7 {
+			t.Errorf("frame %d: % x... %d bytes", i, frame.data[:2], len(frame.data))
+		}
+	}
+	// the second frame follows 1024 samples later
+	if tags[3].ts != 21 {
+		t.Errorf("second frame at %dms, want 21", tags[3].ts)
+	}
+}
+
+func TestTagMuxer(t *testing.T) {
+	var b bytes.Buffer
+	m := NewTagMuxer(&b, &Options{AudioStreamType: psdemux.StreamTypeG711A})
+	if err := m.WriteAudio(bytes.Repeat([]byte{0xd5}, 160), 0); err != nil {
+		t.Fatal(err)
+	}
+	// no header, no onMetaData
+	tags := parseTags(t, append([]byte{0, 0, 0, 0}, b.Bytes()...))
+	if len(tags) != 1 || tags[0].typ != TagTypeAudio || tags[0].data[0] != SoundFormatG711A<<4|0x2 {
+		t.Errorf("tags %+v", tags)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import "mpegps-parser/psdemux"
+
+// frameAssembler joins video PES payloads into access units. A PES packet
+// with a PTS starts a new access unit; GB28181 devices split large frames
+// over several PES packets and only the first carries timestamps.
+type frameAssembler struct {
+	au   []byte
+	pts  uint64
+	dts  uint64
+	emit func(au []byte, pts, dts uint64)
+}
+
+func (a *frameAssembler) push(pkt *psdemux.PESPacket) {
+	hdr := &pkt.Header
+	if hdr.HasPTS() {
+		a.flush()
+		a.pts, a.dts = hdr.PTS, hdr.PTS
+		if hdr.HasDTS() {
+			a.dts = hdr.DTS
+		}
+	} else if a.au == nil {
+		// the start of this frame was lost
+		return
+	}
+	a.au = append(a.au, pkt.Payload...)
+}
+
+// flush emits the pending access unit.
+func (a *frameAssembler) flush() {
+	if len(a.au) > 0 {
+		a.emit(a.au, a.pts, a.dts)
+	}
+	a.au = nil
+}
+
+// drop discards the access unit a corrupt PES packet belongs to. If the
+// packet starts a frame the pending one is complete and emitted, otherwise
+// the pending one is damaged. Either way the PES packets without PTS that
+// follow are ignored until the next frame starts.
+func (a *frameAssembler) drop(pkt *psdemux.PESPacket) {
+	if pkt.Header.HasPTS() {
+		a.flush()
+		return
+	}
+	a.au = nil
+}
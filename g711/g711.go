@@ -0,0 +1,71 @@
+// Package g711 decodes ITU-T G.711 A-law and μ-law samples to 16-bit
+// linear PCM.
+package g711
+
+var (
+	alawTable [256]int16
+	ulawTable [256]int16
+)
+
+func init() {
+	for i := range alawTable {
+		alawTable[i] = decodeALaw(uint8(i))
+		ulawTable[i] = decodeULaw(uint8(i))
+	}
+}
+
+func decodeALaw(a uint8) int16 {
+	a ^= 0x55
+	t := int16(a&0x0f) << 4
+	switch seg := a & 0x70 >> 4; seg {
+	case 0:
+		t += 8
+	case 1:
+		t += 0x108
+	default:
+		t = (t + 0x108) << (seg - 1)
+	}
+	if a&0x80 != 0 {
+		return t
+	}
+	return -t
+}
+
+func decodeULaw(u uint8) int16 {
+	u = ^u
+	t := (int16(u&0x0f)<<3 + 0x84) << (u & 0x70 >> 4)
+	if u&0x80 != 0 {
+		return 0x84 - t
+	}
+	return t - 0x84
+}
+
+// DecodeALaw returns the linear value of an A-law sample.
+func DecodeALaw(a uint8) int16 {
+	return alawTable[a]
+}
+
+// DecodeULaw returns the linear value of a μ-law sample.
+func DecodeULaw(u uint8) int16 {
+	return ulawTable[u]
+}
+
+// ALawToPCM appends the samples of src, decoded to little endian 16-bit
+// PCM, to dst.
+func ALawToPCM(dst, src []byte) []byte {
+	return toPCM(dst, src, &alawTable)
+}
+
+// ULawToPCM appends the samples of src, decoded to little endian 16-bit
+// PCM, to dst.
+func ULawToPCM(dst, src []byte) []byte {
+	return toPCM(dst, src, &ulawTable)
+}
+
+func toPCM(dst, src []byte, table *[256]int16) []byte {
+	for _, b := range src {
+		v := uint16(table[b])
+		dst = append(dst, uint8(v), uint8(v>>8))
+	}
+	return dst
+}
@@ -0,0 +1,88 @@
+package g711
+
+import (
+	"bytes"
+	"testing"
+)
+
+// values of ITU-T G.711 Table 1a and 2a
+func TestDecode(t *testing.T) {
+	alaw := []struct {
+		a   uint8
+		pcm int16
+	}{
+		{0xd5, 8},
+		{0x55, -8},
+		{0xd4, 24},
+		{0x54, -24},
+		{0xc5, 264},
+		{0xaa, 32256},
+		{0x2a, -32256},
+	}
+	for _, tt := range alaw {
+		if got := DecodeALaw(tt.a); got != tt.pcm {
+			t.Errorf("A-law 0x%02x = %d, want %d", tt.a, got, tt.pcm)
+		}
+	}
+	ulaw := []struct {
+		u   uint8
+		pcm int16
+	}{
+		{0xff, 0},
+		{0x7f, 0},
+		{0xfe, 8},
+		{0x7e, -8},
+		{0xef, 132},
+		{0xd5, 716},
+		{0x80, 32124},
+		{0x00, -32124},
+	}
+	for _, tt := range ulaw {
+		if got := DecodeULaw(tt.u); got != tt.pcm {
+			t.Errorf("μ-law 0x%02x = %d, want %d", tt.u, got, tt.pcm)
+		}
+	}
+}
+
+func TestSymmetry(t *testing.T) {
+	// the sign bit alone flips the value, and the magnitude grows with the
+	// code within each sign
+	for i := 0; i < 0x80; i++ {
+		a, u := uint8(i), uint8(i)
+		if p, n := DecodeALaw(a|0x80), DecodeALaw(a); p != -n || p <= 0 {
+			t.Errorf("A-law 0x%02x = %d, 0x%02x = %d", a|0x80, p, a, n)
+		}
+		if p, n := DecodeULaw(u|0x80), DecodeULaw(u); p != -n || p < 0 {
+			t.Errorf("μ-law 0x%02x = %d, 0x%02x = %d", u|0x80, p, u, n)
+		}
+		if i == 0 {
+			continue
+		}
+		// A-law inverts the even bits, μ-law all of them
+		if DecodeALaw(uint8(i^0x55)|0x80) <= DecodeALaw(uint8((i-1)^0x55)|0x80) {
+			t.Errorf("A-law not increasing at step %d", i)
+		}
+		if DecodeULaw(^uint8(i)) <= DecodeULaw(^uint8(i-1)) {
+			t.Errorf("μ-law not increasing at step %d", i)
+		}
+	}
+}
+
+func TestToPCM(t *testing.T) {
+	prefix := []byte{1, 2}
+	tests := []struct {
+		name string
+		got  []byte
+		want []byte
+	}{
+		// little endian samples appended to dst
+		{"A-law", ALawToPCM(prefix, []byte{0xd5, 0x55, 0xaa}), []byte{1, 2, 8, 0, 0xf8, 0xff, 0x00, 0x7e}},
+		{"μ-law", ULawToPCM(prefix, []byte{0xff, 0x7e, 0x00}), []byte{1, 2, 0, 0, 0xf8, 0xff, 0x84, 0x82}},
+		{"empty", ALawToPCM(nil, nil), nil},
+	}
+	for _, tt := range tests {
+		if !bytes.Equal(tt.got, tt.want) {
+			t.Errorf("%s: % x, want % x", tt.name, tt.got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package mp4mux
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// boxWriter builds nested ISO BMFF boxes in memory, filling in each box
+// size when the box is closed.
+type boxWriter struct {
+	bytes.Buffer
+	open []int
+}
+
+func (b *boxWriter) start(typ string) {
+	b.open = append(b.open, b.Len())
+	b.u32(0)
+	b.WriteString(typ)
+}
+
+// startFull starts a FullBox.
+func (b *boxWriter) startFull(typ string, version uint8, flags uint32) {
+	b.start(typ)
+	b.u32(uint32(version)<<24 | flags)
+}
+
+func (b *boxWriter) end() {
+	start := b.open[len(b.open)-1]
+	b.open = b.open[:len(b.open)-1]
+	binary.BigEndian.PutUint32(b.Bytes()[start:], uint32(b.Len()-start))
+}
+
+func (b *boxWriter) u8(v uint8) {
+	b.WriteByte(v)
+}
+
+func (b *boxWriter) u16(v uint16) {
+	b.Write([]byte{byte(v >> 8), byte(v)})
+}
+
+func (b *boxWriter) u32(v uint32) {
+	b.Write([]byte{byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)})
+}
+
+func (b *boxWriter) u64(v uint64) {
+	b.u32(uint32(v >> 32))
+	b.u32(uint32(v))
+}
+
+// time writes a time or duration of a version 1 box in 64 bits, of a
+// version 0 box in 32.
+func (b *boxWriter) time(v uint64, version uint8) {
+	if version == 1 {
+		b.u64(v)
+	} else {
+		b.u32(uint32(v))
+	}
+}
+
+// timeVersion returns the box version the durations need: 1 with 64-bit
+// fields when one of them does not fit in 32 bits.
+func timeVersion(durations ...uint64) uint8 {
+	for _, d := range durations {
+		if d > 0xffffffff {
+			return 1
+		}
+	}
+	return 0
+}
+
+func (b *boxWriter) zeros(n int) {
+	for i := 0; i < n; i++ {
+		b.WriteByte(0)
+	}
+}
+
+// matrix writes the unity transformation matrix of mvhd and tkhd.
+func (b *boxWriter) matrix() {
+	for _, v := range []uint32{0x10000, 0, 0, 0, 0x10000, 0, 0, 0, 0x40000000} {
+		b.u32(v)
+	}
+}
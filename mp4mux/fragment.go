@@ -0,0 +1,103 @@
+package mp4mux
+
+import "encoding/binary"
+
+const (
+	// sample_flags of trun
+	sampleFlagsSync    = 0x02000000 // sample_depends_on 2
+	sampleFlagsNonSync = 0x01010000 // sample_depends_on 1, sample_is_non_sync_sample
+
+	trunDataOffset = 0x000001
+	trunDuration   = 0x000100
+	trunSize       = 0x000200
+	trunFlags      = 0x000400
+	trunCTO        = 0x000800
+
+	tfhdDefaultBaseIsMoof = 0x020000
+)
+
+// writeFragment writes the buffered samples of every track as one
+// moof/mdat pair, preceded by the initialization segment the first time.
+// A video sample whose duration is not known yet stays for the next one.
+func (m *Muxer) writeFragment() error {
+	if !m.started {
+		m.dropUnreadyTracks()
+		if err := m.start(); err != nil {
+			return err
+		}
+		b := &boxWriter{}
+		m.writeMoov(b)
+		if err := m.write(b.Bytes()); err != nil {
+			return err
+		}
+	}
+	type part struct {
+		t       *track
+		samples []sample
+	}
+	var parts []part
+	for _, t := range m.tracks {
+		n := len(t.samples)
+		if n > 0 && t.samples[n-1].duration == 0 {
+			n--
+		}
+		if n > 0 {
+			parts = append(parts, part{t, t.samples[:n]})
+		}
+	}
+	if len(parts) == 0 {
+		return nil
+	}
+	m.seq++
+	b := &boxWriter{}
+	b.start("moof")
+	b.startFull("mfhd", 0, 0)
+	b.u32(m.seq)
+	b.end()
+	dataOffsets := make([]int, len(parts))
+	for i, p := range parts {
+		flags := uint32(trunDataOffset | trunDuration | trunSize | trunFlags)
+		if hasCompositionOffsets(p.samples) {
+			flags |= trunCTO
+		}
+		b.start("traf")
+		b.startFull("tfhd", 0, tfhdDefaultBaseIsMoof)
+		b.u32(p.t.id)
+		b.end()
+		b.startFull("tfdt", 1, 0)
+		b.u64(uint64(p.samples[0].time))
+		b.end()
+		b.startFull("trun", 1, flags)
+		b.u32(uint32(len(p.samples)))
+		dataOffsets[i] = b.Len()
+		b.u32(0) // data_offset, filled in below
+		for _, s := range p.samples {
+			b.u32(s.duration)
+			b.u32(s.size)
+			if s.key {
+				b.u32(sampleFlagsSync)
+			} else {
+				b.u32(sampleFlagsNonSync)
+			}
+			if flags&trunCTO != 0 {
+				b.u32(uint32(s.cto))
+			}
+		}
+		b.end()
+		b.end()
+	}
+	b.end()
+	moofSize := b.Len()
+	offset := moofSize + 8
+	b.start("mdat")
+	for i, p := range parts {
+		binary.BigEndian.PutUint32(b.Bytes()[dataOffsets[i]:], uint32(offset))
+		for _, s := range p.samples {
+			b.Write(s.data)
+			offset += len(s.data)
+		}
+		p.t.samples = append(p.t.samples[:0], p.t.samples[len(p.samples):]...)
+	}
+	b.end()
+	return m.write(b.Bytes())
+}
@@ -0,0 +1,372 @@
+package mp4mux
+
+import "mpegps-parser/psdemux"
+
+// ftypBox returns the ftyp box.
+func ftypBox(fragmented bool) []byte {
+	b := &boxWriter{}
+	writeFtyp(b, fragmented)
+	return b.Bytes()
+}
+
+func writeFtyp(b *boxWriter, fragmented bool) {
+	b.start("ftyp")
+	if fragmented {
+		b.WriteString("iso5")
+		b.u32(512)
+		b.WriteString("iso5iso6mp41")
+	} else {
+		b.WriteString("isom")
+		b.u32(512)
+		b.WriteString("isomiso2avc1mp41")
+	}
+	b.end()
+}
+
+// movieDuration converts a duration in the track timescale to the movie
+// timescale.
+func (t *track) movieDuration(d uint64) uint64 {
+	if t.timescale == 0 {
+		return 0
+	}
+	return d * movieTimescale / uint64(t.timescale)
+}
+
+// writeMoov writes the moov box. For fragmented mp4 the sample tables are
+// empty and mvex announces the fragments.
+func (m *Muxer) writeMoov(b *boxWriter) {
+	fragmented := m.opts.Fragmented
+	var duration uint64
+	for _, t := range m.tracks {
+		if d := t.movieDuration(t.duration + uint64(t.startTime)); d > duration && !fragmented {
+			duration = d
+		}
+	}
+	b.start("moov")
+	version := timeVersion(duration)
+	b.startFull("mvhd", version, 0)
+	b.time(0, version) // creation_time
+	b.time(0, version) // modification_time
+	b.u32(movieTimescale)
+	b.time(duration, version)
+	b.u32(0x00010000) // rate
+	b.u16(0x0100)     // volume
+	b.zeros(10)
+	b.matrix()
+	b.zeros(24) // pre_defined
+	b.u32(uint32(len(m.tracks) + 1))
+	b.end()
+	for _, t := range m.tracks {
+		m.writeTrak(b, t)
+	}
+	if fragmented {
+		b.start("mvex")
+		for _, t := range m.tracks {
+			b.startFull("trex", 0, 0)
+			b.u32(t.id)
+			b.u32(1) // default_sample_description_index
+			b.u32(0) // default_sample_duration
+			b.u32(0) // default_sample_size
+			b.u32(0) // default_sample_flags
+			b.end()
+		}
+		b.end()
+	}
+	b.end()
+}
+
+func (m *Muxer) writeTrak(b *boxWriter, t *track) {
+	fragmented := m.opts.Fragmented
+	duration := t.duration
+	if fragmented {
+		duration = 0
+	}
+	b.start("trak")
+	tkhdDuration := t.movieDuration(duration + uint64(t.startTime))
+	version := timeVersion(tkhdDuration)
+	b.startFull("tkhd", version, 0x3) // enabled, in movie
+	b.time(0, version)
+	b.time(0, version)
+	b.u32(t.id)
+	b.u32(0)
+	b.time(tkhdDuration, version)
+	b.zeros(8)
+	b.u16(0) // layer
+	b.u16(0) // alternate_group
+	if t.video {
+		b.u16(0)
+	} else {
+		b.u16(0x0100)
+	}
+	b.u16(0)
+	b.matrix()
+	width, height := t.size()
+	b.u32(uint32(width) << 16)
+	b.u32(uint32(height) << 16)
+	b.end()
+	if !fragmented && t.startTime > 0 {
+		// an empty edit delays a track starting after the other one
+		b.start("edts")
+		empty, media := t.movieDuration(uint64(t.startTime)), t.movieDuration(duration)
+		version := timeVersion(empty, media)
+		b.startFull("elst", version, 0)
+		b.u32(2)
+		b.time(empty, version)
+		b.time(0xffffffffffffffff, version) // media_time -1
+		b.u32(0x00010000)
+		b.time(media, version)
+		b.time(0, version)
+		b.u32(0x00010000)
+		b.end()
+		b.end()
+	}
+	b.start("mdia")
+	version = timeVersion(duration)
+	b.startFull("mdhd", version, 0)
+	b.time(0, version)
+	b.time(0, version)
+	b.u32(t.timescale)
+	b.time(duration, version)
+	b.u16(0x55c4) // language "und"
+	b.u16(0)
+	b.end()
+	b.startFull("hdlr", 0, 0)
+	b.u32(0)
+	if t.video {
+		b.WriteString("vide")
+	} else {
+		b.WriteString("soun")
+	}
+	b.zeros(12)
+	if t.video {
+		b.WriteString("VideoHandler\x00")
+	} else {
+		b.WriteString("SoundHandler\x00")
+	}
+	b.end()
+	b.start("minf")
+	if t.video {
+		b.startFull("vmhd", 0, 1)
+		b.zeros(8) // graphicsmode, opcolor
+	} else {
+		b.startFull("smhd", 0, 0)
+		b.zeros(4) // balance, reserved
+	}
+	b.end()
+	b.start("dinf")
+	b.startFull("dref", 0, 0)
+	b.u32(1)
+	b.startFull("url ", 0, 1) // media data is in this file
+	b.end()
+	b.end()
+	b.end()
+	m.writeStbl(b, t)
+	b.end() // minf
+	b.end() // mdia
+	b.end() // trak
+}
+
+// size returns the picture size from the SPS.
+func (t *track) size() (int, int) {
+	if t.params == nil {
+		return 0, 0
+	}
+	return t.params.Width, t.params.Height
+}
+
+func (m *Muxer) writeStbl(b *boxWriter, t *track) {
+	samples := t.samples
+	if m.opts.Fragmented {
+		samples = nil
+	}
+	b.start("stbl")
+	b.startFull("stsd", 0, 0)
+	b.u32(1)
+	if t.video {
+		t.writeVisualSampleEntry(b)
+	} else {
+		t.writeAudioSampleEntry(b)
+	}
+	b.end()
+
+	// stts: run length coded sample durations
+	b.startFull("stts", 0, 0)
+	type run struct{ count, value uint32 }
+	var runs []run
+	for _, s := range samples {
+		if n := len(runs); n > 0 && runs[n-1].value == s.duration {
+			runs[n-1].count++
+		} else {
+			runs = append(runs, run{1, s.duration})
+		}
+	}
+	b.u32(uint32(len(runs)))
+	for _, r := range runs {
+		b.u32(r.count)
+		b.u32(r.value)
+	}
+	b.end()
+
+	if hasCompositionOffsets(samples) {
+		b.startFull("ctts", 1, 0)
+		runs = runs[:0]
+		for _, s := range samples {
+			if n := len(runs); n > 0 && runs[n-1].value == uint32(s.cto) {
+				runs[n-1].count++
+			} else {
+				runs = append(runs, run{1, uint32(s.cto)})
+			}
+		}
+		b.u32(uint32(len(runs)))
+		for _, r := range runs {
+			b.u32(r.count)
+			b.u32(r.value)
+		}
+		b.end()
+	}
+
+	if t.video && len(samples) > 0 {
+		var sync []uint32
+		for i, s := range samples {
+			if s.key {
+				sync = append(sync, uint32(i+1))
+			}
+		}
+		if len(sync) < len(samples) {
+			b.startFull("stss", 0, 0)
+			b.u32(uint32(len(sync)))
+			for _, n := range sync {
+				b.u32(n)
+			}
+			b.end()
+		}
+	}
+
+	// every sample is its own chunk
+	b.startFull("stsc", 0, 0)
+	if len(samples) > 0 {
+		b.u32(1)
+		b.u32(1) // first_chunk
+		b.u32(1) // samples_per_chunk
+		b.u32(1) // sample_description_index
+	} else {
+		b.u32(0)
+	}
+	b.end()
+
+	b.startFull("stsz", 0, 0)
+	b.u32(0) // sample_size
+	b.u32(uint32(len(samples)))
+	for _, s := range samples {
+		b.u32(s.size)
+	}
+	b.end()
+
+	large := len(samples) > 0 && samples[len(samples)-1].offset > 0xffffffff
+	if large {
+		b.startFull("co64", 0, 0)
+	} else {
+		b.startFull("stco", 0, 0)
+	}
+	b.u32(uint32(len(samples)))
+	for _, s := range samples {
+		if large {
+			b.u64(uint64(s.offset))
+		} else {
+			b.u32(uint32(s.offset))
+		}
+	}
+	b.end()
+	b.end() // stbl
+}
+
+func hasCompositionOffsets(samples []sample) bool {
+	for _, s := range samples {
+		if s.cto != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *track) writeVisualSampleEntry(b *boxWriter) {
+	if t.codec == psdemux.CodecH265 {
+		b.start("hvc1")
+	} else {
+		b.start("avc1")
+	}
+	b.zeros(6)
+	b.u16(1) // data_reference_index
+	b.zeros(16)
+	width, height := t.size()
+	b.u16(uint16(width))
+	b.u16(uint16(height))
+	b.u32(0x00480000) // 72 dpi
+	b.u32(0x00480000)
+	b.u32(0)
+	b.u16(1)    // frame_count
+	b.zeros(32) // compressorname
+	b.u16(0x0018)
+	b.u16(0xffff) // pre_defined -1
+	if t.codec == psdemux.CodecH265 {
+		t.writeHvcC(b)
+	} else {
+		t.writeAvcC(b)
+	}
+	b.end()
+}
+
+func (t *track) writeAvcC(b *boxWriter) {
+	b.start("avcC")
+	b.Write(AVCDecoderConfigurationRecord(t.sps, t.pps))
+	b.end()
+}
+
+func (t *track) writeHvcC(b *boxWriter) {
+	b.start("hvcC")
+	b.Write(HEVCDecoderConfigurationRecord(t.vps, t.sps, t.pps))
+	b.end()
+}
+
+func (t *track) writeAudioSampleEntry(b *boxWriter) {
+	switch t.audioType {
+	case psdemux.StreamTypeG711A:
+		b.start("alaw")
+	case psdemux.StreamTypeG711U:
+		b.start("ulaw")
+	default:
+		b.start("mp4a")
+	}
+	b.zeros(6)
+	b.u16(1) // data_reference_index
+	b.zeros(8)
+	b.u16(uint16(t.channels))
+	b.u16(16) // samplesize
+	b.u32(0)
+	b.u32(uint32(t.sampleRate) << 16)
+	if t.audioType == psdemux.StreamTypeAAC {
+		t.writeEsds(b)
+	}
+	b.end()
+}
+
+// writeEsds writes the ES_Descriptor carrying the AudioSpecificConfig.
+func (t *track) writeEsds(b *boxWriter) {
+	b.startFull("esds", 0, 0)
+	decSpecificInfo := append([]byte{0x05, uint8(len(t.asc))}, t.asc...)
+	decConfig := append([]byte{0x04, uint8(13 + len(decSpecificInfo)),
+		0x40,    // objectTypeIndication: MPEG-4 audio
+		0x15,    // streamType audio, upStream 0, reserved 1
+		0, 0, 0, // bufferSizeDB
+		0, 0, 0, 0, // maxBitrate
+		0, 0, 0, 0, // avgBitrate
+	}, decSpecificInfo...)
+	slConfig := []byte{0x06, 1, 0x02}
+	b.u8(0x03) // ES_DescrTag
+	b.u8(uint8(3 + len(decConfig) + len(slConfig)))
+	b.u16(uint16(t.id)) // ES_ID
+	b.u8(0)
+	b.Write(decConfig)
+	b.Write(slConfig)
+	b.end()
+}
@@ -0,0 +1,69 @@
+package mp4mux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"mpegps-parser/psdemux"
+)
+
+// fullBox returns the version of the first box of type typ in b and the
+// bytes following its version and flags.
+func fullBox(t *testing.T, b []byte, typ string) (uint8, []byte) {
+	i := bytes.Index(b, []byte(typ))
+	if i < 4 {
+		t.Fatalf("no %s box", typ)
+	}
+	size := int(binary.BigEndian.Uint32(b[i-4:]))
+	return b[i+4], b[i+8 : i-4+size]
+}
+
+func TestMoovDurations(t *testing.T) {
+	tests := []struct {
+		duration uint64 // of the track, 8kHz
+		version  uint8
+	}{
+		{8000 * 3600, 0},
+		{0xffffffff, 0},
+		{0xffffffff + 1, 1},
+		{8000 * 3600 * 24 * 7, 1}, // a week of audio, beyond 32 bits of the movie timescale
+	}
+	for _, tt := range tests {
+		m := NewMuxer(nil, &Options{AudioStreamType: psdemux.StreamTypeG711A})
+		m.audio.duration = tt.duration
+		var b boxWriter
+		m.writeMoov(&b)
+
+		version, mdhd := fullBox(t, b.Bytes(), "mdhd")
+		if version != tt.version {
+			t.Errorf("duration %d: mdhd version %d, want %d", tt.duration, version, tt.version)
+		}
+		var got uint64
+		if version == 1 {
+			got = binary.BigEndian.Uint64(mdhd[20:])
+		} else {
+			got = uint64(binary.BigEndian.Uint32(mdhd[12:]))
+		}
+		if got != tt.duration {
+			t.Errorf("duration %d: mdhd duration %d", tt.duration, got)
+		}
+
+		movie := tt.duration * movieTimescale / g711SampleRate
+		// tkhd has track_ID and a reserved field before the duration
+		for typ, skip := range map[string]int{"mvhd": 0, "tkhd": 4} {
+			version, box := fullBox(t, b.Bytes(), typ)
+			if version != timeVersion(movie) {
+				t.Errorf("duration %d: %s version %d", tt.duration, typ, version)
+			}
+			if version == 1 {
+				got = binary.BigEndian.Uint64(box[20+skip:])
+			} else {
+				got = uint64(binary.BigEndian.Uint32(box[12+skip:]))
+			}
+			if got != movie {
+				t.Errorf("duration %d: %s duration %d, want %d", tt.duration, typ, got, movie)
+			}
+		}
+	}
+}
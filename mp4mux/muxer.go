@@ -0,0 +1,418 @@
+// Package mp4mux writes H.264/H.265 video and AAC/G.711 audio into an MP4
+// file (ISO/IEC 14496-12/14), either as a regular file with the moov box at
+// the end or as fragmented MP4 for streaming.
+package mp4mux
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"mpegps-parser/psdemux"
+)
+
+var (
+	ErrUnsupportedCodec = errors.New("unsupported codec")
+	ErrNotSeekable      = errors.New("regular mp4 output must be an io.WriteSeeker")
+)
+
+const (
+	movieTimescale = 1000
+	videoTimescale = 90000
+	g711SampleRate = 8000
+	// defaultFrameDuration is used for the last frame and for frames whose
+	// DTS does not increase, in 90kHz units (25 fps).
+	defaultFrameDuration = 3600
+	// mdatHeaderSize is the size of the mdat header with a 64 bit size.
+	mdatHeaderSize = 16
+)
+
+// Options configures a Muxer.
+type Options struct {
+	// VideoCodec is psdemux.CodecH264 or psdemux.CodecH265; any other
+	// value means no video track.
+	VideoCodec psdemux.Codec
+	// AudioStreamType is psdemux.StreamTypeAAC, StreamTypeG711A or
+	// StreamTypeG711U; any other value means no audio track.
+	AudioStreamType uint8
+	// Fragmented writes an initialization segment followed by one
+	// moof/mdat fragment per GOP (or per second of audio without video).
+	// Otherwise the output must be an io.WriteSeeker.
+	Fragmented bool
+}
+
+type sample struct {
+	data     []byte // held until the fragment is written
+	offset   int64  // file offset in a regular mp4
+	size     uint32
+	time     int64 // decode time in the track timescale
+	duration uint32
+	cto      int32 // composition time offset
+	key      bool
+}
+
+type track struct {
+	id        uint32
+	video     bool
+	timescale uint32
+	codec     psdemux.Codec
+	audioType uint8
+	// video decoder configuration
+	vps, sps, pps []byte
+	params        *psdemux.VideoParams
+	// audio decoder configuration
+	asc        []byte
+	sampleRate int
+	channels   int
+
+	ready     bool // decoder configuration known
+	started   bool
+	startTime int64
+	nextTime  int64 // decode time following the last sample
+	samples   []sample
+	duration  uint64 // of every sample, written or not
+}
+
+// Muxer is the MP4 writer. Timestamps passed to it are in 90kHz units.
+type Muxer struct {
+	w       io.Writer
+	opts    Options
+	video   *track
+	audio   *track
+	tracks  []*track
+	pos     int64 // bytes written
+	started bool  // ftyp (and mdat or init segment) written
+	seq     uint32
+
+	// the last timestamp seen and its time on the muxer timeline, which
+	// starts at 0 with the first one and runs on across the 33-bit wrap
+	lastTS   uint64
+	lastTime int64
+	hasBase  bool
+}
+
+// NewMuxer returns a Muxer writing to w.
+func NewMuxer(w io.Writer, opts *Options) *Muxer {
+	m := &Muxer{w: w, opts: *opts}
+	if opts.VideoCodec == psdemux.CodecH264 || opts.VideoCodec == psdemux.CodecH265 {
+		m.video = &track{video: true, timescale: videoTimescale, codec: opts.VideoCodec}
+		m.tracks = append(m.tracks, m.video)
+	}
+	switch opts.AudioStreamType {
+	case psdemux.StreamTypeAAC:
+		m.audio = &track{audioType: opts.AudioStreamType}
+	case psdemux.StreamTypeG711A, psdemux.StreamTypeG711U:
+		m.audio = &track{audioType: opts.AudioStreamType, timescale: g711SampleRate,
+			sampleRate: g711SampleRate, channels: 1, ready: true}
+	}
+	if m.audio != nil {
+		m.tracks = append(m.tracks, m.audio)
+	}
+	for i, t := range m.tracks {
+		t.id = uint32(i + 1)
+	}
+	return m
+}
+
+// ptsWrap is where the 33-bit PTS and DTS wrap around.
+const ptsWrap = 1 << 33
+
+// tsDiff returns a-b for two 33-bit timestamps; a step of more than half
+// the range is a step back.
+func tsDiff(a, b uint64) int64 {
+	d := int64((a - b) % ptsWrap)
+	if d >= ptsWrap/2 {
+		d -= ptsWrap
+	}
+	return d
+}
+
+// relTime maps a 90kHz timestamp to the muxer timeline. Timestamps are
+// unwrapped relative to the previous one.
+func (m *Muxer) relTime(ts uint64) int64 {
+	if !m.hasBase {
+		m.lastTS, m.hasBase = ts, true
+	}
+	m.lastTime += tsDiff(ts, m.lastTS)
+	m.lastTS = ts
+	if m.lastTime > 0 {
+		return m.lastTime
+	}
+	return 0
+}
+
+// WriteVideo writes one access unit in Annex B format. Frames before the
+// first key frame with its parameter sets are dropped. Parameter sets and
+// access unit delimiters go to the sample entry, not the samples.
+func (m *Muxer) WriteVideo(au []byte, pts, dts uint64) error {
+	t := m.video
+	if t == nil {
+		return ErrUnsupportedCodec
+	}
+	var data []byte
+	key := false
+	for _, nalu := range psdemux.SplitNALUnits(au) {
+		switch t.nalKind(nalu) {
+		case nalParamSet, nalAUD:
+			continue
+		case nalKey:
+			key = true
+		}
+		var size [4]byte
+		binary.BigEndian.PutUint32(size[:], uint32(len(nalu)))
+		data = append(data, size[:]...)
+		data = append(data, nalu...)
+	}
+	if !t.started && !(key && t.ready) || len(data) == 0 {
+		return nil
+	}
+	time := m.relTime(dts)
+	if n := len(t.samples); n > 0 {
+		last := &t.samples[n-1]
+		d := time - last.time
+		if d <= 0 {
+			d = defaultFrameDuration
+		}
+		last.duration = uint32(d)
+		t.duration += uint64(d)
+		t.nextTime = last.time + d
+	}
+	if !t.started {
+		t.started, t.startTime = true, time
+	}
+	if m.opts.Fragmented && key && len(t.samples) > 0 {
+		if err := m.writeFragment(); err != nil {
+			return err
+		}
+	}
+	s := sample{size: uint32(len(data)), time: time, cto: int32(tsDiff(pts, dts)), key: key}
+	if err := m.addSample(t, s, data); err != nil {
+		return err
+	}
+	return nil
+}
+
+// WriteAudio writes audio data: one or more ADTS frames for AAC, or a
+// block of G.711 samples. pts is the time of the first frame; the
+// following frames are timed by their sample count.
+func (m *Muxer) WriteAudio(data []byte, pts uint64) error {
+	t := m.audio
+	if t == nil {
+		return ErrUnsupportedCodec
+	}
+	if t.audioType != psdemux.StreamTypeAAC {
+		return m.writeAudioFrame(t, data, len(data), pts)
+	}
+	for len(data) > 0 {
+		h, err := psdemux.ParseADTSHeader(data)
+		if err != nil {
+			return err
+		}
+		if h.FrameLength > len(data) {
+			return psdemux.ErrADTSHeader
+		}
+		if !t.ready {
+			t.asc = h.AudioSpecificConfig()
+			t.sampleRate, t.channels = h.SampleRate(), int(h.ChannelConfig)
+			t.timescale = uint32(t.sampleRate)
+			t.ready = t.sampleRate != 0
+		}
+		if err := m.writeAudioFrame(t, data[h.HeaderLength():h.FrameLength], h.Samples(), pts); err != nil {
+			return err
+		}
+		data = data[h.FrameLength:]
+	}
+	return nil
+}
+
+func (m *Muxer) writeAudioFrame(t *track, frame []byte, samples int, pts uint64) error {
+	if !t.ready || len(frame) == 0 {
+		return nil
+	}
+	if !t.started {
+		t.started = true
+		t.startTime = m.relTime(pts) * int64(t.timescale) / videoTimescale
+		t.nextTime = t.startTime
+	}
+	if m.opts.Fragmented && m.video == nil && len(t.samples) > 0 &&
+		t.nextTime-t.samples[0].time >= int64(t.timescale) {
+		if err := m.writeFragment(); err != nil {
+			return err
+		}
+	}
+	s := sample{size: uint32(len(frame)), time: t.nextTime, duration: uint32(samples), key: true}
+	t.nextTime += int64(samples)
+	t.duration += uint64(samples)
+	return m.addSample(t, s, frame)
+}
+
+// addSample appends s to t, writing its data to the mdat of a regular mp4
+// right away.
+func (m *Muxer) addSample(t *track, s sample, data []byte) error {
+	if m.opts.Fragmented {
+		s.data = append([]byte(nil), data...)
+	} else {
+		if err := m.start(); err != nil {
+			return err
+		}
+		s.offset = m.pos
+		if err := m.write(data); err != nil {
+			return err
+		}
+	}
+	t.samples = append(t.samples, s)
+	return nil
+}
+
+// start writes ftyp and, for a regular mp4, the mdat header.
+func (m *Muxer) start() error {
+	if m.started {
+		return nil
+	}
+	m.started = true
+	b := &boxWriter{}
+	writeFtyp(b, m.opts.Fragmented)
+	if !m.opts.Fragmented {
+		if _, ok := m.w.(io.WriteSeeker); !ok {
+			return ErrNotSeekable
+		}
+		// the size is filled in by Close
+		b.u32(1)
+		b.WriteString("mdat")
+		b.u64(0)
+	}
+	return m.write(b.Bytes())
+}
+
+func (m *Muxer) write(p []byte) error {
+	n, err := m.w.Write(p)
+	m.pos += int64(n)
+	return err
+}
+
+// Close finishes the file: the last fragment, or the moov box and mdat
+// size of a regular mp4. It does not close the writer.
+func (m *Muxer) Close() error {
+	if t := m.video; t != nil && len(t.samples) > 0 {
+		if last := &t.samples[len(t.samples)-1]; last.duration == 0 {
+			last.duration = defaultFrameDuration
+			t.duration += defaultFrameDuration
+		}
+	}
+	if m.opts.Fragmented {
+		return m.writeFragment()
+	}
+	if err := m.start(); err != nil {
+		return err
+	}
+	m.dropUnreadyTracks()
+	mdatSize := m.pos - int64(len(ftypBox(false)))
+	b := &boxWriter{}
+	m.writeMoov(b)
+	if err := m.write(b.Bytes()); err != nil {
+		return err
+	}
+	ws := m.w.(io.WriteSeeker)
+	if _, err := ws.Seek(int64(len(ftypBox(false)))+8, io.SeekStart); err != nil {
+		return err
+	}
+	var size [8]byte
+	binary.BigEndian.PutUint64(size[:], uint64(mdatSize))
+	if _, err := ws.Write(size[:]); err != nil {
+		return err
+	}
+	_, err := ws.Seek(0, io.SeekEnd)
+	return err
+}
+
+// dropUnreadyTracks leaves out the tracks whose decoder configuration never
+// showed up; they have no samples either.
+func (m *Muxer) dropUnreadyTracks() {
+	tracks := m.tracks[:0]
+	for _, t := range m.tracks {
+		if t.ready {
+			t.id = uint32(len(tracks) + 1)
+			tracks = append(tracks, t)
+		}
+	}
+	m.tracks = tracks
+	if m.video != nil && !m.video.ready {
+		m.video = nil
+	}
+	if m.audio != nil && !m.audio.ready {
+		m.audio = nil
+	}
+}
+
+type nalKind int
+
+const (
+	nalOther nalKind = iota
+	nalKey
+	nalParamSet
+	nalAUD
+)
+
+// nalKind classifies a NAL unit and keeps the parameter sets of the
+// track until its configuration is complete.
+func (t *track) nalKind(nalu []byte) nalKind {
+	if t.codec == psdemux.CodecH265 {
+		hdr, ok := psdemux.ParseH265NalHeader(nalu)
+		if !ok {
+			return nalOther
+		}
+		switch hdr.Type {
+		case psdemux.H265NalVps:
+			t.setParamSet(&t.vps, nalu)
+			return nalParamSet
+		case psdemux.H265NalSps:
+			t.setParamSet(&t.sps, nalu)
+			return nalParamSet
+		case psdemux.H265NalPps:
+			t.setParamSet(&t.pps, nalu)
+			return nalParamSet
+		case psdemux.H265NalAud:
+			return nalAUD
+		}
+		if hdr.IsIRAP() {
+			return nalKey
+		}
+		return nalOther
+	}
+	hdr, ok := psdemux.ParseH264NalHeader(nalu)
+	if !ok {
+		return nalOther
+	}
+	switch hdr.Type {
+	case psdemux.H264NalSPS:
+		t.setParamSet(&t.sps, nalu)
+		return nalParamSet
+	case psdemux.H264NalPPS:
+		t.setParamSet(&t.pps, nalu)
+		return nalParamSet
+	case psdemux.H264NalAUD:
+		return nalAUD
+	case psdemux.H264NalIDR:
+		return nalKey
+	}
+	return nalOther
+}
+
+// setParamSet stores a parameter set while the configuration is
+// incomplete; the sample entry keeps the first complete set.
+func (t *track) setParamSet(dst *[]byte, nalu []byte) {
+	if t.ready {
+		return
+	}
+	*dst = append([]byte(nil), nalu...)
+	if t.sps == nil || t.pps == nil || (t.codec == psdemux.CodecH265 && t.vps == nil) {
+		return
+	}
+	var err error
+	if t.codec == psdemux.CodecH265 {
+		t.params, err = psdemux.ParseH265SPS(t.sps)
+	} else {
+		t.params, err = psdemux.ParseH264SPS(t.sps)
+	}
+	t.ready = err == nil
+}
@@ -0,0 +1,68 @@
+package mp4mux
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"mpegps-parser/psdemux"
+)
+
+func TestTSDiff(t *testing.T) {
+	tests := []struct {
+		a, b uint64
+		want int64
+	}{
+		{3600, 0, 3600},
+		{0, 3600, -3600},
+		{100, ptsWrap - 3500, 3600},
+		{ptsWrap - 3500, 100, -3600},
+		{ptsWrap/2 - 1, 0, ptsWrap/2 - 1},
+		{ptsWrap / 2, 0, -ptsWrap / 2},
+	}
+	for _, tt := range tests {
+		if got := tsDiff(tt.a, tt.b); got != tt.want {
+			t.Errorf("tsDiff(%d, %d) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestTimestampWrap(t *testing.T) {
+	sps, _ := hex.DecodeString("67640028acca501e0089f970110000030001000003003284")
+	pps, _ := hex.DecodeString("68ce3c80")
+	annexB := func(nalus ...[]byte) []byte {
+		var b []byte
+		for _, nalu := range nalus {
+			b = append(append(b, 0, 0, 0, 1), nalu...)
+		}
+		return b
+	}
+	var b bytes.Buffer
+	m := NewMuxer(&b, &Options{VideoCodec: psdemux.CodecH264, Fragmented: true})
+	// 25fps with B-frame delay, the DTS wrapping after the third frame and
+	// the PTS one frame earlier
+	start := uint64(ptsWrap - 3*3600)
+	for i := 0; i < 6; i++ {
+		dts := (start + uint64(i)*3600) % ptsWrap
+		pts := (dts + 3600) % ptsWrap
+		au := annexB([]byte{0x41, 0x9a})
+		if i == 0 {
+			au = annexB(sps, pps, []byte{0x65, 0x88})
+		}
+		if err := m.WriteVideo(au, pts, dts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	samples := m.video.samples
+	if len(samples) != 6 {
+		t.Fatalf("%d samples, want 6", len(samples))
+	}
+	for i, s := range samples {
+		if s.time != int64(i)*3600 || s.cto != 3600 {
+			t.Errorf("sample %d: time %d cto %d, want %d and 3600", i, s.time, s.cto, i*3600)
+		}
+		if i < len(samples)-1 && s.duration != 3600 {
+			t.Errorf("sample %d: duration %d, want 3600", i, s.duration)
+		}
+	}
+}
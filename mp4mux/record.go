@@ -0,0 +1,77 @@
+package mp4mux
+
+import (
+	"mpegps-parser/bitreader"
+	"mpegps-parser/psdemux"
+)
+
+// AVCDecoderConfigurationRecord returns the avcC record (ISO/IEC 14496-15)
+// for an H.264 SPS and PPS given as NAL units without start codes. FLV
+// uses the same record as its AVC sequence header.
+func AVCDecoderConfigurationRecord(sps, pps []byte) []byte {
+	b := &boxWriter{}
+	b.u8(1) // configurationVersion
+	if len(sps) >= 4 {
+		b.Write(sps[1:4]) // profile_idc, constraint flags, level_idc
+	} else {
+		b.zeros(3)
+	}
+	b.u8(0xfc | 3) // lengthSizeMinusOne
+	b.u8(0xe0 | 1)
+	b.u16(uint16(len(sps)))
+	b.Write(sps)
+	b.u8(1)
+	b.u16(uint16(len(pps)))
+	b.Write(pps)
+	p, err := psdemux.ParseH264SPS(sps)
+	if err == nil && p.ProfileIdc != 66 && p.ProfileIdc != 77 && p.ProfileIdc != 88 {
+		b.u8(0xfc | uint8(p.ChromaFormatIdc))
+		b.u8(0xf8 | uint8(p.BitDepthLuma-8))
+		b.u8(0xf8 | uint8(p.BitDepthChroma-8))
+		b.u8(0) // numOfSequenceParameterSetExt
+	}
+	return b.Bytes()
+}
+
+// HEVCDecoderConfigurationRecord returns the hvcC record for an H.265
+// VPS, SPS and PPS. The profile, tier and level bytes are copied from the
+// SPS profile_tier_level().
+func HEVCDecoderConfigurationRecord(vps, sps, pps []byte) []byte {
+	b := &boxWriter{}
+	b.u8(1)
+	maxSubLayersMinus1, temporalIDNested := uint8(0), uint8(0)
+	var rbsp []byte
+	if len(sps) > 2 {
+		rbsp = bitreader.UnescapeRBSP(sps[2:])
+	}
+	if len(rbsp) >= 13 {
+		maxSubLayersMinus1 = rbsp[0] >> 1 & 0x7
+		temporalIDNested = rbsp[0] & 0x1
+		b.Write(rbsp[1:13])
+	} else {
+		b.zeros(12)
+	}
+	b.u16(0xf000) // min_spatial_segmentation_idc
+	b.u8(0xfc)    // parallelismType
+	chroma, depthLuma, depthChroma := uint32(1), uint32(8), uint32(8)
+	if p, err := psdemux.ParseH265SPS(sps); err == nil {
+		chroma, depthLuma, depthChroma = p.ChromaFormatIdc, p.BitDepthLuma, p.BitDepthChroma
+	}
+	b.u8(0xfc | uint8(chroma))
+	b.u8(0xf8 | uint8(depthLuma-8))
+	b.u8(0xf8 | uint8(depthChroma-8))
+	b.u16(0) // avgFrameRate
+	b.u8((maxSubLayersMinus1+1)<<3 | temporalIDNested<<2 | 3)
+	b.u8(3) // numOfArrays
+	for _, nalu := range [][]byte{vps, sps, pps} {
+		if len(nalu) == 0 {
+			b.zeros(5)
+			continue
+		}
+		b.u8(0x80 | nalu[0]>>1&0x3f) // array_completeness, NAL_unit_type
+		b.u16(1)
+		b.u16(uint16(len(nalu)))
+		b.Write(nalu)
+	}
+	return b.Bytes()
+}
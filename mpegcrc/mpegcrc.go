@@ -0,0 +1,34 @@
+// Package mpegcrc implements the CRC_32 used by MPEG-2 systems sections
+// (ISO/IEC 13818-1 Annex A): polynomial 0x04C11DB7, initial value
+// 0xFFFFFFFF, no bit reflection and no final XOR.
+package mpegcrc
+
+var table [256]uint32
+
+func init() {
+	for i := range table {
+		crc := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+}
+
+// Update returns the result of adding the bytes in p to crc.
+func Update(crc uint32, p []byte) uint32 {
+	for _, b := range p {
+		crc = crc<<8 ^ table[byte(crc>>24)^b]
+	}
+	return crc
+}
+
+// Checksum returns the MPEG-2 CRC_32 of data. Running it over a section
+// that includes its own CRC_32 field yields zero when the section is intact.
+func Checksum(data []byte) uint32 {
+	return Update(0xffffffff, data)
+}
@@ -0,0 +1,274 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrLinkType  = errors.New("unsupported link type")
+	ErrNotIP     = errors.New("not an ip packet")
+	ErrFragment  = errors.New("ip fragment")
+	ErrTransport = errors.New("not udp or tcp")
+	ErrShort     = errors.New("packet too short")
+	ErrFlow      = errors.New("flow format error, want: udp|tcp src_ip:port-dst_ip:port")
+)
+
+const (
+	ProtoTCP = 6
+	ProtoUDP = 17
+
+	etherTypeIPv4 = 0x0800
+	etherTypeIPv6 = 0x86dd
+	etherTypeVLAN = 0x8100
+	etherTypeQinQ = 0x88a8
+)
+
+// TCP flags
+const (
+	TCPFin = 0x01
+	TCPSyn = 0x02
+	TCPRst = 0x04
+)
+
+// Flow is the 5-tuple of a UDP or TCP packet. IPv4 addresses are held in
+// their IPv4-mapped form, so Flow can be used as a map key.
+type Flow struct {
+	Proto   uint8
+	SrcIP   [16]byte
+	DstIP   [16]byte
+	SrcPort uint16
+	DstPort uint16
+}
+
+func (f Flow) String() string {
+	proto := "udp"
+	if f.Proto == ProtoTCP {
+		proto = "tcp"
+	}
+	return fmt.Sprintf("%s %s-%s", proto,
+		net.JoinHostPort(net.IP(f.SrcIP[:]).String(), strconv.Itoa(int(f.SrcPort))),
+		net.JoinHostPort(net.IP(f.DstIP[:]).String(), strconv.Itoa(int(f.DstPort))))
+}
+
+// Reverse returns the flow of the other direction.
+func (f Flow) Reverse() Flow {
+	return Flow{Proto: f.Proto, SrcIP: f.DstIP, DstIP: f.SrcIP, SrcPort: f.DstPort, DstPort: f.SrcPort}
+}
+
+// ParseFlow parses a flow in the form printed by Flow.String, e.g.
+// "udp 192.168.1.64:15060-192.168.1.10:30000".
+func ParseFlow(s string) (Flow, error) {
+	var f Flow
+	fields := strings.Fields(s)
+	if len(fields) != 2 {
+		return f, ErrFlow
+	}
+	switch strings.ToLower(fields[0]) {
+	case "udp":
+		f.Proto = ProtoUDP
+	case "tcp":
+		f.Proto = ProtoTCP
+	default:
+		return f, ErrFlow
+	}
+	// an IPv6 source address is bracketed, look for the '-' after it
+	i := -1
+	if strings.HasPrefix(fields[1], "[") {
+		i = strings.Index(fields[1], "]")
+	}
+	j := strings.Index(fields[1][i+1:], "-")
+	if j < 0 {
+		return f, ErrFlow
+	}
+	j += i + 1
+	var err error
+	if f.SrcIP, f.SrcPort, err = parseAddr(fields[1][:j]); err != nil {
+		return f, err
+	}
+	if f.DstIP, f.DstPort, err = parseAddr(fields[1][j+1:]); err != nil {
+		return f, err
+	}
+	return f, nil
+}
+
+func parseAddr(s string) (ip [16]byte, port uint16, err error) {
+	host, portStr, err := net.SplitHostPort(s)
+	if err != nil {
+		return ip, 0, ErrFlow
+	}
+	addr := net.ParseIP(host)
+	p, err := strconv.ParseUint(portStr, 10, 16)
+	if addr == nil || err != nil {
+		return ip, 0, ErrFlow
+	}
+	copy(ip[:], addr.To16())
+	return ip, uint16(p), nil
+}
+
+// Segment is the transport payload of a packet.
+type Segment struct {
+	Flow      Flow
+	Timestamp time.Time
+	Payload   []byte
+	// TCP only
+	Seq   uint32
+	Flags uint8
+}
+
+// Decode extracts the UDP or TCP payload of pkt. IP fragments are not
+// reassembled and return ErrFragment.
+func Decode(pkt *Packet) (*Segment, error) {
+	data := pkt.Data
+	var etherType uint16
+	switch pkt.LinkType {
+	case LinkTypeEthernet:
+		if len(data) < 14 {
+			return nil, ErrShort
+		}
+		etherType, data = binary.BigEndian.Uint16(data[12:]), data[14:]
+		for etherType == etherTypeVLAN || etherType == etherTypeQinQ {
+			if len(data) < 4 {
+				return nil, ErrShort
+			}
+			etherType, data = binary.BigEndian.Uint16(data[2:]), data[4:]
+		}
+	case LinkTypeLinuxSLL:
+		if len(data) < 16 {
+			return nil, ErrShort
+		}
+		etherType, data = binary.BigEndian.Uint16(data[14:]), data[16:]
+	case LinkTypeSLL2:
+		if len(data) < 20 {
+			return nil, ErrShort
+		}
+		etherType, data = binary.BigEndian.Uint16(data), data[20:]
+	case LinkTypeNull, LinkTypeLoop:
+		if len(data) < 4 {
+			return nil, ErrShort
+		}
+		// the address family, in host order for Null
+		family := binary.LittleEndian.Uint32(data)
+		if pkt.LinkType == LinkTypeLoop || family > 0xffff {
+			family = binary.BigEndian.Uint32(data)
+		}
+		data = data[4:]
+		switch family {
+		case 2:
+			etherType = etherTypeIPv4
+		case 10, 24, 28, 30:
+			etherType = etherTypeIPv6
+		}
+	case LinkTypeRaw, LinkTypeIPv4, LinkTypeIPv6:
+		if len(data) < 1 {
+			return nil, ErrShort
+		}
+		switch data[0] >> 4 {
+		case 4:
+			etherType = etherTypeIPv4
+		case 6:
+			etherType = etherTypeIPv6
+		}
+	default:
+		return nil, ErrLinkType
+	}
+
+	seg := &Segment{Timestamp: pkt.Timestamp}
+	var proto uint8
+	var err error
+	switch etherType {
+	case etherTypeIPv4:
+		proto, data, err = decodeIPv4(data, &seg.Flow)
+	case etherTypeIPv6:
+		proto, data, err = decodeIPv6(data, &seg.Flow)
+	default:
+		return nil, ErrNotIP
+	}
+	if err != nil {
+		return nil, err
+	}
+	seg.Flow.Proto = proto
+	switch proto {
+	case ProtoUDP:
+		if len(data) < 8 {
+			return nil, ErrShort
+		}
+		seg.Flow.SrcPort = binary.BigEndian.Uint16(data)
+		seg.Flow.DstPort = binary.BigEndian.Uint16(data[2:])
+		if n := int(binary.BigEndian.Uint16(data[4:])); n >= 8 && n <= len(data) {
+			data = data[:n]
+		}
+		seg.Payload = data[8:]
+	case ProtoTCP:
+		if len(data) < 20 {
+			return nil, ErrShort
+		}
+		seg.Flow.SrcPort = binary.BigEndian.Uint16(data)
+		seg.Flow.DstPort = binary.BigEndian.Uint16(data[2:])
+		seg.Seq = binary.BigEndian.Uint32(data[4:])
+		seg.Flags = data[13]
+		off := int(data[12]>>4) * 4
+		if off < 20 || off > len(data) {
+			return nil, ErrShort
+		}
+		seg.Payload = data[off:]
+	default:
+		return nil, ErrTransport
+	}
+	return seg, nil
+}
+
+func decodeIPv4(data []byte, flow *Flow) (uint8, []byte, error) {
+	if len(data) < 20 || data[0]>>4 != 4 {
+		return 0, nil, ErrNotIP
+	}
+	ihl := int(data[0]&0xf) * 4
+	total := int(binary.BigEndian.Uint16(data[2:]))
+	if ihl < 20 || total < ihl || len(data) < ihl {
+		return 0, nil, ErrShort
+	}
+	// drop the ethernet padding; a snapped capture is shorter than total
+	if total < len(data) {
+		data = data[:total]
+	}
+	if frag := binary.BigEndian.Uint16(data[6:]); frag&0x3fff != 0 {
+		return 0, nil, ErrFragment
+	}
+	copy(flow.SrcIP[:], net.IP(data[12:16]).To16())
+	copy(flow.DstIP[:], net.IP(data[16:20]).To16())
+	return data[9], data[ihl:], nil
+}
+
+func decodeIPv6(data []byte, flow *Flow) (uint8, []byte, error) {
+	if len(data) < 40 || data[0]>>4 != 6 {
+		return 0, nil, ErrNotIP
+	}
+	if n := 40 + int(binary.BigEndian.Uint16(data[4:])); n < len(data) {
+		data = data[:n]
+	}
+	copy(flow.SrcIP[:], data[8:24])
+	copy(flow.DstIP[:], data[24:40])
+	next, data := data[6], data[40:]
+	for {
+		switch next {
+		case 0, 43, 60: // hop-by-hop, routing, destination options
+			if len(data) < 8 {
+				return 0, nil, ErrShort
+			}
+			n := (int(data[1]) + 1) * 8
+			if len(data) < n {
+				return 0, nil, ErrShort
+			}
+			next, data = data[0], data[n:]
+		case 44:
+			return 0, nil, ErrFragment
+		default:
+			return next, data, nil
+		}
+	}
+}
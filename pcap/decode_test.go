@@ -0,0 +1,224 @@
+package pcap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+var (
+	srcIPv4 = net.ParseIP("192.168.1.64")
+	dstIPv4 = net.ParseIP("192.168.1.10")
+	srcIPv6 = net.ParseIP("2001:db8::40")
+	dstIPv6 = net.ParseIP("2001:db8::a")
+)
+
+func udpHeader(src, dst uint16, payload []byte) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint16(b, src)
+	binary.BigEndian.PutUint16(b[2:], dst)
+	binary.BigEndian.PutUint16(b[4:], uint16(8+len(payload)))
+	return append(b, payload...)
+}
+
+// tcpHeader builds a TCP header with options bytes of options.
+func tcpHeader(src, dst uint16, seq uint32, flags uint8, options int, payload []byte) []byte {
+	b := make([]byte, 20+options)
+	binary.BigEndian.PutUint16(b, src)
+	binary.BigEndian.PutUint16(b[2:], dst)
+	binary.BigEndian.PutUint32(b[4:], seq)
+	b[12] = uint8(len(b)/4) << 4
+	b[13] = flags
+	return append(b, payload...)
+}
+
+func ipv4Header(proto uint8, frag uint16, payload []byte) []byte {
+	b := make([]byte, 20)
+	b[0] = 0x45
+	binary.BigEndian.PutUint16(b[2:], uint16(20+len(payload)))
+	binary.BigEndian.PutUint16(b[6:], frag)
+	b[8] = 64
+	b[9] = proto
+	copy(b[12:], srcIPv4.To4())
+	copy(b[16:], dstIPv4.To4())
+	return append(b, payload...)
+}
+
+// ipv6Header builds an IPv6 header followed by the extension headers ext,
+// each given by its next header value and 8 bytes long.
+func ipv6Header(proto uint8, payload []byte, ext ...uint8) []byte {
+	var hdrs []byte
+	next := proto
+	for i := len(ext) - 1; i >= 0; i-- {
+		hdrs = append([]byte{next, 0, 0, 0, 0, 0, 0, 0}, hdrs...)
+		next = ext[i]
+	}
+	payload = append(hdrs, payload...)
+	b := make([]byte, 40)
+	b[0] = 0x60
+	binary.BigEndian.PutUint16(b[4:], uint16(len(payload)))
+	b[6] = next
+	b[7] = 64
+	copy(b[8:], srcIPv6)
+	copy(b[24:], dstIPv6)
+	return append(b, payload...)
+}
+
+func ethernet(etherType uint16, payload []byte, vlans ...uint16) []byte {
+	b := make([]byte, 12) // MAC addresses
+	for _, tpid := range vlans {
+		b = append(b, uint8(tpid>>8), uint8(tpid), 0, 100)
+	}
+	b = append(b, uint8(etherType>>8), uint8(etherType))
+	return append(b, payload...)
+}
+
+func linuxSLL(etherType uint16, payload []byte) []byte {
+	b := make([]byte, 16)
+	binary.BigEndian.PutUint16(b[14:], etherType)
+	return append(b, payload...)
+}
+
+func linuxSLL2(etherType uint16, payload []byte) []byte {
+	b := make([]byte, 20)
+	binary.BigEndian.PutUint16(b, etherType)
+	return append(b, payload...)
+}
+
+func TestDecode(t *testing.T) {
+	payload := []byte("v=0\r\n")
+	udp4 := ipv4Header(ProtoUDP, 0, udpHeader(15060, 30000, payload))
+	tcp4 := ipv4Header(ProtoTCP, 0x4000, tcpHeader(15060, 30000, 0x01020304, TCPSyn, 12, payload)) // DF set
+	udp6 := ipv6Header(ProtoUDP, udpHeader(15060, 30000, payload))
+	tcp6 := ipv6Header(ProtoTCP, tcpHeader(15060, 30000, 7, 0, 0, payload), 0, 60)
+	tests := []struct {
+		name     string
+		linkType uint32
+		data     []byte
+		proto    uint8
+		v6       bool
+		seq      uint32
+		flags    uint8
+	}{
+		{"ethernet udp", LinkTypeEthernet, ethernet(etherTypeIPv4, udp4), ProtoUDP, false, 0, 0},
+		{"ethernet padding", LinkTypeEthernet, ethernet(etherTypeIPv4, append(udp4, 0, 0, 0, 0)), ProtoUDP, false, 0, 0},
+		{"ethernet tcp", LinkTypeEthernet, ethernet(etherTypeIPv4, tcp4), ProtoTCP, false, 0x01020304, TCPSyn},
+		{"vlan", LinkTypeEthernet, ethernet(etherTypeIPv4, udp4, etherTypeVLAN), ProtoUDP, false, 0, 0},
+		{"qinq", LinkTypeEthernet, ethernet(etherTypeIPv4, tcp4, etherTypeQinQ, etherTypeVLAN), ProtoTCP, false, 0x01020304, TCPSyn},
+		{"ethernet ipv6", LinkTypeEthernet, ethernet(etherTypeIPv6, udp6), ProtoUDP, true, 0, 0},
+		{"ipv6 extension headers", LinkTypeEthernet, ethernet(etherTypeIPv6, tcp6), ProtoTCP, true, 7, 0},
+		{"linux sll", LinkTypeLinuxSLL, linuxSLL(etherTypeIPv4, udp4), ProtoUDP, false, 0, 0},
+		{"linux sll ipv6", LinkTypeLinuxSLL, linuxSLL(etherTypeIPv6, tcp6), ProtoTCP, true, 7, 0},
+		{"linux sll2", LinkTypeSLL2, linuxSLL2(etherTypeIPv4, udp4), ProtoUDP, false, 0, 0},
+		{"null", LinkTypeNull, append([]byte{2, 0, 0, 0}, udp4...), ProtoUDP, false, 0, 0},
+		{"null big endian", LinkTypeNull, append([]byte{0, 0, 0, 30}, udp6...), ProtoUDP, true, 0, 0},
+		{"loop", LinkTypeLoop, append([]byte{0, 0, 0, 2}, tcp4...), ProtoTCP, false, 0x01020304, TCPSyn},
+		{"raw ipv4", LinkTypeRaw, udp4, ProtoUDP, false, 0, 0},
+		{"raw ipv6", LinkTypeRaw, udp6, ProtoUDP, true, 0, 0},
+		{"ipv4", LinkTypeIPv4, tcp4, ProtoTCP, false, 0x01020304, TCPSyn},
+		{"ipv6", LinkTypeIPv6, udp6, ProtoUDP, true, 0, 0},
+	}
+	for _, tt := range tests {
+		seg, err := Decode(&Packet{LinkType: tt.linkType, Data: tt.data})
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		src, dst := srcIPv4.To16(), dstIPv4.To16()
+		if tt.v6 {
+			src, dst = srcIPv6, dstIPv6
+		}
+		f := seg.Flow
+		if f.Proto != tt.proto || !net.IP(f.SrcIP[:]).Equal(src) || !net.IP(f.DstIP[:]).Equal(dst) ||
+			f.SrcPort != 15060 || f.DstPort != 30000 {
+			t.Errorf("%s: flow %v", tt.name, f)
+		}
+		if !bytes.Equal(seg.Payload, payload) || seg.Seq != tt.seq || seg.Flags != tt.flags {
+			t.Errorf("%s: payload %q seq %d flags 0x%x", tt.name, seg.Payload, seg.Seq, seg.Flags)
+		}
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	udp4 := ipv4Header(ProtoUDP, 0, udpHeader(1, 2, []byte{1}))
+	tests := []struct {
+		name     string
+		linkType uint32
+		data     []byte
+		err      error
+	}{
+		{"link type", 147, udp4, ErrLinkType},
+		{"arp", LinkTypeEthernet, ethernet(0x0806, make([]byte, 28)), ErrNotIP},
+		{"null family", LinkTypeNull, append([]byte{7, 0, 0, 0}, udp4...), ErrNotIP},
+		{"short ethernet", LinkTypeEthernet, make([]byte, 13), ErrShort},
+		{"short vlan", LinkTypeEthernet, ethernet(etherTypeVLAN, []byte{0, 100}), ErrShort},
+		{"short sll", LinkTypeLinuxSLL, make([]byte, 15), ErrShort},
+		{"short ipv4", LinkTypeRaw, udp4[:19], ErrNotIP},
+		{"ipv4 header length", LinkTypeRaw, append([]byte{0x44}, udp4[1:]...), ErrShort},
+		{"first fragment", LinkTypeRaw, ipv4Header(ProtoUDP, 0x2000, udpHeader(1, 2, []byte{1})), ErrFragment},
+		{"last fragment", LinkTypeRaw, ipv4Header(ProtoUDP, 0x0010, []byte{1, 2, 3}), ErrFragment},
+		{"ipv6 fragment", LinkTypeRaw, ipv6Header(ProtoUDP, udpHeader(1, 2, []byte{1}), 44), ErrFragment},
+		{"short ipv6 extension", LinkTypeRaw, ipv6Header(ProtoUDP, nil, 0)[:44], ErrShort},
+		{"icmp", LinkTypeRaw, ipv4Header(1, 0, make([]byte, 8)), ErrTransport},
+		{"short udp", LinkTypeRaw, ipv4Header(ProtoUDP, 0, make([]byte, 7)), ErrShort},
+		{"short tcp", LinkTypeRaw, ipv4Header(ProtoTCP, 0, make([]byte, 19)), ErrShort},
+		{"tcp data offset", LinkTypeRaw, ipv4Header(ProtoTCP, 0, tcpHeader(1, 2, 0, 0, 0, nil)[:12]), ErrShort},
+	}
+	for _, tt := range tests {
+		if _, err := Decode(&Packet{LinkType: tt.linkType, Data: tt.data}); err != tt.err {
+			t.Errorf("%s: %v, want %v", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestParseFlow(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Flow
+	}{
+		{"udp 192.168.1.64:15060-192.168.1.10:30000",
+			Flow{Proto: ProtoUDP, SrcPort: 15060, DstPort: 30000}},
+		{"TCP 192.168.1.64:15060-192.168.1.10:30000",
+			Flow{Proto: ProtoTCP, SrcPort: 15060, DstPort: 30000}},
+		{"udp [2001:db8::40]:15060-[2001:db8::a]:30000",
+			Flow{Proto: ProtoUDP, SrcPort: 15060, DstPort: 30000}},
+	}
+	for i, tt := range tests {
+		src, dst := srcIPv4.To16(), dstIPv4.To16()
+		if i == 2 {
+			src, dst = srcIPv6, dstIPv6
+		}
+		copy(tt.want.SrcIP[:], src)
+		copy(tt.want.DstIP[:], dst)
+		f, err := ParseFlow(tt.in)
+		if err != nil || f != tt.want {
+			t.Errorf("%q: %v %v, want %v", tt.in, f, err, tt.want)
+			continue
+		}
+		// String prints the form ParseFlow reads
+		if back, err := ParseFlow(f.String()); err != nil || back != f {
+			t.Errorf("%q: %q does not parse back: %v", tt.in, f.String(), err)
+		}
+		if r := f.Reverse(); r.SrcIP != f.DstIP || r.DstPort != f.SrcPort || r.Reverse() != f {
+			t.Errorf("%q: reverse %v", tt.in, r)
+		}
+	}
+
+	for _, s := range []string{
+		"",
+		"udp",
+		"sctp 192.168.1.64:1-192.168.1.10:2",
+		"udp 192.168.1.64:1 192.168.1.10:2",
+		"udp 192.168.1.64:1",
+		"udp 192.168.1.64-192.168.1.10:2",
+		"udp 192.168.1.64:1-192.168.1.10:65536",
+		"udp 192.168.1.300:1-192.168.1.10:2",
+		"udp [2001:db8::40]:1",
+		"udp 2001:db8::40:1-2001:db8::a:2",
+	} {
+		if _, err := ParseFlow(s); err != ErrFlow {
+			t.Errorf("%q: %v, want ErrFlow", s, err)
+		}
+	}
+}
@@ -0,0 +1,267 @@
+// Package pcap reads packets from pcap and pcapng captures, decodes their
+// UDP and TCP payloads and reassembles TCP streams, enough to pull a
+// GB28181 session out of a Wireshark capture.
+package pcap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+var (
+	ErrFormat    = errors.New("not a pcap or pcapng file")
+	ErrTruncated = errors.New("pcap file truncated")
+)
+
+// Link types (https://www.tcpdump.org/linktypes.html)
+const (
+	LinkTypeNull     = 0
+	LinkTypeEthernet = 1
+	LinkTypeRaw      = 101
+	LinkTypeLoop     = 108
+	LinkTypeLinuxSLL = 113
+	LinkTypeIPv4     = 228
+	LinkTypeIPv6     = 229
+	LinkTypeSLL2     = 276
+)
+
+const (
+	magicMicros = 0xa1b2c3d4
+	magicNanos  = 0xa1b23c4d
+
+	blockSHB      = 0x0a0d0d0a
+	blockIDB      = 0x00000001
+	blockPacket   = 0x00000002 // obsolete
+	blockSPB      = 0x00000003
+	blockEPB      = 0x00000006
+	byteOrderNG   = 0x1a2b3c4d
+	optEnd        = 0
+	optTSResol    = 9
+	maxBlockSize  = 64 << 20
+	maxPacketSize = 256 << 10
+)
+
+// Packet is a captured frame. Data is only valid until the next call to
+// ReadPacket.
+type Packet struct {
+	Timestamp time.Time
+	LinkType  uint32
+	Data      []byte
+}
+
+type iface struct {
+	linkType uint32
+	// timestamp units per second
+	tsUnits uint64
+}
+
+// Reader reads the packets of a pcap or pcapng capture.
+type Reader struct {
+	r     *bufio.Reader
+	order binary.ByteOrder
+	ng    bool
+	// pcap
+	linkType uint32
+	nanos    bool
+	// pcapng
+	ifaces []iface
+	buf    []byte
+}
+
+// NewReader reads the file header from r and returns a Reader for its
+// packets.
+func NewReader(r io.Reader) (*Reader, error) {
+	pr := &Reader{r: bufio.NewReaderSize(r, 1<<16)}
+	head, err := pr.r.Peek(4)
+	if err != nil {
+		return nil, ErrFormat
+	}
+	if binary.BigEndian.Uint32(head) == blockSHB {
+		pr.ng = true
+		return pr, nil
+	}
+	if err := pr.readFileHeader(); err != nil {
+		return nil, err
+	}
+	return pr, nil
+}
+
+func (pr *Reader) readFileHeader() error {
+	var hdr [24]byte
+	if _, err := io.ReadFull(pr.r, hdr[:]); err != nil {
+		return ErrFormat
+	}
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		switch order.Uint32(hdr[:]) {
+		case magicMicros:
+			pr.order = order
+		case magicNanos:
+			pr.order, pr.nanos = order, true
+		default:
+			continue
+		}
+		pr.linkType = order.Uint32(hdr[20:]) & 0xffff
+		return nil
+	}
+	return ErrFormat
+}
+
+// ReadPacket returns the next packet, or io.EOF at the end of the capture.
+func (pr *Reader) ReadPacket() (*Packet, error) {
+	if pr.ng {
+		return pr.readBlocks()
+	}
+	var hdr [16]byte
+	if _, err := io.ReadFull(pr.r, hdr[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, ErrTruncated
+		}
+		return nil, err
+	}
+	sec := int64(pr.order.Uint32(hdr[0:]))
+	frac := int64(pr.order.Uint32(hdr[4:]))
+	capLen := pr.order.Uint32(hdr[8:])
+	if capLen > maxPacketSize {
+		return nil, fmt.Errorf("pcap packet too large: %d", capLen)
+	}
+	data, err := pr.read(int(capLen))
+	if err != nil {
+		return nil, err
+	}
+	if !pr.nanos {
+		frac *= 1000
+	}
+	return &Packet{
+		Timestamp: time.Unix(sec, frac),
+		LinkType:  pr.linkType,
+		Data:      data,
+	}, nil
+}
+
+// read reads n bytes into the reusable buffer.
+func (pr *Reader) read(n int) ([]byte, error) {
+	if cap(pr.buf) < n {
+		pr.buf = make([]byte, n)
+	}
+	b := pr.buf[:n]
+	if _, err := io.ReadFull(pr.r, b); err != nil {
+		return nil, ErrTruncated
+	}
+	return b, nil
+}
+
+// readBlocks reads pcapng blocks until one holds a packet.
+func (pr *Reader) readBlocks() (*Packet, error) {
+	for {
+		head, err := pr.r.Peek(12)
+		if err != nil {
+			if err == io.EOF && len(head) == 0 {
+				return nil, io.EOF
+			}
+			return nil, ErrTruncated
+		}
+		blockType := binary.BigEndian.Uint32(head)
+		if blockType == blockSHB {
+			// every section may switch the byte order and starts over
+			// with its own interfaces
+			switch binary.BigEndian.Uint32(head[8:]) {
+			case byteOrderNG:
+				pr.order = binary.BigEndian
+			default:
+				pr.order = binary.LittleEndian
+			}
+			pr.ifaces = pr.ifaces[:0]
+		} else if pr.order == nil {
+			return nil, ErrFormat
+		} else {
+			blockType = pr.order.Uint32(head)
+		}
+		size := pr.order.Uint32(head[4:])
+		if size < 12 || size%4 != 0 || size > maxBlockSize {
+			return nil, fmt.Errorf("pcapng block size error: %d", size)
+		}
+		block, err := pr.read(int(size))
+		if err != nil {
+			return nil, err
+		}
+		body := block[8 : size-4]
+		switch blockType {
+		case blockIDB:
+			pr.ifaces = append(pr.ifaces, parseIDB(pr.order, body))
+		case blockEPB:
+			if len(body) < 20 {
+				return nil, ErrTruncated
+			}
+			return pr.packet(pr.order.Uint32(body),
+				uint64(pr.order.Uint32(body[4:]))<<32|uint64(pr.order.Uint32(body[8:])),
+				body[20:], pr.order.Uint32(body[12:]))
+		case blockPacket:
+			if len(body) < 20 {
+				return nil, ErrTruncated
+			}
+			return pr.packet(uint32(pr.order.Uint16(body)),
+				uint64(pr.order.Uint32(body[4:]))<<32|uint64(pr.order.Uint32(body[8:])),
+				body[20:], pr.order.Uint32(body[12:]))
+		case blockSPB:
+			if len(body) < 4 {
+				return nil, ErrTruncated
+			}
+			// no timestamp, and the captured length is what's left
+			data := body[4:]
+			if origLen := pr.order.Uint32(body); origLen < uint32(len(data)) {
+				data = data[:origLen]
+			}
+			return pr.packet(0, 0, data, uint32(len(data)))
+		}
+	}
+}
+
+func (pr *Reader) packet(ifaceID uint32, ts uint64, data []byte, capLen uint32) (*Packet, error) {
+	if int(ifaceID) >= len(pr.ifaces) {
+		return nil, fmt.Errorf("pcapng unknown interface: %d", ifaceID)
+	}
+	if capLen > uint32(len(data)) {
+		return nil, ErrTruncated
+	}
+	ifc := pr.ifaces[ifaceID]
+	pkt := &Packet{LinkType: ifc.linkType, Data: data[:capLen]}
+	if ts != 0 {
+		sec := ts / ifc.tsUnits
+		nsec := (ts % ifc.tsUnits) * uint64(time.Second) / ifc.tsUnits
+		pkt.Timestamp = time.Unix(int64(sec), int64(nsec))
+	}
+	return pkt, nil
+}
+
+func parseIDB(order binary.ByteOrder, body []byte) iface {
+	ifc := iface{tsUnits: 1000000}
+	if len(body) < 8 {
+		return ifc
+	}
+	ifc.linkType = uint32(order.Uint16(body))
+	opts := body[8:]
+	for len(opts) >= 4 {
+		code, n := order.Uint16(opts), int(order.Uint16(opts[2:]))
+		if code == optEnd || len(opts) < 4+n {
+			break
+		}
+		if code == optTSResol && n >= 1 {
+			v := opts[4]
+			units := uint64(1)
+			for i := uint8(0); i < v&0x7f; i++ {
+				if v&0x80 != 0 {
+					units *= 2
+				} else {
+					units *= 10
+				}
+			}
+			ifc.tsUnits = units
+		}
+		opts = opts[4+(n+3)&^3:]
+	}
+	return ifc
+}
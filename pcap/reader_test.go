@@ -0,0 +1,229 @@
+package pcap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+)
+
+// pcapFile builds a classic pcap file with the given packets, one second
+// and frac microseconds (or nanoseconds) apart.
+func pcapFile(order binary.ByteOrder, nanos bool, linkType uint32, frac uint32, packets ...[]byte) []byte {
+	var b []byte
+	u16 := func(v uint16) { b = append(b, 0, 0); order.PutUint16(b[len(b)-2:], v) }
+	u32 := func(v uint32) { b = append(b, 0, 0, 0, 0); order.PutUint32(b[len(b)-4:], v) }
+	magic := uint32(magicMicros)
+	if nanos {
+		magic = magicNanos
+	}
+	u32(magic)
+	u16(2)
+	u16(4)
+	u32(0) // thiszone
+	u32(0) // sigfigs
+	u32(65535)
+	u32(linkType)
+	for i, p := range packets {
+		u32(1600000000 + uint32(i))
+		u32(frac)
+		u32(uint32(len(p)))
+		u32(uint32(len(p)))
+		b = append(b, p...)
+	}
+	return b
+}
+
+func readAll(t *testing.T, b []byte) []Packet {
+	r, err := NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pkts []Packet
+	for {
+		pkt, err := r.ReadPacket()
+		if err == io.EOF {
+			return pkts
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := *pkt
+		p.Data = append([]byte(nil), pkt.Data...)
+		pkts = append(pkts, p)
+	}
+}
+
+func TestReadPcap(t *testing.T) {
+	tests := []struct {
+		name  string
+		order binary.ByteOrder
+		nanos bool
+		frac  uint32
+		nsec  int
+	}{
+		{"little endian", binary.LittleEndian, false, 250000, 250000000},
+		{"big endian", binary.BigEndian, false, 250000, 250000000},
+		{"nanoseconds", binary.LittleEndian, true, 123456789, 123456789},
+		{"big endian nanoseconds", binary.BigEndian, true, 5, 5},
+	}
+	data := [][]byte{{1, 2, 3}, {}, bytes.Repeat([]byte{4}, 1500)}
+	for _, tt := range tests {
+		pkts := readAll(t, pcapFile(tt.order, tt.nanos, LinkTypeEthernet, tt.frac, data...))
+		if len(pkts) != len(data) {
+			t.Fatalf("%s: %d packets, want %d", tt.name, len(pkts), len(data))
+		}
+		for i, p := range pkts {
+			want := time.Unix(1600000000+int64(i), int64(tt.nsec))
+			if !p.Timestamp.Equal(want) || p.LinkType != LinkTypeEthernet || !bytes.Equal(p.Data, data[i]) {
+				t.Errorf("%s: packet %d: %v link type %d % x", tt.name, i, p.Timestamp, p.LinkType, p.Data)
+			}
+		}
+	}
+}
+
+func TestReadPcapErrors(t *testing.T) {
+	if _, err := NewReader(bytes.NewReader([]byte("not a capture file at all"))); err != ErrFormat {
+		t.Errorf("garbage: %v, want ErrFormat", err)
+	}
+	if _, err := NewReader(bytes.NewReader(nil)); err != ErrFormat {
+		t.Errorf("empty: %v, want ErrFormat", err)
+	}
+	b := pcapFile(binary.LittleEndian, false, LinkTypeEthernet, 0, []byte{1, 2, 3, 4})
+	for _, n := range []int{len(b) - 2, 24 + 10} {
+		r, err := NewReader(bytes.NewReader(b[:n]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.ReadPacket(); err != ErrTruncated {
+			t.Errorf("cut at %d: %v, want ErrTruncated", n, err)
+		}
+	}
+}
+
+// ngWriter builds pcapng blocks.
+type ngWriter struct {
+	order binary.ByteOrder
+	b     []byte
+}
+
+func (w *ngWriter) block(blockType uint32, body []byte) {
+	for len(body)%4 != 0 {
+		body = append(body, 0)
+	}
+	n := uint32(12 + len(body))
+	var v [4]byte
+	w.order.PutUint32(v[:], blockType)
+	w.b = append(w.b, v[:]...)
+	w.order.PutUint32(v[:], n)
+	w.b = append(w.b, v[:]...)
+	w.b = append(w.b, body...)
+	w.b = append(w.b, v[:]...)
+}
+
+func (w *ngWriter) u16(b []byte, v uint16) []byte {
+	var x [2]byte
+	w.order.PutUint16(x[:], v)
+	return append(b, x[:]...)
+}
+
+func (w *ngWriter) u32(b []byte, v uint32) []byte {
+	var x [4]byte
+	w.order.PutUint32(x[:], v)
+	return append(b, x[:]...)
+}
+
+func (w *ngWriter) shb() {
+	body := w.u32(nil, byteOrderNG)
+	body = w.u16(body, 1)
+	body = w.u16(body, 0)
+	body = append(body, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff) // section length unknown
+	w.block(blockSHB, body)
+}
+
+// idb adds an interface, with if_tsresol if tsresol is not 0.
+func (w *ngWriter) idb(linkType uint16, tsresol uint8) {
+	body := w.u16(nil, linkType)
+	body = w.u16(body, 0)
+	body = w.u32(body, 65535)
+	if tsresol != 0 {
+		body = w.u16(body, optTSResol)
+		body = w.u16(body, 1)
+		body = append(body, tsresol, 0, 0, 0)
+	}
+	body = w.u16(body, optEnd)
+	body = w.u16(body, 0)
+	w.block(blockIDB, body)
+}
+
+func (w *ngWriter) epb(ifaceID uint32, ts uint64, data []byte) {
+	body := w.u32(nil, ifaceID)
+	body = w.u32(body, uint32(ts>>32))
+	body = w.u32(body, uint32(ts))
+	body = w.u32(body, uint32(len(data)))
+	body = w.u32(body, uint32(len(data)))
+	w.block(blockEPB, append(body, data...))
+}
+
+func TestReadPcapng(t *testing.T) {
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		w := &ngWriter{order: order}
+		w.shb()
+		w.idb(LinkTypeEthernet, 0)              // microseconds
+		w.idb(LinkTypeLinuxSLL, 9)              // nanoseconds
+		w.block(0x00000bad, []byte{1, 2, 3, 4}) // unknown blocks are skipped
+		w.epb(0, 1600000000*1000000+5, []byte{1, 2, 3})
+		w.epb(1, 1600000000*1000000000+7, []byte{4, 5, 6, 7, 8})
+		// a new section starts over with its own interfaces
+		w.shb()
+		w.idb(LinkTypeRaw, 0x80|10) // 2^-10 seconds
+		w.epb(0, 1024*1600000000+512, []byte{9})
+
+		pkts := readAll(t, w.b)
+		want := []struct {
+			linkType uint32
+			ts       time.Time
+			data     []byte
+		}{
+			{LinkTypeEthernet, time.Unix(1600000000, 5000), []byte{1, 2, 3}},
+			{LinkTypeLinuxSLL, time.Unix(1600000000, 7), []byte{4, 5, 6, 7, 8}},
+			{LinkTypeRaw, time.Unix(1600000000, 500000000), []byte{9}},
+		}
+		if len(pkts) != len(want) {
+			t.Fatalf("%v: %d packets, want %d", order, len(pkts), len(want))
+		}
+		for i, p := range pkts {
+			if p.LinkType != want[i].linkType || !p.Timestamp.Equal(want[i].ts) || !bytes.Equal(p.Data, want[i].data) {
+				t.Errorf("%v: packet %d: link type %d %v % x, want %d %v % x", order, i,
+					p.LinkType, p.Timestamp, p.Data, want[i].linkType, want[i].ts, want[i].data)
+			}
+		}
+	}
+}
+
+func TestReadPcapngErrors(t *testing.T) {
+	w := &ngWriter{order: binary.LittleEndian}
+	w.shb()
+	w.idb(LinkTypeEthernet, 0)
+	w.epb(1, 0, []byte{1})
+	r, err := NewReader(bytes.NewReader(w.b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.ReadPacket(); err == nil {
+		t.Error("packet of an unknown interface accepted")
+	}
+
+	w = &ngWriter{order: binary.LittleEndian}
+	w.shb()
+	w.idb(LinkTypeEthernet, 0)
+	w.epb(0, 0, []byte{1, 2, 3, 4, 5})
+	r, err = NewReader(bytes.NewReader(w.b[:len(w.b)-6]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.ReadPacket(); err != ErrTruncated {
+		t.Errorf("cut block: %v, want ErrTruncated", err)
+	}
+}
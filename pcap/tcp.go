@@ -0,0 +1,118 @@
+package pcap
+
+import "sort"
+
+// maxPending is how many bytes past a hole the Reassembler holds before
+// giving the missing bytes up as lost.
+const maxPending = 1 << 20
+
+type pendingSegment struct {
+	seq  uint32
+	data []byte
+}
+
+// Reassembler puts the payloads of one direction of a TCP connection back
+// in order. Retransmitted bytes are dropped; bytes that never arrive are
+// skipped once maxPending bytes beyond them have been captured, and
+// reported through OnGap.
+type Reassembler struct {
+	// OnData receives the stream in order.
+	OnData func(data []byte)
+	// OnGap is told how many bytes were lost before the next OnData.
+	OnGap func(lost uint32)
+
+	next         uint32
+	started      bool
+	pending      []pendingSegment
+	pendingBytes int
+
+	Retransmits int
+	LostBytes   int64
+}
+
+// Push adds a captured segment.
+func (r *Reassembler) Push(seg *Segment) {
+	seq, data := seg.Seq, seg.Payload
+	if seg.Flags&TCPSyn != 0 {
+		// SYN takes up one sequence number
+		seq++
+		r.next, r.started = seq, true
+	}
+	if len(data) == 0 {
+		return
+	}
+	if !r.started {
+		// joined an established connection
+		r.next, r.started = seq, true
+	}
+	if diff := int32(seq - r.next); diff < 0 {
+		if int(-diff) >= len(data) {
+			r.Retransmits++
+			return
+		}
+		data, seq = data[-diff:], r.next
+	}
+	if seq != r.next {
+		r.pending = append(r.pending, pendingSegment{seq, append([]byte(nil), data...)})
+		r.pendingBytes += len(data)
+		if r.pendingBytes > maxPending {
+			r.skipHole()
+		}
+		return
+	}
+	r.deliver(data)
+	r.drain()
+}
+
+func (r *Reassembler) deliver(data []byte) {
+	r.next += uint32(len(data))
+	if r.OnData != nil {
+		r.OnData(data)
+	}
+}
+
+// drain delivers the pending segments that have become contiguous.
+func (r *Reassembler) drain() {
+	for len(r.pending) > 0 {
+		sort.Slice(r.pending, func(i, j int) bool {
+			return int32(r.pending[i].seq-r.pending[j].seq) < 0
+		})
+		p := r.pending[0]
+		diff := int32(p.seq - r.next)
+		if diff > 0 {
+			return
+		}
+		r.pending = r.pending[1:]
+		r.pendingBytes -= len(p.data)
+		if int(-diff) >= len(p.data) {
+			r.Retransmits++
+			continue
+		}
+		r.deliver(p.data[-diff:])
+	}
+}
+
+// skipHole gives up on the bytes missing before the first pending segment.
+func (r *Reassembler) skipHole() {
+	if len(r.pending) == 0 {
+		return
+	}
+	sort.Slice(r.pending, func(i, j int) bool {
+		return int32(r.pending[i].seq-r.pending[j].seq) < 0
+	})
+	lost := r.pending[0].seq - r.next
+	r.LostBytes += int64(lost)
+	r.next = r.pending[0].seq
+	if r.OnGap != nil {
+		r.OnGap(lost)
+	}
+	r.drain()
+}
+
+// Flush delivers whatever is still pending at the end of the capture,
+// skipping the holes.
+func (r *Reassembler) Flush() {
+	for len(r.pending) > 0 {
+		r.skipHole()
+	}
+}
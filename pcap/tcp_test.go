@@ -0,0 +1,85 @@
+package pcap
+
+import (
+	"bytes"
+	"testing"
+)
+
+type segment struct {
+	seq   uint32
+	data  string
+	flags uint8
+}
+
+func TestReassembler(t *testing.T) {
+	tests := []struct {
+		name        string
+		segs        []segment
+		want        string
+		gaps        []uint32
+		retransmits int
+	}{
+		{"in order", []segment{{100, "", TCPSyn}, {101, "abc", 0}, {104, "def", 0}}, "abcdef", nil, 0},
+		{"joined", []segment{{5000, "abc", 0}, {5003, "def", 0}}, "abcdef", nil, 0},
+		{"out of order", []segment{{1, "abc", 0}, {7, "ghi", 0}, {4, "def", 0}}, "abcdefghi", nil, 0},
+		{"reversed", []segment{{0, "", TCPSyn}, {7, "ghi", 0}, {4, "def", 0}, {1, "abc", 0}}, "abcdefghi", nil, 0},
+		{"retransmit", []segment{{1, "abc", 0}, {4, "def", 0}, {1, "abc", 0}, {4, "def", 0}}, "abcdef", nil, 2},
+		{"overlap", []segment{{1, "abc", 0}, {2, "bcdef", 0}}, "abcdef", nil, 0},
+		{"pending retransmit", []segment{{1, "abc", 0}, {7, "ghi", 0}, {7, "ghi", 0}, {4, "def", 0}}, "abcdefghi", nil, 1},
+		{"pending overlap", []segment{{1, "abc", 0}, {6, "fghi", 0}, {4, "def", 0}}, "abcdefghi", nil, 0},
+		{"sequence wrap", []segment{{0xfffffffe, "abc", 0}, {4, "gh", 0}, {1, "def", 0}}, "abcdefgh", nil, 0},
+		{"gap", []segment{{1, "abc", 0}, {7, "ghi", 0}, {14, "no", 0}}, "abcghino", []uint32{3, 4}, 0},
+	}
+	for _, tt := range tests {
+		var got []byte
+		var gaps []uint32
+		r := &Reassembler{
+			OnData: func(data []byte) { got = append(got, data...) },
+			OnGap:  func(lost uint32) { gaps = append(gaps, lost) },
+		}
+		for _, s := range tt.segs {
+			r.Push(&Segment{Seq: s.seq, Payload: []byte(s.data), Flags: s.flags})
+		}
+		r.Flush()
+		lost := int64(0)
+		for _, n := range gaps {
+			lost += int64(n)
+		}
+		if string(got) != tt.want || len(gaps) != len(tt.gaps) || r.LostBytes != lost || r.Retransmits != tt.retransmits {
+			t.Errorf("%s: %q gaps %v lost %d retransmits %d, want %q gaps %v retransmits %d", tt.name,
+				got, gaps, r.LostBytes, r.Retransmits, tt.want, tt.gaps, tt.retransmits)
+			continue
+		}
+		for i := range gaps {
+			if gaps[i] != tt.gaps[i] {
+				t.Errorf("%s: gaps %v, want %v", tt.name, gaps, tt.gaps)
+				break
+			}
+		}
+	}
+}
+
+func TestReassemblerMaxPending(t *testing.T) {
+	var got []byte
+	r := &Reassembler{OnData: func(data []byte) { got = append(got, data...) }}
+	r.Push(&Segment{Seq: 1, Payload: []byte("abc")})
+	// 100 bytes go missing, then segments arrive until too much is held
+	chunk := bytes.Repeat([]byte{'x'}, 64<<10)
+	seq := uint32(104)
+	for i := 0; i <= maxPending/len(chunk); i++ {
+		if len(got) != 3 {
+			t.Fatalf("delivered %d bytes past the hole after %d segments", len(got)-3, i)
+		}
+		r.Push(&Segment{Seq: seq, Payload: chunk})
+		seq += uint32(len(chunk))
+	}
+	if r.LostBytes != 100 || len(got) != 3+int(seq-104) {
+		t.Errorf("lost %d, delivered %d bytes", r.LostBytes, len(got))
+	}
+	// back in order, nothing left pending
+	r.Push(&Segment{Seq: seq, Payload: []byte("y")})
+	r.Flush()
+	if r.LostBytes != 100 || got[len(got)-1] != 'y' {
+		t.Errorf("after the hole: lost %d, last byte %q", r.LostBytes, got[len(got)-1])
+	}
+}
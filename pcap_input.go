@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"mpegps-parser/pcap"
+	"mpegps-parser/rtp"
+)
+
+var (
+	ErrNoPcapFlow = errors.New("no flow carrying ps found in the capture")
+)
+
+var packStartCode = []byte{0, 0, 1, 0xba}
+
+// maxScanSSRCs is how many senders a flow may show before the scan stops
+// taking it for RTP.
+const maxScanSSRCs = 8
+
+// pcapFlow is what the first pass over a capture learned about one flow.
+type pcapFlow struct {
+	flow    pcap.Flow
+	packets int
+	bytes   int64
+	// rtpPS counts the depacketized frames that start with a pack header,
+	// rawPS the pack headers in the payload as it is.
+	rtpPS        psCounter
+	rawPS        int
+	depacketizer *rtp.Depacketizer
+	framer       *rtp.Framer
+	tcp          *pcap.Reassembler
+	ts           time.Time
+}
+
+type psCounter int
+
+func (c *psCounter) Write(p []byte) (int, error) {
+	if bytes.HasPrefix(p, packStartCode) {
+		*c++
+	}
+	return len(p), nil
+}
+
+func (fl *pcapFlow) isRTP() bool {
+	return fl.rtpPS > 0
+}
+
+func (fl *pcapFlow) isPS() bool {
+	return fl.rtpPS > 0 || fl.rawPS > 0
+}
+
+func (fl *pcapFlow) rtpStats() []rtp.Stats {
+	var stats []rtp.Stats
+	for _, s := range fl.depacketizer.Stats() {
+		if s.Frames > 0 {
+			stats = append(stats, s)
+		}
+	}
+	return stats
+}
+
+func (fl *pcapFlow) String() string {
+	if !fl.isRTP() {
+		return fmt.Sprintf("%s packets: %d bytes: %d ps packs: %d", fl.flow, fl.packets, fl.bytes, fl.rawPS)
+	}
+	s := fmt.Sprintf("%s packets: %d bytes: %d rtp/ps frames: %d", fl.flow, fl.packets, fl.bytes, fl.rtpPS)
+	for _, st := range fl.rtpStats() {
+		s += fmt.Sprintf(" ssrc: 0x%08x pt: %d", st.SSRC, st.PayloadType)
+	}
+	return s
+}
+
+func (fl *pcapFlow) push(seg *pcap.Segment) {
+	fl.packets++
+	fl.bytes += int64(len(seg.Payload))
+	if seg.Flow.Proto == pcap.ProtoTCP {
+		fl.ts = seg.Timestamp
+		fl.tcp.Push(seg)
+		return
+	}
+	fl.rawPS += bytes.Count(seg.Payload, packStartCode)
+	if len(seg.Payload) >= 12 && seg.Payload[0]>>6 == 2 && len(fl.depacketizer.Stats()) <= maxScanSSRCs {
+		fl.depacketizer.WritePacket(seg.Payload, seg.Timestamp)
+	}
+}
+
+func newPcapFlow(seg *pcap.Segment) *pcapFlow {
+	fl := &pcapFlow{flow: seg.Flow}
+	fl.depacketizer = rtp.NewDepacketizer(&fl.rtpPS, &rtp.Options{})
+	if seg.Flow.Proto == pcap.ProtoTCP {
+		fl.framer = rtp.NewFramer(fl.depacketizer)
+		fl.tcp = &pcap.Reassembler{
+			OnData: func(data []byte) {
+				fl.rawPS += bytes.Count(data, packStartCode)
+				if len(fl.depacketizer.Stats()) <= maxScanSSRCs {
+					fl.framer.Write(data, fl.ts)
+				}
+			},
+			OnGap: func(uint32) {
+				fl.framer.Skip()
+			},
+		}
+	}
+	return fl
+}
+
+func openPcap(name string) (*os.File, *pcap.Reader, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	r, err := pcap.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return f, r, nil
+}
+
+// readPcap calls fn with the UDP and TCP segments of the capture. A
+// truncated capture ends without an error, as captures cut short are
+// common.
+func readPcap(name string, fn func(*pcap.Segment) error) error {
+	f, r, err := openPcap(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	for {
+		pkt, err := r.ReadPacket()
+		if err == io.EOF {
+			return nil
+		}
+		if err == pcap.ErrTruncated {
+			log.Printf("%s: %v", name, err)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		seg, err := pcap.Decode(pkt)
+		if err != nil {
+			continue
+		}
+		if err := fn(seg); err != nil {
+			return err
+		}
+	}
+}
+
+// scanPcap finds the flows of the capture that carry PS, with or without
+// RTP.
+func scanPcap(name string) ([]*pcapFlow, error) {
+	flows := make(map[pcap.Flow]*pcapFlow)
+	var order []*pcapFlow
+	err := readPcap(name, func(seg *pcap.Segment) error {
+		fl, ok := flows[seg.Flow]
+		if !ok {
+			fl = newPcapFlow(seg)
+			flows[seg.Flow] = fl
+			order = append(order, fl)
+		}
+		fl.push(seg)
+		return nil
+	})
+	var ps []*pcapFlow
+	for _, fl := range order {
+		if fl.tcp != nil {
+			fl.tcp.Flush()
+		}
+		if fl.isPS() {
+			ps = append(ps, fl)
+		}
+	}
+	return ps, err
+}
+
+// selectPcapFlow picks the flow given by want or carrying ssrc, or else the
+// one with the most PS.
+func selectPcapFlow(flows []*pcapFlow, want *pcap.Flow, ssrc uint32) (*pcapFlow, error) {
+	var best *pcapFlow
+	score := func(fl *pcapFlow) int {
+		if fl.isRTP() {
+			return int(fl.rtpPS)
+		}
+		return fl.rawPS
+	}
+	for _, fl := range flows {
+		switch {
+		case want != nil:
+			if fl.flow != *want && fl.flow != want.Reverse() {
+				continue
+			}
+		case ssrc != 0:
+			found := false
+			for _, s := range fl.rtpStats() {
+				found = found || s.SSRC == ssrc
+			}
+			if !found {
+				continue
+			}
+		}
+		if best == nil || score(fl) > score(best) {
+			best = fl
+		}
+	}
+	if best == nil {
+		return nil, ErrNoPcapFlow
+	}
+	return best, nil
+}
+
+// feedPcap feeds the flow of the capture file name to the demuxer.
+func (in *streamInput) feedPcap(name string, flow pcap.Flow) {
+	in.run(func() error {
+		var tcp *pcap.Reassembler
+		var framer *rtp.Framer
+		var ts time.Time
+		var werr error
+		if flow.Proto == pcap.ProtoTCP {
+			if in.depacketizer != nil {
+				framer = rtp.NewFramer(in.depacketizer)
+			}
+			tcp = &pcap.Reassembler{
+				OnData: func(data []byte) {
+					if werr != nil {
+						return
+					}
+					if framer != nil {
+						werr = framer.Write(data, ts)
+					} else {
+						_, werr = in.pw.Write(data)
+					}
+				},
+				OnGap: func(uint32) {
+					if framer != nil {
+						framer.Skip()
+					}
+				},
+			}
+			in.mu.Lock()
+			in.tcp, in.framer = tcp, framer
+			in.mu.Unlock()
+		}
+		err := readPcap(name, func(seg *pcap.Segment) error {
+			if seg.Flow != flow {
+				return nil
+			}
+			ts = seg.Timestamp
+			switch {
+			case tcp != nil:
+				tcp.Push(seg)
+				return werr
+			case in.depacketizer != nil:
+				err := in.depacketizer.WritePacket(seg.Payload, seg.Timestamp)
+				if err == rtp.ErrPacketTooShort || err == rtp.ErrVersion {
+					return nil
+				}
+				return err
+			default:
+				_, err := in.pw.Write(seg.Payload)
+				return err
+			}
+		})
+		if err == nil && tcp != nil {
+			tcp.Flush()
+			err = werr
+		}
+		return err
+	})
+}
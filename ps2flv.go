@@ -0,0 +1,92 @@
+package main
+
+import (
+	"io"
+	"log"
+
+	"mpegps-parser/flvmux"
+	"mpegps-parser/psdemux"
+)
+
+// ps2flv remuxes the demuxed video and audio into an flv file. The muxer
+// is created once the program stream map has told the codecs, the PES
+// packets before it are held until then.
+type ps2flv struct {
+	w       io.Writer
+	mux     *flvmux.Muxer
+	demuxer *psdemux.Demuxer
+	wait    psmWait
+	video   frameAssembler
+	err     error
+}
+
+func newPs2flv(w io.Writer) *ps2flv {
+	p := &ps2flv{w: w}
+	p.video.emit = func(au []byte, pts, dts uint64) {
+		p.check(p.mux.WriteVideo(au, pts, dts))
+	}
+	return p
+}
+
+func (p *ps2flv) install(opts *psdemux.Options) {
+	chainOnPES(opts, p.onPES)
+}
+
+func (p *ps2flv) onPES(pkt *psdemux.PESPacket) {
+	if p.mux == nil {
+		if !p.wait.ready(p.demuxer, pkt) {
+			return
+		}
+		p.start()
+	}
+	p.write(pkt)
+}
+
+// start creates the muxer and writes the packets held until then.
+func (p *ps2flv) start() {
+	p.mux = flvmux.NewMuxer(p.w, &flvmux.Options{
+		VideoCodec:      p.demuxer.VideoCodec(),
+		AudioStreamType: p.demuxer.AudioStreamType(),
+	})
+	for _, pkt := range p.wait.flush() {
+		p.write(pkt)
+	}
+}
+
+func (p *ps2flv) write(pkt *psdemux.PESPacket) {
+	if pkt.Corrupt {
+		if pkt.Header.StreamID == psdemux.StartCodeVideo&0xff {
+			p.video.drop(pkt)
+		}
+		return
+	}
+	switch {
+	case pkt.Header.StreamID == psdemux.StartCodeVideo&0xff:
+		p.video.push(pkt)
+	case pkt.Header.StreamID == psdemux.StartCodeAudio&0xff && pkt.Header.HasPTS():
+		if err := p.mux.WriteAudio(pkt.Payload, pkt.Header.PTS); err != flvmux.ErrUnsupportedCodec {
+			p.check(err)
+		}
+	}
+}
+
+// close writes the last frame and fills in onMetaData.
+func (p *ps2flv) close() {
+	if p.mux == nil {
+		if len(p.wait.pending) == 0 {
+			return
+		}
+		// the stream ended before a program stream map
+		p.start()
+	}
+	p.video.flush()
+	p.check(p.mux.Close())
+}
+
+// check logs the first write error.
+func (p *ps2flv) check(err error) {
+	if err != nil && p.err == nil {
+		p.err = err
+		log.Println("write flv error:", err)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"io"
+	"log"
+
+	"mpegps-parser/mp4mux"
+	"mpegps-parser/psdemux"
+)
+
+// ps2mp4 remuxes the demuxed video and audio into an mp4 file. The muxer
+// is created once the program stream map has told the codecs, the PES
+// packets before it are held until then.
+type ps2mp4 struct {
+	w          io.Writer
+	fragmented bool
+	mux        *mp4mux.Muxer
+	demuxer    *psdemux.Demuxer
+	wait       psmWait
+	video      frameAssembler
+	err        error
+}
+
+func newPs2mp4(w io.Writer, fragmented bool) *ps2mp4 {
+	p := &ps2mp4{w: w, fragmented: fragmented}
+	p.video.emit = func(au []byte, pts, dts uint64) {
+		p.check(p.mux.WriteVideo(au, pts, dts))
+	}
+	return p
+}
+
+func (p *ps2mp4) install(opts *psdemux.Options) {
+	chainOnPES(opts, p.onPES)
+}
+
+func (p *ps2mp4) onPES(pkt *psdemux.PESPacket) {
+	if p.mux == nil {
+		if !p.wait.ready(p.demuxer, pkt) {
+			return
+		}
+		p.start()
+	}
+	p.write(pkt)
+}
+
+// start creates the muxer and writes the packets held until then.
+func (p *ps2mp4) start() {
+	p.mux = mp4mux.NewMuxer(p.w, &mp4mux.Options{
+		VideoCodec:      p.demuxer.VideoCodec(),
+		AudioStreamType: p.demuxer.AudioStreamType(),
+		Fragmented:      p.fragmented,
+	})
+	for _, pkt := range p.wait.flush() {
+		p.write(pkt)
+	}
+}
+
+func (p *ps2mp4) write(pkt *psdemux.PESPacket) {
+	if pkt.Corrupt {
+		if pkt.Header.StreamID == psdemux.StartCodeVideo&0xff {
+			p.video.drop(pkt)
+		}
+		return
+	}
+	switch {
+	case pkt.Header.StreamID == psdemux.StartCodeVideo&0xff:
+		p.video.push(pkt)
+	case pkt.Header.StreamID == psdemux.StartCodeAudio&0xff && pkt.Header.HasPTS():
+		if err := p.mux.WriteAudio(pkt.Payload, pkt.Header.PTS); err != mp4mux.ErrUnsupportedCodec {
+			p.check(err)
+		}
+	}
+}
+
+// close writes the last frame and finishes the file.
+func (p *ps2mp4) close() {
+	if p.mux == nil {
+		if len(p.wait.pending) == 0 {
+			return
+		}
+		// the stream ended before a program stream map
+		p.start()
+	}
+	p.video.flush()
+	p.check(p.mux.Close())
+}
+
+// check logs the first write error.
+func (p *ps2mp4) check(err error) {
+	if err != nil && p.err == nil {
+		p.err = err
+		log.Println("write mp4 error:", err)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"io"
+	"log"
+
+	"mpegps-parser/psdemux"
+	"mpegps-parser/tsmux"
+)
+
+// ps2ts remuxes the demuxed PES packets into a transport stream. The PMT
+// follows the program stream map; the PCR comes from the pack SCR.
+type ps2ts struct {
+	mux     *tsmux.Muxer
+	demuxer *psdemux.Demuxer
+	err     error
+}
+
+func newPs2ts(w io.Writer) *ps2ts {
+	return &ps2ts{mux: tsmux.NewMuxer(w)}
+}
+
+// install hooks the remuxer into the demuxer callbacks.
+func (p *ps2ts) install(opts *psdemux.Options) {
+	chainOnPack(opts, p.onPack)
+	chainOnPSM(opts, p.onPSM)
+	chainOnPES(opts, p.onPES)
+}
+
+func (p *ps2ts) onPack(hdr *psdemux.PackHeader) {
+	p.mux.SetPCR(hdr.SCR)
+}
+
+func (p *ps2ts) onPSM(psm *psdemux.ProgramStreamMap) {
+	var streams []tsmux.Stream
+	for _, es := range psm.Streams {
+		streams = append(streams, tsmux.Stream{StreamID: es.StreamID, StreamType: es.StreamType})
+	}
+	p.check(p.mux.SetStreams(streams))
+}
+
+func (p *ps2ts) onPES(pkt *psdemux.PESPacket) {
+	if pkt.Corrupt || (pkt.Type != psdemux.VideoPES && pkt.Type != psdemux.AudioPES) {
+		return
+	}
+	if len(p.mux.Streams()) == 0 {
+		// no usable program stream map yet, assume the usual video stream
+		video := uint8(psdemux.StartCodeVideo & 0xff)
+		streamType := uint8(psdemux.StreamTypeH264)
+		if p.demuxer.VideoCodec() == psdemux.CodecH265 {
+			streamType = psdemux.StreamTypeH265
+		}
+		p.check(p.mux.SetStreams([]tsmux.Stream{{StreamID: video, StreamType: streamType}}))
+	}
+	err := p.mux.WritePES(pkt.Header.StreamID, &pkt.Header, pkt.Payload)
+	if err != tsmux.ErrUnknownStream {
+		p.check(err)
+	}
+}
+
+// check logs the first write error.
+func (p *ps2ts) check(err error) {
+	if err != nil && p.err == nil {
+		p.err = err
+		log.Println("write ts error:", err)
+	}
+}
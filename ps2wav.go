@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+
+	"mpegps-parser/g711"
+	"mpegps-parser/psdemux"
+	"mpegps-parser/wav"
+)
+
+var (
+	ErrWavCodec    = errors.New("wav output needs g711, g722 or g726 audio")
+	ErrWavPCMCodec = errors.New("wav pcm output needs g711 audio")
+)
+
+// ps2wav writes the G.711, G.722 or G.726 audio of stream 0xC0 to a wav
+// file as it is, with the format tag of the codec, or G.711 decoded to
+// 16-bit PCM. The format is chosen at the first audio PES, once the
+// program stream map has told the codec.
+type ps2wav struct {
+	w       io.WriteSeeker
+	pcm     bool
+	wav     *wav.Writer
+	demuxer *psdemux.Demuxer
+	buf     []byte
+	decode  func(dst, src []byte) []byte
+	err     error
+}
+
+func newPs2wav(w io.WriteSeeker, pcm bool) *ps2wav {
+	return &ps2wav{w: w, pcm: pcm}
+}
+
+func (p *ps2wav) install(opts *psdemux.Options) {
+	chainOnPES(opts, p.onPES)
+}
+
+func (p *ps2wav) onPES(pkt *psdemux.PESPacket) {
+	if pkt.Corrupt || pkt.Header.StreamID != psdemux.StartCodeAudio&0xff || p.err != nil {
+		return
+	}
+	if p.wav == nil && !p.open() {
+		return
+	}
+	data := pkt.Payload
+	if p.decode != nil {
+		p.buf = p.decode(p.buf[:0], data)
+		data = p.buf
+	}
+	if _, err := p.wav.Write(data); err != nil {
+		p.err = err
+		log.Println("write wav error:", err)
+	}
+}
+
+// open writes the wav header for the codec of the audio stream.
+func (p *ps2wav) open() bool {
+	params := p.demuxer.AudioParams(psdemux.StartCodeAudio & 0xff)
+	var tag uint16
+	if params != nil {
+		switch params.Codec {
+		case psdemux.AudioCodecG711A:
+			tag = wav.FormatALaw
+		case psdemux.AudioCodecG711U:
+			tag = wav.FormatMuLaw
+		case psdemux.AudioCodecG722:
+			tag = wav.FormatG722
+		case psdemux.AudioCodecG726:
+			tag = wav.FormatG726
+		}
+	}
+	if tag == 0 {
+		p.err = ErrWavCodec
+		log.Printf("%v: stream type 0x%x", p.err, p.demuxer.StreamInfo().AudioStreamType)
+		return false
+	}
+	if p.pcm && tag != wav.FormatALaw && tag != wav.FormatMuLaw {
+		p.err = ErrWavPCMCodec
+		log.Printf("%v: %s", p.err, params)
+		return false
+	}
+	format := wav.Format{
+		Tag:           tag,
+		Channels:      uint16(params.Channels),
+		SampleRate:    uint32(params.SampleRate),
+		BitsPerSample: uint16(params.BitsPerSample),
+	}
+	if p.pcm {
+		p.decode = g711.ALawToPCM
+		if format.Tag == wav.FormatMuLaw {
+			p.decode = g711.ULawToPCM
+		}
+		format.Tag, format.BitsPerSample = wav.FormatPCM, 16
+	}
+	p.wav, p.err = wav.NewWriter(p.w, format)
+	if p.err != nil {
+		log.Println("write wav error:", p.err)
+		return false
+	}
+	return true
+}
+
+// close fills in the sizes of the wav header.
+func (p *ps2wav) close() {
+	if p.wav == nil {
+		return
+	}
+	if err := p.wav.Close(); err != nil {
+		log.Println("write wav error:", err)
+		return
+	}
+	log.Printf("wav samples: %d", p.wav.Samples())
+}
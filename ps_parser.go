@@ -1,546 +1,580 @@
 package main
 
 import (
-	"bytes"
+	"bufio"
 	"encoding/binary"
-	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
-	"mpegps-parser/bitreader"
+	"math"
 	"os"
-)
-
-const (
-	StartCodePS    = 0x000001ba
-	StartCodeSYS   = 0x000001bb
-	StartCodeMAP   = 0x000001bc
-	StartCodeVideo = 0x000001e0
-	StartCodeAudio = 0x000001c0
-)
-
-const (
-	VideoPES = 0x01
-	AudioPES = 0x02
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"mpegps-parser/pcap"
+	"mpegps-parser/psdemux"
+	"mpegps-parser/rtp"
 )
 
 var (
-	ErrNotFoundStartCode = errors.New("not found the need start code flag")
-	ErrFormatPack        = errors.New("not package standard")
-	ErrParsePakcet       = errors.New("parse ps packet error")
-	ErrNewBiteReader     = errors.New("new bit reader error")
-	ErrCheckH264         = errors.New("check h264 error")
-	ErrCheckPayloadLen   = errors.New("check payload length error")
-	ErrCheckInputFile    = errors.New("check input file error")
+	ErrCheckInputFile = errors.New("check input file error")
 )
 
-type FieldInfo struct {
-	len  uint
-	item string
-}
-
-type PsDecoder struct {
-	videoStreamType    uint32
-	audioStreamType    uint32
-	br                 bitreader.BitReader
-	psHeader           map[string]uint32
-	handlers           map[int]func() error
-	psHeaderFields     []FieldInfo
-	pktCnt             int
-	fileSize           int
-	psBuf              *[]byte
-	errVideoFrameCnt   int
-	errAudioFrameCnt   int
-	totalVideoFrameCnt int
-	totalAudioFrameCnt int
-	iFrameCnt          int
-	psmCnt             int
-	errIFrameCnt       int
-	pFrameCnt          int
-	h264File           *os.File
-	audioFile          *os.File
-	param              *consoleParam
-}
-
-func (dec *PsDecoder) decodePsPkts() error {
-	for dec.getPos() < int64(dec.fileSize) {
-		startCode, err := dec.br.Read32(32)
-		if err != nil {
-			log.Println(err)
-			return err
-		}
-		dec.pktCnt++
-		if dec.param.verbose {
-			fmt.Println()
-			log.Printf("pkt count: %d pos: %d/%d", dec.pktCnt, dec.getPos(), dec.fileSize)
-		}
-		handler, ok := dec.handlers[int(startCode)]
-		if !ok {
-			log.Printf("check startCode error: 0x%x pos:%d, fileSize:%d\n", startCode, dec.getPos(), dec.fileSize)
-			return ErrParsePakcet
-		}
-		handler()
+// showInfo shows the demuxer counters and, when in is not nil, the loss
+// seen by the transport.
+func showInfo(demuxer *psdemux.Demuxer, in *streamInput) {
+	stats := demuxer.Stats()
+	streamInfo := demuxer.StreamInfo()
+	fmt.Println()
+	log.Printf("total video frame count: %d\n", stats.TotalVideoFrameCnt)
+	log.Printf("err frame cont: %d\n", stats.ErrVideoFrameCnt)
+	log.Printf("I frame count: %d\n", stats.IFrameCnt)
+	log.Printf("err I frame count: %d\n", stats.ErrIFrameCnt)
+	log.Printf("program stream map count: %d", stats.PsmCnt)
+	log.Printf("err program stream map crc count: %d", stats.ErrPsmCRCCnt)
+	log.Printf("pack count: %d\n", stats.PackCnt)
+	log.Printf("err pack header count: %d\n", stats.ErrPackHeaderCnt)
+	if stats.MPEG1PackCnt > 0 {
+		log.Printf("mpeg1 pack count: %d\n", stats.MPEG1PackCnt)
+	}
+	log.Printf("P frame count: %d\n", stats.PFrameCnt)
+	log.Printf("non-reference frame count: %d\n", stats.NonRefFrameCnt)
+	log.Printf("err nal count: %d\n", stats.ErrNalCnt)
+	log.Printf("err sps/pps count: %d\n", stats.ErrParamSetCnt)
+	log.Printf("video params change count: %d\n", stats.VideoParamsChangeCnt)
+	showNalCnt(stats)
+	log.Println("total audio frame count:", stats.TotalAudioFrameCnt)
+	if stats.ErrADTSCnt > 0 || stats.ErrADTSLengthCnt > 0 {
+		log.Printf("err adts header count: %d frame length count: %d\n", stats.ErrADTSCnt, stats.ErrADTSLengthCnt)
+	}
+	if stats.AudioParamsChangeCnt > 0 {
+		log.Printf("audio params change count: %d\n", stats.AudioParamsChangeCnt)
+	}
+	log.Printf("err pes header count: %d\n", stats.ErrPESHeaderCnt)
+	log.Printf("video stream type: 0x%x (%s)\n", streamInfo.VideoStreamType, demuxer.VideoCodec())
+	log.Printf("audio stream type: 0x%x\n", streamInfo.AudioStreamType)
+	if stats.TotalOtherPktCnt > 0 {
+		log.Printf("other pes packet count: %d\n", stats.TotalOtherPktCnt)
+	}
+	if stats.ResyncCnt > 0 {
+		log.Printf("resync count: %d skipped bytes: %d\n", stats.ResyncCnt, stats.ResyncBytes)
+	}
+	if stats.PaddingCnt > 0 {
+		log.Printf("padding packet count: %d bytes: %d\n", stats.PaddingCnt, stats.PaddingBytes)
+	}
+	showStreams(demuxer)
+	showSystemHeaderCheck(demuxer)
+	if in != nil {
+		in.showStats()
 	}
-	return nil
 }
 
-func (dec *PsDecoder) decodeSystemHeader() error {
-	br := dec.br
-	syslens, err := br.Read32(16)
-	if dec.param.printSysHeader {
-		log.Println("=== ps system header === ")
-		log.Printf("\tsystem_header_length:%d", syslens)
+func showNalCnt(stats psdemux.Stats) {
+	for t, cnt := range stats.H264NalCnt {
+		if cnt > 0 {
+			log.Printf("h264 %s count: %d\n", psdemux.H264NalTypeName(uint8(t)), cnt)
+		}
 	}
-	if err != nil {
-		return err
+	for t, cnt := range stats.H265NalCnt {
+		if cnt > 0 {
+			log.Printf("h265 %s count: %d\n", psdemux.H265NalTypeName(uint8(t)), cnt)
+		}
 	}
-
-	br.Skip(uint(syslens) * 8)
-	return nil
-}
-
-func (decoder *PsDecoder) getPos() int64 {
-	pos := decoder.br.Size() - int64(decoder.br.Len())
-	return pos
 }
 
-func (decoder *PsDecoder) decodePsmNLoop(programStreamMapLen uint32) error {
-	br := decoder.br
-	for programStreamMapLen > 0 {
-		streamType, err := br.Read32(8)
-		if decoder.param.printPsm {
-			log.Printf("\t\tstream type: 0x%x", streamType)
-		}
-		if err != nil {
-			return err
-		}
-		elementaryStreamID, err := br.Read32(8)
-		if err != nil {
-			return err
-		}
-		if elementaryStreamID >= 0xe0 && elementaryStreamID <= 0xef {
-			decoder.videoStreamType = streamType
-		}
-		if elementaryStreamID >= 0xc0 && elementaryStreamID <= 0xdf {
-			decoder.audioStreamType = streamType
+func showStreams(demuxer *psdemux.Demuxer) {
+	for _, s := range demuxer.Streams() {
+		log.Printf("stream 0x%x type: 0x%x packets: %d err packets: %d bytes: %d\n",
+			s.StreamID, s.StreamType, s.PktCnt, s.ErrPktCnt, s.Bytes)
+		if p := demuxer.VideoParams(s.StreamID); p != nil {
+			log.Printf("\t%s\n", p)
 		}
-		if decoder.param.printPsm {
-			log.Printf("\t\tstream id: 0x%x", elementaryStreamID)
-		}
-		elementaryStreamInfoLength, err := br.Read32(16)
-		if err != nil {
-			return err
-		}
-		if decoder.param.printPsm {
-			log.Printf("\t\telementary_stream_info_length: %d", elementaryStreamInfoLength)
-		}
-		br.Skip(uint(elementaryStreamInfoLength * 8))
-		programStreamMapLen -= (4 + elementaryStreamInfoLength)
+		showAudio(demuxer, s.StreamID)
 	}
-	return nil
 }
 
-func (dec *PsDecoder) decodeProgramStreamMap() error {
-	br := dec.br
-	dec.psmCnt++
-	psmLen, err := br.Read32(16)
-	if err != nil {
-		return err
+func showAudio(demuxer *psdemux.Demuxer, streamID uint8) {
+	a := demuxer.AudioStats(streamID)
+	if a == nil {
+		return
 	}
-	if dec.param.printPsm {
-		log.Println("=== program stream map ===")
-		log.Printf("\tprogram_stream_map_length: %d pos: %d", psmLen, dec.getPos())
+	rate := 0
+	if p := demuxer.AudioParams(streamID); p != nil {
+		log.Printf("\t%s\n", p)
+		rate = p.SampleRate
 	}
-	//drop psm version info
-	br.Skip(16)
-	psmLen -= 2
-	programStreamInfoLen, err := br.Read32(16)
-	if err != nil {
-		return err
+	log.Printf("\tframes: %d samples: %d duration: %.3fs pts duration: %.3fs\n",
+		a.Frames, a.Samples, a.Duration(rate), a.PTSDuration(rate))
+	// lost or dropped audio shows as samples falling short of the pts
+	if diff := a.PTSDuration(rate) - a.Duration(rate); rate != 0 && (diff > 0.1 || diff < -0.1) {
+		log.Printf("\tsamples differ from pts duration by %.3fs (%d samples)\n", diff, int64(math.Round(diff*float64(rate))))
 	}
-	br.Skip(uint(programStreamInfoLen * 8))
-	psmLen -= (programStreamInfoLen + 2)
-	programStreamMapLen, err := br.Read32(16)
-	if err != nil {
-		return err
-	}
-	psmLen -= (2 + programStreamMapLen)
-	if dec.param.printPsm {
-		log.Printf("\tprogram_stream_info_length: %d", programStreamMapLen)
+	if a.ErrFrames > 0 || a.LengthErrs > 0 {
+		log.Printf("\terr frames: %d frame length errors: %d\n", a.ErrFrames, a.LengthErrs)
 	}
+}
 
-	if err := dec.decodePsmNLoop(programStreamMapLen); err != nil {
-		return err
+func showSystemHeaderCheck(demuxer *psdemux.Demuxer) {
+	check := demuxer.CheckSystemHeader()
+	if check == nil {
+		log.Println("no system header")
+		return
 	}
-
-	// crc 32
-	if psmLen != 4 {
-		if dec.param.printPsm {
-			log.Printf("psmLen: 0x%x", psmLen)
-		}
-		return ErrFormatPack
+	log.Printf("err system header count: %d\n", demuxer.Stats().ErrSysHeaderCnt)
+	if check.OK() {
+		log.Println("system header matches streams")
+		return
 	}
-	br.Skip(32)
-	return nil
-}
-
-func (dec *PsDecoder) decodeH264(data []byte, len uint32, err bool) error {
-	if dec.param.verbose {
-		log.Printf("\t\th264 len : %d", len)
-		if data[4] == 0x67 {
-			log.Println("\t\tSPS")
-		}
-		if data[4] == 0x68 {
-			log.Println("\t\tPPS")
-		}
-		if data[4] == 0x65 {
-			log.Println("\t\tIDR")
-			if err {
-				dec.errIFrameCnt++
-			} else {
-				dec.iFrameCnt++
-			}
-		}
-		if data[4] == 0x61 {
-			log.Println("\t\tP Frame")
-			dec.pFrameCnt++
-		}
+	sysHeader := demuxer.SystemHeader()
+	for _, id := range check.NotSeen {
+		log.Printf("system header stream 0x%x not found in stream", id)
 	}
-	if !err && dec.h264File != nil {
-		dec.writeH264FrameToFile(data)
+	for _, id := range check.NotAnnounced {
+		log.Printf("stream 0x%x not announced in system header", id)
 	}
-	return nil
-}
-
-func (dec *PsDecoder) saveAudioPkt(data []byte, len uint32, err bool) error {
-	if dec.param.verbose {
-		log.Printf("\t\taudio len : %d", len)
+	if check.AudioBoundErr {
+		log.Printf("audio stream count %d exceeds audio_bound %d", check.AudioStreamCnt, sysHeader.AudioBound)
 	}
-	if !err && dec.audioFile != nil {
-		dec.writeAudioFrameToFile(data)
+	if check.VideoBoundErr {
+		log.Printf("video stream count %d exceeds video_bound %d", check.VideoStreamCnt, sysHeader.VideoBound)
 	}
-	return nil
 }
 
-func (dec *PsDecoder) isStartCodeValid(startCode uint32) bool {
-	if startCode == StartCodePS ||
-		startCode == StartCodeMAP ||
-		startCode == StartCodeSYS ||
-		startCode == StartCodeVideo ||
-		startCode == StartCodeAudio {
-		return true
-	}
-	return false
+type consoleParam struct {
+	psFile            string
+	outputAudioFile   string
+	outputVideoFile   string
+	dumpAudio         bool
+	dumpVideo         bool
+	dumpStreams       bool
+	outputPrefix      string
+	printPsHeader     bool
+	printSysHeader    bool
+	printPsm          bool
+	verbose           bool
+	dumpPesStartBytes bool
+	ps2ts             bool
+	outputTsFile      string
+	mp4               bool
+	fmp4              bool
+	outputMp4File     string
+	flv               bool
+	outputFlvFile     string
+	rtp               bool
+	listenUDP         string
+	listenTCP         string
+	connectTCP        string
+	summaryInterval   time.Duration
+	raw               bool
+	resync            bool
+	flow              string
+	ssrc              string
+	wav               string
+	audioCodec        string
+	forceAudioCodec   psdemux.AudioCodec
+	g726BitRate       int
 }
 
-// 移动到当前位置+payloadLen位置，判断startcode是否正确
-// 如果startcode不正确，说明payloadLen是错误的
-func (dec *PsDecoder) isPayloadLenValid(payloadLen uint32, pesType int, pesStartPos int64) bool {
-	psBuf := *dec.psBuf
-	pos := dec.getPos() + int64(payloadLen)
-	if pos >= int64(dec.fileSize) {
-		log.Println("reach file end, quit")
-		return false
-	}
-	packStartCode := binary.BigEndian.Uint32(psBuf[pos : pos+4])
-	if !dec.isStartCodeValid(packStartCode) {
-		log.Printf("check payload len error, len: %d pes start pos: %d(0x%x), pesType:%d", payloadLen, pesStartPos, pesStartPos, pesType)
-		return false
-	}
-	return true
+// live reports whether the input is received from the network.
+func (p *consoleParam) live() bool {
+	return p.listenUDP != "" || p.listenTCP != "" || p.connectTCP != ""
 }
 
-func (dec *PsDecoder) GetNextPackPos() int {
-	pos := int(dec.getPos())
-	for pos < dec.fileSize-4 {
-		b := (*dec.psBuf)[pos : pos+4]
-		packStartCode := binary.BigEndian.Uint32(b)
-		if dec.isStartCodeValid((packStartCode)) {
-			return pos
+func parseConsoleParam() (*consoleParam, error) {
+	param := &consoleParam{}
+	flag.StringVar(&param.psFile, "file", "", "input file, - for stdin")
+	flag.StringVar(&param.outputAudioFile, "output-audio", "", "output audio file, default ./output.audio, or ./output.wav with -wav")
+	flag.StringVar(&param.outputVideoFile, "output-video", "", "output video file, default ./output.<codec>")
+	flag.BoolVar(&param.dumpAudio, "dump-audio", false, "dump audio")
+	flag.StringVar(&param.wav, "wav", "", "dump g711, g722 or g726 audio to a wav file: \"raw\" (or \"g711\") keeps the samples with the format tag of the codec, \"pcm\" decodes g711 to 16-bit pcm")
+	flag.StringVar(&param.audioCodec, "audio-codec", "", "codec of the audio whatever the psm says, gb28181 has no stream_type for it: g711a, g711u, g722, g726-16, g726-24, g726-32 or g726-40")
+	flag.BoolVar(&param.dumpVideo, "dump-video", false, "dump video")
+	flag.BoolVar(&param.dumpStreams, "dump-streams", false, "dump every stream to <output-prefix>_<stream id>.es")
+	flag.StringVar(&param.outputPrefix, "output-prefix", "./output", "output file prefix for -dump-streams")
+	flag.BoolVar(&param.printPsHeader, "print-ps-header", false, "print ps header")
+	flag.BoolVar(&param.printSysHeader, "print-sys-header", false, "print system header")
+	flag.BoolVar(&param.printPsm, "print-psm", false, "print porgram stream map")
+	flag.BoolVar(&param.verbose, "verbose", false, "show packet detail")
+	flag.BoolVar(&param.dumpPesStartBytes, "dump-pes-start-bytes", false, "dump pes start bytes")
+	flag.BoolVar(&param.ps2ts, "ps2ts", false, "remux the program stream to mpeg-ts")
+	flag.StringVar(&param.outputTsFile, "output-ts", "./output.ts", "output ts file for -ps2ts")
+	flag.BoolVar(&param.mp4, "mp4", false, "remux video and audio to mp4")
+	flag.BoolVar(&param.fmp4, "fmp4", false, "remux video and audio to fragmented mp4")
+	flag.StringVar(&param.outputMp4File, "output-mp4", "./output.mp4", "output mp4 file for -mp4 and -fmp4")
+	flag.BoolVar(&param.flv, "flv", false, "remux video and audio to flv")
+	flag.StringVar(&param.outputFlvFile, "output-flv", "./output.flv", "output flv file for -flv")
+	flag.BoolVar(&param.rtp, "rtp", false, "input is rtp/ps with rfc 4571 framing, as sent over tcp by gb28181 devices")
+	flag.StringVar(&param.listenUDP, "listen-udp", "", "receive rtp/ps, or ps with -raw, over udp on this address, e.g. :30000")
+	flag.StringVar(&param.listenTCP, "listen-tcp", "", "accept rtp/ps (rfc 4571), or ps with -raw, over tcp on this address, gb28181 passive mode")
+	flag.StringVar(&param.connectTCP, "connect-tcp", "", "connect to the device at this address for rtp/ps, or ps with -raw, over tcp, gb28181 active mode")
+	flag.BoolVar(&param.raw, "raw", false, "the network carries bare ps without rtp")
+	flag.BoolVar(&param.resync, "resync", false, "skip to the next start code instead of stopping at an invalid one, always on for network input")
+	flag.StringVar(&param.flow, "flow", "", "flow of a pcap/pcapng input to decode, e.g. \"udp 192.168.1.64:15060-192.168.1.10:30000\", default the one carrying the most ps")
+	flag.StringVar(&param.ssrc, "ssrc", "", "only decode rtp with this ssrc, decimal as in the sdp (e.g. 0100000001) or hex with 0x, and pick the pcap flow carrying it")
+	flag.DurationVar(&param.summaryInterval, "summary-interval", 10*time.Second, "show a summary this often while receiving from the network, 0 to disable")
+	flag.Parse()
+	if param.psFile == "" && !param.live() {
+		log.Println("must input file")
+		return nil, ErrCheckInputFile
+	}
+	switch param.wav {
+	case "":
+	case "raw", "g711", "pcm":
+		param.dumpAudio = true
+	default:
+		log.Printf("unknown -wav format %q, want raw, g711 or pcm", param.wav)
+		return nil, ErrCheckInputFile
+	}
+	switch param.audioCodec {
+	case "":
+	case "g711a":
+		param.forceAudioCodec = psdemux.AudioCodecG711A
+	case "g711u":
+		param.forceAudioCodec = psdemux.AudioCodecG711U
+	case "g722":
+		param.forceAudioCodec = psdemux.AudioCodecG722
+	case "g726-16", "g726-24", "g726-32", "g726-40":
+		param.forceAudioCodec = psdemux.AudioCodecG726
+		param.g726BitRate, _ = strconv.Atoi(strings.TrimPrefix(param.audioCodec, "g726-"))
+	default:
+		log.Printf("unknown -audio-codec %q", param.audioCodec)
+		return nil, ErrCheckInputFile
+	}
+	if param.outputAudioFile == "" {
+		param.outputAudioFile = "./output.audio"
+		if param.wav != "" {
+			param.outputAudioFile = "./output.wav"
 		}
-		pos++
 	}
-	return dec.fileSize
+	return param, nil
 }
 
-func (dec *PsDecoder) skipInvalidBytes(payloadLen uint32, pesType int, pesStartPos int64) error {
-	if pesType == VideoPES {
-		dec.errVideoFrameCnt++
-	} else {
-		dec.errAudioFrameCnt++
-	}
-	br := dec.br
-	pos := dec.GetNextPackPos()
-	skipLen := pos - int(dec.getPos())
-	log.Printf("pes start dump: % X\n", (*dec.psBuf)[pesStartPos:pesStartPos+16])
-	log.Printf("pes payload len err, expect: %d actual: %d", payloadLen, skipLen)
-	log.Printf("skip len: %d, next pack pos:%d", skipLen, pos)
-	skipBuf := make([]byte, skipLen)
-	// 由于payloadLen是错误的，所以下一个startcode和当前位置之间的字节需要丢弃
-	if _, err := io.ReadAtLeast(br, skipBuf, int(skipLen)); err != nil {
-		log.Println(err)
-		return err
+// isPcapFile reports whether f starts like a pcap or pcapng capture, and
+// rewinds it.
+func isPcapFile(f *os.File) bool {
+	if _, err := f.Seek(0, io.SeekCurrent); err != nil {
+		return false
 	}
-	if pesType == AudioPES {
-		dec.saveAudioPkt(skipBuf, uint32(skipLen), true)
-	} else {
-		dec.decodeH264(skipBuf, uint32(skipLen), true)
+	var magic [4]byte
+	n, _ := io.ReadFull(f, magic[:])
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return false
 	}
-	return nil
-}
-
-func (dec *PsDecoder) decodeAudioPes() error {
-	if dec.param.verbose {
-		log.Println("=== Audio ===")
+	if n < 4 {
+		return false
 	}
-	dec.totalAudioFrameCnt++
-	dec.decodePES(AudioPES)
-	return nil
-}
-
-func (dec *PsDecoder) decodePESHeader() (uint32, error) {
-	br := dec.br
-	/* payload length */
-	payloadLen, err := br.Read32(16)
-	if err != nil {
-		log.Println(err)
-		return 0, err
+	switch binary.BigEndian.Uint32(magic[:]) {
+	case 0xa1b2c3d4, 0xd4c3b2a1, 0xa1b23c4d, 0x4d3cb2a1, 0x0a0d0d0a:
+		return true
 	}
+	return false
+}
 
-	/* flags: pts_dts_flags ... */
-	br.Skip(16) // 跳过各种flags,比如pts_dts_flags
-	payloadLen -= 2
-
-	/* pes header data length */
-	pesHeaderDataLen, err := br.Read32(8)
+func openOutputFile(name string) (*os.File, error) {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
 	if err != nil {
 		log.Println(err)
-		return 0, err
-	}
-	if dec.param.verbose {
-		log.Printf("\tPES_packet_length: %d", payloadLen)
-		log.Printf("\tpes_header_data_length: %d", pesHeaderDataLen)
+		return nil, err
 	}
-	payloadLen--
+	return f, nil
+}
 
-	/* pes header data */
-	br.Skip(uint(pesHeaderDataLen * 8))
-	payloadLen -= pesHeaderDataLen
-	return payloadLen, nil
+// lazyFile is an io.Writer that creates its file on the first write.
+type lazyFile struct {
+	name func() string
+	f    *os.File
+	err  error
 }
 
-func (dec *PsDecoder) decodePES(pesType int) error {
-	br := dec.br
-	pesStartPos := dec.getPos() - 4 // 4为startcode的长度
-	if dec.param.dumpPesStartBytes {
-		log.Printf("% X\n", (*dec.psBuf)[pesStartPos:pesStartPos+16])
+func (l *lazyFile) Write(p []byte) (int, error) {
+	if l.f == nil && l.err == nil {
+		l.f, l.err = openOutputFile(l.name())
 	}
-	payloadLen, err := dec.decodePESHeader()
-	if err != nil {
-		return err
-	}
-	if !dec.isPayloadLenValid(payloadLen, pesType, pesStartPos) {
-		return dec.skipInvalidBytes(payloadLen, pesType, pesStartPos)
-	}
-	payloadData := make([]byte, payloadLen)
-	if _, err := io.ReadAtLeast(br, payloadData, int(payloadLen)); err != nil {
-		return err
-	}
-	if pesType == VideoPES {
-		dec.decodeH264(payloadData, payloadLen, false)
-	} else {
-		dec.saveAudioPkt(payloadData, payloadLen, false)
+	if l.err != nil {
+		return 0, l.err
 	}
-
-	return nil
+	return l.f.Write(p)
 }
 
-func (dec *PsDecoder) decodeVideoPes() error {
-	if dec.param.verbose {
-		log.Println("=== video ===")
+func (l *lazyFile) Close() error {
+	if l.f == nil {
+		return nil
 	}
-	dec.totalVideoFrameCnt++
-	dec.decodePES(VideoPES)
-	return nil
+	return l.f.Close()
 }
 
-func (decoder *PsDecoder) decodePsHeader() error {
-	if decoder.param.verbose {
-		log.Println("=== pack header ===")
-	}
-	psHeaderFields := decoder.psHeaderFields
-	for _, field := range psHeaderFields {
-		val, err := decoder.br.Read32(field.len)
-		if err != nil {
-			log.Printf("parse %s error", field.item)
-			return err
+// chainOnPES adds fn to the PES callbacks, so that several output modes can
+// run at once. chainOnPack and chainOnPSM do the same for their callbacks.
+func chainOnPES(opts *psdemux.Options, fn func(*psdemux.PESPacket)) {
+	prev := opts.OnPES
+	opts.OnPES = func(pkt *psdemux.PESPacket) {
+		if prev != nil {
+			prev(pkt)
 		}
-		decoder.psHeader[field.item] = val
+		fn(pkt)
 	}
-	pack_stuffing_length := decoder.psHeader["pack_stuffing_length"]
-	decoder.br.Skip(uint(pack_stuffing_length * 8))
-	if decoder.param.printPsHeader {
-		b, err := json.MarshalIndent(decoder.psHeader, "", "  ")
-		if err != nil {
-			log.Println("error:", err)
-		}
-		fmt.Print(string(b) + "\n")
-	}
-	return nil
 }
 
-func (dec *PsDecoder) writeH264FrameToFile(frame []byte) error {
-	if _, err := dec.h264File.Write(frame); err != nil {
-		log.Println(err)
-		return err
+func chainOnPack(opts *psdemux.Options, fn func(*psdemux.PackHeader)) {
+	prev := opts.OnPack
+	opts.OnPack = func(hdr *psdemux.PackHeader) {
+		if prev != nil {
+			prev(hdr)
+		}
+		fn(hdr)
 	}
-	dec.h264File.Sync()
-	return nil
 }
 
-func (dec *PsDecoder) writeAudioFrameToFile(frame []byte) error {
-	if _, err := dec.audioFile.Write(frame); err != nil {
-		log.Println(err)
-		return err
+func chainOnPSM(opts *psdemux.Options, fn func(*psdemux.ProgramStreamMap)) {
+	prev := opts.OnPSM
+	opts.OnPSM = func(psm *psdemux.ProgramStreamMap) {
+		if prev != nil {
+			prev(psm)
+		}
+		fn(psm)
 	}
-	dec.audioFile.Sync()
-	return nil
 }
 
-func (dec *PsDecoder) openVideoFile() error {
-	var err error
-	dec.h264File, err = os.OpenFile(dec.param.outputVideoFile, os.O_WRONLY|os.O_CREATE, 0666)
+func main() {
+	log.SetFlags(log.Lshortfile)
+	param, err := parseConsoleParam()
 	if err != nil {
-		log.Println(err)
-		return err
+		return
 	}
-	return nil
-}
-
-func (dec *PsDecoder) openAudioFile() error {
-	var err error
-	dec.audioFile, err = os.OpenFile(dec.param.outputAudioFile, os.O_WRONLY|os.O_CREATE, 0666)
-	if err != nil {
-		log.Println(err)
-		return err
+	var ssrc uint32
+	if param.ssrc != "" {
+		// GB28181 writes the ssrc as ten decimal digits, leading zeros
+		// included, so only 0x switches the base
+		base, digits := 10, param.ssrc
+		if strings.HasPrefix(digits, "0x") || strings.HasPrefix(digits, "0X") {
+			base, digits = 16, digits[2:]
+		}
+		v, err := strconv.ParseUint(digits, base, 32)
+		if err != nil {
+			log.Printf("ssrc: %s error", param.ssrc)
+			return
+		}
+		ssrc = uint32(v)
 	}
-	return nil
-}
-
-func NewPsDecoder(br bitreader.BitReader, psBuf *[]byte, fileSize int, param *consoleParam) *PsDecoder {
-	decoder := &PsDecoder{
-		br:             br,
-		psHeader:       make(map[string]uint32),
-		handlers:       make(map[int]func() error),
-		psHeaderFields: make([]FieldInfo, 14),
-		fileSize:       fileSize,
-		psBuf:          psBuf,
-		param:          param,
-	}
-	decoder.handlers = map[int]func() error{
-		StartCodePS:    decoder.decodePsHeader,
-		StartCodeSYS:   decoder.decodeSystemHeader,
-		StartCodeMAP:   decoder.decodeProgramStreamMap,
-		StartCodeVideo: decoder.decodeVideoPes,
-		StartCodeAudio: decoder.decodeAudioPes,
-	}
-	decoder.psHeaderFields = []FieldInfo{
-		{2, "fixed"},
-		{3, "system_clock_refrence_base1"},
-		{1, "marker_bit1"},
-		{15, "system_clock_refrence_base2"},
-		{1, "marker_bit2"},
-		{15, "system_clock_refrence_base3"},
-		{1, "marker_bit3"},
-		{9, "system_clock_reference_extension"},
-		{1, "marker_bit4"},
-		{22, "program_mux_rate"},
-		{1, "marker_bit5"},
-		{1, "marker_bit6"},
-		{5, "reserved"},
-		{3, "pack_stuffing_length"},
+	rtpOpts := &rtp.Options{
+		PayloadType: rtp.PayloadTypePS,
+		SSRC:        ssrc,
+		Verbose:     param.verbose,
 	}
+	input := os.Stdin
+	capture := false
+	if param.psFile != "-" && !param.live() {
+		f, err := os.Open(param.psFile)
+		if err != nil {
+			log.Printf("open file: %s error", param.psFile)
+			return
+		}
+		defer f.Close()
+		if fi, err := f.Stat(); err == nil {
+			log.Println(param.psFile, "file size:", fi.Size())
+		}
+		input = f
+		capture = isPcapFile(f)
+	}
+	opts := &psdemux.Options{
+		Verbose:           param.verbose,
+		PrintPackHeader:   param.printPsHeader,
+		PrintSysHeader:    param.printSysHeader,
+		PrintPsm:          param.printPsm,
+		DumpPesStartBytes: param.dumpPesStartBytes,
+		Resync:            param.resync || param.live() || capture,
+		AudioCodec:        param.forceAudioCodec,
+		G726BitRate:       param.g726BitRate,
+	}
+	var wav *ps2wav
 	if param.dumpAudio {
-		err := decoder.openAudioFile()
+		f, err := openOutputFile(param.outputAudioFile)
 		if err != nil {
-			return nil
+			return
+		}
+		defer f.Close()
+		if param.wav != "" {
+			// the sizes are written last, so the file must be seekable
+			wav = newPs2wav(f, param.wav == "pcm")
+			wav.install(opts)
+		} else {
+			opts.AudioWriter = f
 		}
 	}
+	var demuxer *psdemux.Demuxer
 	if param.dumpVideo {
-		err := decoder.openVideoFile()
-		if err != nil {
-			return nil
+		// the codec, and so the file extension, is only known once the
+		// program stream map has been parsed
+		video := &lazyFile{name: func() string {
+			if param.outputVideoFile != "" {
+				return param.outputVideoFile
+			}
+			return "./output." + demuxer.VideoCodec().String()
+		}}
+		defer video.Close()
+		opts.VideoWriter = video
+	}
+	if param.dumpStreams {
+		var files []*os.File
+		defer func() {
+			for _, f := range files {
+				f.Close()
+			}
+		}()
+		opts.StreamWriter = func(streamID uint8) io.Writer {
+			f, err := openOutputFile(fmt.Sprintf("%s_%02x.es", param.outputPrefix, streamID))
+			if err != nil {
+				return nil
+			}
+			files = append(files, f)
+			return f
 		}
 	}
-	return decoder
-}
-
-func (dec *PsDecoder) showInfo() {
-	fmt.Println()
-	log.Printf("total video frame count: %d\n", dec.totalVideoFrameCnt)
-	log.Printf("err frame cont: %d\n", dec.errVideoFrameCnt)
-	log.Printf("I frame count: %d\n", dec.iFrameCnt)
-	log.Printf("err I frame count: %d\n", dec.errIFrameCnt)
-	log.Printf("program stream map count: %d", dec.psmCnt)
-	log.Printf("P frame count: %d\n", dec.pFrameCnt)
-	log.Println("total audio frame count:", dec.totalAudioFrameCnt)
-	log.Printf("video stream type: 0x%x\n", dec.videoStreamType)
-	log.Printf("audio stream type: 0x%x\n", dec.audioStreamType)
-}
-
-type consoleParam struct {
-	psFile            string
-	outputAudioFile   string
-	outputVideoFile   string
-	dumpAudio         bool
-	dumpVideo         bool
-	printPsHeader     bool
-	printSysHeader    bool
-	printPsm          bool
-	verbose           bool
-	dumpPesStartBytes bool
-}
-
-func parseConsoleParam() (*consoleParam, error) {
-	param := &consoleParam{}
-	flag.StringVar(&param.psFile, "file", "", "input file")
-	flag.StringVar(&param.outputAudioFile, "output-audio", "./output.audio", "output audio file")
-	flag.StringVar(&param.outputVideoFile, "output-video", "./output.video", "output video file")
-	flag.BoolVar(&param.dumpAudio, "dump-audio", false, "dump audio")
-	flag.BoolVar(&param.dumpVideo, "dump-video", false, "dump video")
-	flag.BoolVar(&param.printPsHeader, "print-ps-header", false, "print ps header")
-	flag.BoolVar(&param.printSysHeader, "print-sys-header", false, "print system header")
-	flag.BoolVar(&param.printPsm, "print-psm", false, "print porgram stream map")
-	flag.BoolVar(&param.verbose, "verbose", false, "show packet detail")
-	flag.BoolVar(&param.dumpPesStartBytes, "dump-pes-start-bytes", false, "dump pes start bytes")
-	flag.Parse()
-	if param.psFile == "" {
-		log.Println("must input file")
-		return nil, ErrCheckInputFile
-	}
-	return param, nil
-}
-
-func main() {
-	log.SetFlags(log.Lshortfile)
-	param, err := parseConsoleParam()
-	if err != nil {
-		return
-	}
-	psBuf, err := ioutil.ReadFile(param.psFile)
-	if err != nil {
-		log.Printf("open file: %s error", param.psFile)
-		return
+	var remuxer *ps2ts
+	if param.ps2ts {
+		f, err := openOutputFile(param.outputTsFile)
+		if err != nil {
+			return
+		}
+		defer f.Close()
+		w := bufio.NewWriter(f)
+		defer w.Flush()
+		remuxer = newPs2ts(w)
+		remuxer.install(opts)
+	}
+	var mp4 *ps2mp4
+	if param.mp4 || param.fmp4 {
+		f, err := openOutputFile(param.outputMp4File)
+		if err != nil {
+			return
+		}
+		defer f.Close()
+		if param.fmp4 {
+			w := bufio.NewWriter(f)
+			defer w.Flush()
+			mp4 = newPs2mp4(w, true)
+		} else {
+			// the mdat size is written last, so the file must be seekable
+			mp4 = newPs2mp4(f, false)
+		}
+		mp4.install(opts)
 	}
-	log.Println(param.psFile, "file size:", len(psBuf))
-	br := bitreader.NewReader(bytes.NewReader(psBuf))
-	decoder := NewPsDecoder(br, &psBuf, len(psBuf), param)
-	if err := decoder.decodePsPkts(); err != nil {
+	var flv *ps2flv
+	if param.flv {
+		f, err := openOutputFile(param.outputFlvFile)
+		if err != nil {
+			return
+		}
+		defer f.Close()
+		// the onMetaData duration is written last, so the file must be
+		// seekable
+		flv = newPs2flv(f)
+		flv.install(opts)
+	}
+	var src io.Reader = input
+	var in *streamInput
+	switch {
+	case param.live():
+		if param.raw {
+			in = newStreamInput(nil)
+		} else {
+			in = newStreamInput(rtpOpts)
+		}
+		var err error
+		switch {
+		case param.listenUDP != "":
+			err = in.listenUDP(param.listenUDP)
+		case param.listenTCP != "":
+			err = in.listenTCP(param.listenTCP)
+		default:
+			err = in.connectTCP(param.connectTCP)
+		}
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		defer in.stop()
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-sig
+			log.Println("stopping")
+			in.stop()
+		}()
+		if param.summaryInterval > 0 {
+			// runs on the demuxer's goroutine, so its stats can be read
+			last := time.Now()
+			chainOnPack(opts, func(*psdemux.PackHeader) {
+				if time.Since(last) < param.summaryInterval {
+					return
+				}
+				last = time.Now()
+				showInfo(demuxer, in)
+			})
+		}
+		src = in
+	case capture:
+		var want *pcap.Flow
+		if param.flow != "" {
+			flow, err := pcap.ParseFlow(param.flow)
+			if err != nil {
+				log.Println(err)
+				return
+			}
+			want = &flow
+		}
+		flows, err := scanPcap(param.psFile)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		for _, fl := range flows {
+			log.Printf("ps flow: %s", fl)
+		}
+		fl, err := selectPcapFlow(flows, want, ssrc)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		log.Printf("decode flow: %s", fl.flow)
+		if fl.isRTP() {
+			// GB28181 says 96, but not every device listens
+			rtpOpts.PayloadType = fl.rtpStats()[0].PayloadType
+			in = newStreamInput(rtpOpts)
+		} else {
+			in = newStreamInput(nil)
+		}
+		in.feedPcap(param.psFile, fl.flow)
+		src = in
+	case param.rtp:
+		in = newStreamInput(rtpOpts)
+		in.readStream(bufio.NewReader(input))
+		src = in
+	}
+	demuxer = psdemux.NewDemuxer(bufio.NewReader(src), opts)
+	if remuxer != nil {
+		remuxer.demuxer = demuxer
+	}
+	if mp4 != nil {
+		mp4.demuxer = demuxer
+		defer mp4.close()
+	}
+	if flv != nil {
+		flv.demuxer = demuxer
+		defer flv.close()
+	}
+	if wav != nil {
+		wav.demuxer = demuxer
+		defer wav.close()
+	}
+	if err := demuxer.Demux(); err != nil {
 		log.Println(err)
 		return
 	}
-	decoder.showInfo()
+	showInfo(demuxer, in)
 }
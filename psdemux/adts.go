@@ -0,0 +1,112 @@
+package psdemux
+
+import "errors"
+
+var (
+	ErrADTSHeader = errors.New("adts header error")
+)
+
+// adtsSampleRates maps sampling_frequency_index to Hz.
+var adtsSampleRates = [...]int{
+	96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350,
+}
+
+// ADTSHeader is the adts_fixed_header() and adts_variable_header() of an
+// AAC frame (ISO/IEC 13818-7).
+type ADTSHeader struct {
+	MPEG2            bool // ID
+	ProtectionAbsent bool
+	Profile          uint8 // audio object type - 1
+	SampleRateIndex  uint8
+	ChannelConfig    uint8
+	FrameLength      int // including the header
+	BufferFullness   uint16
+	NumRawDataBlocks uint8 // number_of_raw_data_blocks_in_frame
+	CRC              uint16
+}
+
+// ProfileName returns the name of the AAC profile.
+func (h *ADTSHeader) ProfileName() string {
+	switch h.Profile {
+	case 0:
+		return "Main"
+	case 1:
+		return "LC"
+	case 2:
+		return "SSR"
+	}
+	return "LTP"
+}
+
+// HeaderLength returns the size of the header, 9 bytes with a CRC.
+func (h *ADTSHeader) HeaderLength() int {
+	if h.ProtectionAbsent {
+		return 7
+	}
+	return 9
+}
+
+// SampleRate returns the sampling frequency in Hz, or 0 for a reserved
+// index.
+func (h *ADTSHeader) SampleRate() int {
+	if int(h.SampleRateIndex) < len(adtsSampleRates) {
+		return adtsSampleRates[h.SampleRateIndex]
+	}
+	return 0
+}
+
+// Samples returns the number of PCM samples per channel in the frame.
+func (h *ADTSHeader) Samples() int {
+	return 1024 * (int(h.NumRawDataBlocks) + 1)
+}
+
+// AudioSpecificConfig returns the two byte AudioSpecificConfig matching
+// the header, as used by MP4 and FLV.
+func (h *ADTSHeader) AudioSpecificConfig() []byte {
+	objectType := h.Profile + 1
+	return []byte{
+		objectType<<3 | h.SampleRateIndex>>1,
+		h.SampleRateIndex<<7 | h.ChannelConfig<<3,
+	}
+}
+
+// ParseADTSHeader decodes the ADTS header at the start of data.
+func ParseADTSHeader(data []byte) (*ADTSHeader, error) {
+	if len(data) < 7 || data[0] != 0xff || data[1]&0xf0 != 0xf0 || data[1]&0x06 != 0 {
+		return nil, ErrADTSHeader
+	}
+	h := &ADTSHeader{
+		MPEG2:            data[1]&0x08 != 0,
+		ProtectionAbsent: data[1]&0x01 != 0,
+		Profile:          data[2] >> 6,
+		SampleRateIndex:  data[2] >> 2 & 0xf,
+		ChannelConfig:    (data[2]&0x1)<<2 | data[3]>>6,
+		FrameLength:      int(data[3]&0x3)<<11 | int(data[4])<<3 | int(data[5]>>5),
+		BufferFullness:   uint16(data[5]&0x1f)<<6 | uint16(data[6]>>2),
+		NumRawDataBlocks: data[6] & 0x3,
+	}
+	if !h.ProtectionAbsent {
+		if len(data) < 9 {
+			return nil, ErrADTSHeader
+		}
+		h.CRC = uint16(data[7])<<8 | uint16(data[8])
+	}
+	if h.FrameLength < h.HeaderLength() {
+		return nil, ErrADTSHeader
+	}
+	return h, nil
+}
+
+// FindADTSSync returns the offset of the first ADTS header in data that
+// parses, or -1.
+func FindADTSSync(data []byte) int {
+	for i := 0; i+1 < len(data); i++ {
+		if data[i] != 0xff || data[i+1]&0xf6 != 0xf0 {
+			continue
+		}
+		if _, err := ParseADTSHeader(data[i:]); err == nil {
+			return i
+		}
+	}
+	return -1
+}
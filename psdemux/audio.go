@@ -0,0 +1,303 @@
+package psdemux
+
+import (
+	"fmt"
+	"log"
+)
+
+// AudioParams holds the parameters of an audio stream, decoded from the
+// ADTS headers for AAC and fixed by the codec for G.711, G.722 and
+// G.726.
+type AudioParams struct {
+	Codec           AudioCodec
+	Profile         uint8 // AAC audio object type - 1
+	SampleRateIndex uint8
+	SampleRate      int
+	Channels        int
+	CRC             bool // frames are protected by a CRC
+	BitsPerSample   int  // of G.711, G.722 and G.726, 0 for AAC
+}
+
+func (p *AudioParams) String() string {
+	switch p.Codec {
+	case AudioCodecAAC:
+		s := fmt.Sprintf("aac %s sample rate: %d (index %d) channels: %d",
+			(&ADTSHeader{Profile: p.Profile}).ProfileName(), p.SampleRate, p.SampleRateIndex, p.Channels)
+		if p.CRC {
+			s += " crc"
+		}
+		return s
+	case AudioCodecG711A:
+		return fmt.Sprintf("g711a sample rate: %d channels: %d", p.SampleRate, p.Channels)
+	case AudioCodecG711U:
+		return fmt.Sprintf("g711u sample rate: %d channels: %d", p.SampleRate, p.Channels)
+	case AudioCodecG722:
+		return fmt.Sprintf("g722 sample rate: %d channels: %d", p.SampleRate, p.Channels)
+	case AudioCodecG726:
+		return fmt.Sprintf("g726 %dkbit/s sample rate: %d channels: %d", p.SampleRate*p.BitsPerSample/1000, p.SampleRate, p.Channels)
+	}
+	return fmt.Sprintf("%s sample rate: %d channels: %d", p.Codec, p.SampleRate, p.Channels)
+}
+
+// AudioStats counts the frames of an audio stream. G.711, G.722 and G.726
+// have no frames of their own, each PES counts as one.
+type AudioStats struct {
+	Frames     int
+	Samples    int64 // per channel
+	ErrFrames  int   // frames whose header did not parse
+	LengthErrs int   // frame lengths that did not lead to the next frame or the end of the PES
+	// PTS of the first and last PES, and the samples of the last PES
+	FirstPTS    uint64
+	LastPTS     uint64
+	lastSamples int
+	hasPTS      bool
+	// ptsSpan adds up the PTS steps forward, in 90kHz units; where the PTS
+	// jumps back, jumpSamples takes the samples of the PES before
+	ptsSpan     uint64
+	jumpSamples int64
+	// start of an ADTS frame that continues in the next PES
+	carry []byte
+	// bytes of G.711, G.722 and G.726, whose samples need not end on a
+	// byte at the end of a PES
+	bytes int64
+}
+
+// ptsWrap is where the 33-bit PTS wraps around.
+const ptsWrap = 1 << 33
+
+// Duration returns the duration of the samples counted, in seconds.
+func (s *AudioStats) Duration(sampleRate int) float64 {
+	if sampleRate == 0 {
+		return 0
+	}
+	return float64(s.Samples) / float64(sampleRate)
+}
+
+// PTSDuration returns the duration the PTS cover, from the first PES to
+// the end of the last one, in seconds. The PTS may wrap around; where they
+// jump back, the segments before and after are added up.
+func (s *AudioStats) PTSDuration(sampleRate int) float64 {
+	if !s.hasPTS || sampleRate == 0 {
+		return 0
+	}
+	return float64(s.ptsSpan)/90000 + float64(s.jumpSamples+int64(s.lastSamples))/float64(sampleRate)
+}
+
+// addPTS tracks the PTS of the next PES. It must be called before
+// lastSamples is set to the samples of that PES.
+func (s *AudioStats) addPTS(pts uint64) {
+	if !s.hasPTS {
+		s.FirstPTS, s.LastPTS, s.hasPTS = pts, pts, true
+		return
+	}
+	// a step of more than half the PTS range is a step back
+	if d := (pts - s.LastPTS) % ptsWrap; d < ptsWrap/2 {
+		s.ptsSpan += d
+	} else {
+		s.jumpSamples += int64(s.lastSamples)
+	}
+	s.LastPTS = pts
+}
+
+func (dec *Demuxer) decodeAudio(hdr *PESHeader, data []byte, corrupt bool) {
+	if dec.opts.Verbose {
+		log.Printf("\t\taudio len : %d", len(data))
+	}
+	if corrupt {
+		if s, ok := dec.audio[hdr.StreamID]; ok {
+			// the rest of a frame carried over is lost
+			s.carry = nil
+		}
+		return
+	}
+	codec := dec.audioCodec(hdr.StreamID)
+	carried := false
+	if s, ok := dec.audio[hdr.StreamID]; ok {
+		carried = s.carry != nil
+	}
+	samples := 0
+	switch {
+	case codec == AudioCodecAAC,
+		codec == AudioCodecUnknown && dec.streamType(hdr.StreamID) == 0 && (carried || FindADTSSync(data) == 0):
+		samples = dec.decodeAAC(hdr.StreamID, data)
+	case codec == AudioCodecG711A, codec == AudioCodecG711U,
+		codec == AudioCodecG722, codec == AudioCodecG726:
+		samples = dec.decodeSamples(hdr.StreamID, codec, data)
+	default:
+		return
+	}
+	s := dec.audioStats(hdr.StreamID)
+	if hdr.HasPTS() {
+		s.addPTS(hdr.PTS)
+		s.lastSamples = samples
+	} else {
+		s.lastSamples += samples
+	}
+}
+
+// decodeAAC splits a PES payload into its ADTS frames and returns the
+// number of samples they hold. A frame that runs past the end of the PES
+// is completed with the start of the next one.
+func (dec *Demuxer) decodeAAC(streamID uint8, data []byte) int {
+	s := dec.audioStats(streamID)
+	if s.carry != nil {
+		data = dec.joinADTS(streamID, s, data)
+	}
+	samples := 0
+	prev := -1 // start of the previous frame
+	for off := 0; off < len(data); {
+		h, err := ParseADTSHeader(data[off:])
+		if err != nil && isADTSPrefix(data[off:]) {
+			// the header continues in the next PES
+			s.carry = append([]byte(nil), data[off:]...)
+			break
+		}
+		if err != nil {
+			// the PES must start with a frame, later the previous
+			// frame_length was wrong
+			if off == 0 {
+				s.ErrFrames++
+				dec.stats.ErrADTSCnt++
+			} else {
+				s.LengthErrs++
+				dec.stats.ErrADTSLengthCnt++
+			}
+			// a wrong frame_length may have jumped past the next frame
+			from := off + 1
+			if prev >= 0 {
+				from = prev + 1
+			}
+			next := FindADTSSync(data[from:])
+			if next < 0 {
+				log.Printf("stream 0x%x adts sync lost at pes offset %d, skip %d bytes", streamID, off, len(data)-off)
+				break
+			}
+			log.Printf("stream 0x%x adts sync lost at pes offset %d, found again at %d", streamID, off, from+next)
+			off = from + next
+			continue
+		}
+		if off+h.FrameLength > len(data) {
+			s.carry = append([]byte(nil), data[off:]...)
+			break
+		}
+		if dec.opts.Verbose {
+			log.Printf("\t\tadts %s sample rate index: %d channels: %d frame_length: %d blocks: %d crc: %t 0x%04x",
+				h.ProfileName(), h.SampleRateIndex, h.ChannelConfig, h.FrameLength, h.NumRawDataBlocks+1, !h.ProtectionAbsent, h.CRC)
+		}
+		dec.updateAudioParams(streamID, &AudioParams{
+			Codec:           AudioCodecAAC,
+			Profile:         h.Profile,
+			SampleRateIndex: h.SampleRateIndex,
+			SampleRate:      h.SampleRate(),
+			Channels:        int(h.ChannelConfig),
+			CRC:             !h.ProtectionAbsent,
+		})
+		s.Frames++
+		s.Samples += int64(h.Samples())
+		samples += h.Samples()
+		prev, off = off, off+h.FrameLength
+	}
+	return samples
+}
+
+// Sample rates of the codecs without headers. GB28181 uses G.711 at 8kHz,
+// one byte per sample of a mono stream. G.722 codes 16kHz audio at 64kbit/s
+// in 4 bits per sample, G.726 8kHz audio in 2 to 5 bits per sample.
+const (
+	g711SampleRate = 8000
+	g722SampleRate = 16000
+	g726SampleRate = 8000
+)
+
+// decodeSamples counts the samples of a G.711, G.722 or G.726 PES payload.
+func (dec *Demuxer) decodeSamples(streamID uint8, codec AudioCodec, data []byte) int {
+	p := &AudioParams{Codec: codec, SampleRate: g711SampleRate, Channels: 1, BitsPerSample: 8}
+	switch codec {
+	case AudioCodecG722:
+		p.SampleRate, p.BitsPerSample = g722SampleRate, 4
+	case AudioCodecG726:
+		p.SampleRate, p.BitsPerSample = g726SampleRate, 4
+		switch dec.opts.G726BitRate {
+		case 16, 24, 40:
+			p.BitsPerSample = dec.opts.G726BitRate / 8
+		}
+	}
+	dec.updateAudioParams(streamID, p)
+	s := dec.audioStats(streamID)
+	s.bytes += int64(len(data))
+	samples := int(s.bytes*8/int64(p.BitsPerSample) - s.Samples)
+	s.Frames++
+	s.Samples += int64(samples)
+	return samples
+}
+
+// joinADTS puts the start of the frame carried over from the previous
+// PES in front of data. If data starts with a frame of its own where the
+// carried frame needs its bytes, the carried frame_length was wrong or the
+// rest of the frame was lost: that is counted as a length error and
+// decoding resumes at the next sync word after the carried frame start.
+func (dec *Demuxer) joinADTS(streamID uint8, s *AudioStats, data []byte) []byte {
+	carry := s.carry
+	s.carry = nil
+	if h, err := ParseADTSHeader(carry); err == nil && FindADTSSync(data) == 0 {
+		need := h.FrameLength - len(carry)
+		if need > len(data) || !adtsFollows(data[need:]) {
+			s.LengthErrs++
+			dec.stats.ErrADTSLengthCnt++
+			log.Printf("stream 0x%x adts frame_length %d runs past the end of the pes, the next one does not continue it", streamID, h.FrameLength)
+			data = append(carry[1:], data...)
+			return data[FindADTSSync(data):]
+		}
+	}
+	return append(carry, data...)
+}
+
+// isADTSPrefix reports whether b is too short for an ADTS header but
+// starts like one.
+func isADTSPrefix(b []byte) bool {
+	const maxHeaderLen = 9 // with CRC
+	return len(b) > 0 && len(b) < maxHeaderLen && b[0] == 0xff && (len(b) == 1 || b[1]&0xf6 == 0xf0)
+}
+
+// adtsFollows reports whether b, what follows a frame, is empty or starts
+// with the next frame.
+func adtsFollows(b []byte) bool {
+	return len(b) == 0 || isADTSPrefix(b) || FindADTSSync(b) == 0
+}
+
+// updateAudioParams records the parameters of streamID and reports when
+// they change mid-stream.
+func (dec *Demuxer) updateAudioParams(streamID uint8, p *AudioParams) {
+	old, ok := dec.audioParams[streamID]
+	if ok && *old == *p {
+		return
+	}
+	if ok {
+		dec.stats.AudioParamsChangeCnt++
+		log.Printf("stream 0x%x audio params changed at pos %d: %s -> %s", streamID, dec.getPos(), old, p)
+	} else if dec.opts.Verbose {
+		log.Printf("\t\t\t%s", p)
+	}
+	dec.audioParams[streamID] = p
+}
+
+func (dec *Demuxer) audioStats(streamID uint8) *AudioStats {
+	s, ok := dec.audio[streamID]
+	if !ok {
+		s = &AudioStats{}
+		dec.audio[streamID] = s
+	}
+	return s
+}
+
+// AudioParams returns the parameters of the audio stream streamID, or nil
+// if its codec has no headers to decode them from.
+func (dec *Demuxer) AudioParams(streamID uint8) *AudioParams {
+	return dec.audioParams[streamID]
+}
+
+// AudioStats returns the frame counters of the audio stream streamID, or
+// nil.
+func (dec *Demuxer) AudioStats(streamID uint8) *AudioStats {
+	return dec.audio[streamID]
+}
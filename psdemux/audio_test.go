@@ -0,0 +1,161 @@
+package psdemux_test
+
+import (
+	"bytes"
+	"math"
+	"testing"
+
+	"mpegps-parser/psdemux"
+	"mpegps-parser/psmux"
+)
+
+// adtsFrame returns an AAC LC 48kHz stereo ADTS frame of n bytes.
+func adtsFrame(n int, fill byte) []byte {
+	f := []byte{0xff, 0xf1, 0x4c, 0x80 | uint8(n>>11), uint8(n >> 3), uint8(n&7)<<5 | 0x1f, 0xfc}
+	return append(f, bytes.Repeat([]byte{fill}, n-len(f))...)
+}
+
+// muxAAC writes frames with the given PTS as an audio only program stream,
+// in PES packets of at most maxPayload bytes, and demuxes it.
+func muxAAC(t *testing.T, frames [][]byte, pts []uint64, maxPayload int) *psdemux.Demuxer {
+	return demux(t, muxAACBytes(t, frames, pts, maxPayload))
+}
+
+func demux(t *testing.T, ps []byte) *psdemux.Demuxer {
+	dec := psdemux.NewDemuxer(bytes.NewReader(ps), &psdemux.Options{})
+	if err := dec.Demux(); err != nil {
+		t.Fatal(err)
+	}
+	return dec
+}
+
+func muxAACBytes(t *testing.T, frames [][]byte, pts []uint64, maxPayload int) []byte {
+	var ps bytes.Buffer
+	m := psmux.NewMuxer(&ps, &psmux.Options{AudioStreamType: psdemux.StreamTypeAAC, MaxPESPayload: maxPayload})
+	for i, f := range frames {
+		if err := m.WriteAudio(f, pts[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m.Close()
+	return ps.Bytes()
+}
+
+func TestADTSAcrossPES(t *testing.T) {
+	// two frames per write, so frames start in the middle of a PES and
+	// run into the next ones
+	var frames [][]byte
+	var pts []uint64
+	for i := 0; i < 10; i++ {
+		frames = append(frames, append(adtsFrame(300+i, 0x11), adtsFrame(200, 0x22)...))
+		pts = append(pts, uint64(i)*2*1920)
+	}
+	for _, maxPayload := range []int{0, 1000, 256, 97, 7} {
+		dec := muxAAC(t, frames, pts, maxPayload)
+		a := dec.AudioStats(0xc0)
+		if a == nil || a.Frames != 20 || a.Samples != 20*1024 || a.LengthErrs != 0 || a.ErrFrames != 0 {
+			t.Errorf("pes payload %d: %+v, want 20 frames without errors", maxPayload, a)
+		}
+	}
+}
+
+func TestADTSLostContinuation(t *testing.T) {
+	var frames [][]byte
+	var pts []uint64
+	for i := 0; i < 5; i++ {
+		frames = append(frames, adtsFrame(300, 0x44))
+		pts = append(pts, uint64(i)*1920)
+	}
+	// every frame takes a PES with PTS and one without, drop the second
+	// one of the third frame
+	ps := muxAACBytes(t, frames, pts, 256)
+	cont := 0
+	for i := 0; i+9 < len(ps); i++ {
+		if !bytes.Equal(ps[i:i+4], []byte{0, 0, 1, 0xc0}) || ps[i+7]&0xc0 != 0 {
+			continue
+		}
+		if cont++; cont == 3 {
+			n := 6 + (int(ps[i+4])<<8 | int(ps[i+5]))
+			ps = append(ps[:i], ps[i+n:]...)
+			break
+		}
+	}
+	a := demux(t, ps).AudioStats(0xc0)
+	if a.Frames != 4 || a.LengthErrs != 1 || a.ErrFrames != 0 {
+		t.Errorf("%+v, want 4 frames and a length error", a)
+	}
+}
+
+func TestPTSDuration(t *testing.T) {
+	const step = 1920 // 1024 samples at 48kHz
+	tests := []struct {
+		name string
+		pts  []uint64
+	}{
+		{"wrap", []uint64{1<<33 - 2*step, 1<<33 - step, 0, step, 2 * step}},
+		{"back", []uint64{90000, 90000 + step, 90000 + 2*step, 0, step}},
+	}
+	for _, tt := range tests {
+		var frames [][]byte
+		for range tt.pts {
+			frames = append(frames, adtsFrame(100, 0x33))
+		}
+		a := muxAAC(t, frames, tt.pts, 0).AudioStats(0xc0)
+		want := float64(len(tt.pts)) * 1024 / 48000
+		if got := a.PTSDuration(48000); math.Abs(got-want) > 1e-9 {
+			t.Errorf("%s: pts duration %.6fs, want %.6fs", tt.name, got, want)
+		}
+	}
+}
+
+func TestAudioCodec(t *testing.T) {
+	// G.711 in the program stream map, 160 bytes every 20ms
+	var ps bytes.Buffer
+	m := psmux.NewMuxer(&ps, &psmux.Options{AudioStreamType: psdemux.StreamTypeG711A})
+	for i := 0; i < 50; i++ {
+		if err := m.WriteAudio(make([]byte, 160), uint64(i)*1800); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m.Close()
+	tests := []struct {
+		codec       psdemux.AudioCodec
+		g726BitRate int
+		rate        int
+		bits        int
+	}{
+		{psdemux.AudioCodecUnknown, 0, 8000, 8},
+		{psdemux.AudioCodecG711U, 0, 8000, 8},
+		{psdemux.AudioCodecG722, 0, 16000, 4},
+		{psdemux.AudioCodecG726, 0, 8000, 4},
+		{psdemux.AudioCodecG726, 16, 8000, 2},
+		{psdemux.AudioCodecG726, 40, 8000, 5},
+	}
+	for _, tt := range tests {
+		dec := psdemux.NewDemuxer(bytes.NewReader(ps.Bytes()), &psdemux.Options{
+			AudioCodec:  tt.codec,
+			G726BitRate: tt.g726BitRate,
+		})
+		if err := dec.Demux(); err != nil {
+			t.Fatal(err)
+		}
+		// the override wins over the map; G.722 and G.726 have no
+		// stream_type to give the muxers
+		want := uint8(psdemux.StreamTypeG711A)
+		if tt.codec != psdemux.AudioCodecUnknown {
+			want = tt.codec.StreamType()
+		}
+		if got := dec.AudioStreamType(); got != want {
+			t.Errorf("%s: AudioStreamType 0x%x, want 0x%x", tt.codec, got, want)
+		}
+		p, a := dec.AudioParams(0xc0), dec.AudioStats(0xc0)
+		if p == nil || p.SampleRate != tt.rate || p.BitsPerSample != tt.bits {
+			t.Errorf("%s %dkbit/s: %v, want %dHz %d bits", tt.codec, tt.g726BitRate, p, tt.rate, tt.bits)
+			continue
+		}
+		if want := int64(50 * 160 * 8 / tt.bits); a.Frames != 50 || a.Samples != want {
+			t.Errorf("%s %dkbit/s: %d frames %d samples, want 50 frames %d samples",
+				tt.codec, tt.g726BitRate, a.Frames, a.Samples, want)
+		}
+	}
+}
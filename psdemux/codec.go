@@ -0,0 +1,169 @@
+package psdemux
+
+// stream_type values seen in program stream maps (ISO/IEC 13818-1 Table 2-34
+// and GB28181)
+const (
+	StreamTypeMPEG2Video = 0x02
+	StreamTypeMPEG4Video = 0x10
+	StreamTypeH264       = 0x1b
+	StreamTypeH265       = 0x24
+	StreamTypeSVAC       = 0x80
+	StreamTypeAAC        = 0x0f
+	StreamTypeG711A      = 0x90
+	StreamTypeG711U      = 0x91
+	StreamTypeG7221      = 0x92
+	StreamTypeG7231      = 0x93
+	StreamTypeG729       = 0x99
+	StreamTypeSVACAudio  = 0x9b
+)
+
+// Codec identifies the codec of an elementary stream.
+type Codec int
+
+const (
+	CodecUnknown Codec = iota
+	CodecH264
+	CodecH265
+	CodecMPEG2Video
+	CodecMPEG4Video
+	CodecSVAC
+)
+
+// CodecOf returns the codec for a PSM stream_type.
+func CodecOf(streamType uint8) Codec {
+	switch streamType {
+	case StreamTypeH264:
+		return CodecH264
+	case StreamTypeH265:
+		return CodecH265
+	case StreamTypeMPEG2Video:
+		return CodecMPEG2Video
+	case StreamTypeMPEG4Video:
+		return CodecMPEG4Video
+	case StreamTypeSVAC:
+		return CodecSVAC
+	}
+	return CodecUnknown
+}
+
+func (c Codec) String() string {
+	switch c {
+	case CodecH264:
+		return "h264"
+	case CodecH265:
+		return "h265"
+	case CodecMPEG2Video:
+		return "mpeg2video"
+	case CodecMPEG4Video:
+		return "mpeg4video"
+	case CodecSVAC:
+		return "svac"
+	}
+	return "unknown"
+}
+
+// AudioCodec identifies the codec of an audio stream. GB28181 assigns no
+// stream_type to G.722 and G.726; devices that send them label them with
+// another stream_type or leave them out of the program stream map, so they
+// can only be named through Options.AudioCodec.
+type AudioCodec int
+
+const (
+	AudioCodecUnknown AudioCodec = iota
+	AudioCodecAAC
+	AudioCodecG711A
+	AudioCodecG711U
+	AudioCodecG722
+	AudioCodecG726
+)
+
+// AudioCodecOf returns the audio codec for a PSM stream_type.
+func AudioCodecOf(streamType uint8) AudioCodec {
+	switch streamType {
+	case StreamTypeAAC:
+		return AudioCodecAAC
+	case StreamTypeG711A:
+		return AudioCodecG711A
+	case StreamTypeG711U:
+		return AudioCodecG711U
+	}
+	return AudioCodecUnknown
+}
+
+// StreamType returns the PSM stream_type of c, or 0 for the codecs that
+// have none.
+func (c AudioCodec) StreamType() uint8 {
+	switch c {
+	case AudioCodecAAC:
+		return StreamTypeAAC
+	case AudioCodecG711A:
+		return StreamTypeG711A
+	case AudioCodecG711U:
+		return StreamTypeG711U
+	}
+	return 0
+}
+
+func (c AudioCodec) String() string {
+	switch c {
+	case AudioCodecAAC:
+		return "aac"
+	case AudioCodecG711A:
+		return "g711a"
+	case AudioCodecG711U:
+		return "g711u"
+	case AudioCodecG722:
+		return "g722"
+	case AudioCodecG726:
+		return "g726"
+	}
+	return "unknown"
+}
+
+// videoCodec returns the codec of a video stream. Streams the program
+// stream map does not describe are assumed to be H.264.
+func (dec *Demuxer) videoCodec(streamID uint8) Codec {
+	if codec := CodecOf(dec.streamType(streamID)); codec != CodecUnknown {
+		return codec
+	}
+	return CodecH264
+}
+
+// VideoCodec returns the codec of the first video stream (0xE0) as
+// announced by the program stream map.
+func (dec *Demuxer) VideoCodec() Codec {
+	return dec.videoCodec(StartCodeVideo & 0xff)
+}
+
+// AudioStreamType returns the stream_type of the first audio stream
+// (0xC0): the one of Options.AudioCodec if set, otherwise the one the
+// program stream map announced, or 0.
+func (dec *Demuxer) AudioStreamType() uint8 {
+	if dec.opts.AudioCodec != AudioCodecUnknown {
+		return dec.opts.AudioCodec.StreamType()
+	}
+	return dec.streamType(StartCodeAudio & 0xff)
+}
+
+// audioCodec returns the codec of an audio stream, as set by
+// Options.AudioCodec or else by the program stream map.
+func (dec *Demuxer) audioCodec(streamID uint8) AudioCodec {
+	if dec.opts.AudioCodec != AudioCodecUnknown {
+		return dec.opts.AudioCodec
+	}
+	return AudioCodecOf(dec.streamType(streamID))
+}
+
+// streamType returns the stream_type of streamID from the current program
+// stream map, falling back to the last one that listed it.
+func (dec *Demuxer) streamType(streamID uint8) uint8 {
+	if dec.psm != nil {
+		if streamType, ok := dec.psm.StreamType(streamID); ok {
+			return streamType
+		}
+	}
+	if s, ok := dec.streams[streamID]; ok {
+		return s.StreamType
+	}
+	return 0
+}
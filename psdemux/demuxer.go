@@ -0,0 +1,244 @@
+// Package psdemux demultiplexes MPEG-2 program streams (ISO/IEC 13818-1)
+// into pack headers, program stream maps and PES packets.
+package psdemux
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+
+	"mpegps-parser/bitreader"
+)
+
+const (
+	StartCodePS    = 0x000001ba
+	StartCodeSYS   = 0x000001bb
+	StartCodeMAP   = 0x000001bc
+	StartCodeVideo = 0x000001e0
+	StartCodeAudio = 0x000001c0
+)
+
+const (
+	VideoPES   = 0x01
+	AudioPES   = 0x02
+	PrivatePES = 0x03 // private_stream_1, private_stream_2
+	OtherPES   = 0x04 // ECM, EMM, DSMCC and other stream ids
+)
+
+var (
+	ErrNotFoundStartCode = errors.New("not found the need start code flag")
+	ErrFormatPack        = errors.New("not package standard")
+	ErrParsePakcet       = errors.New("parse ps packet error")
+	ErrNewBiteReader     = errors.New("new bit reader error")
+	ErrCheckH264         = errors.New("check h264 error")
+	ErrCheckPayloadLen   = errors.New("check payload length error")
+)
+
+// Options controls what the Demuxer prints and where it sends the
+// elementary stream payloads. The zero value demuxes silently.
+type Options struct {
+	Verbose           bool
+	PrintPackHeader   bool
+	PrintSysHeader    bool
+	PrintPsm          bool
+	DumpPesStartBytes bool
+	// Resync skips to the next valid start code instead of failing when
+	// the stream was joined in the middle or lost data, as happens with
+	// live network input.
+	Resync bool
+	// AudioCodec, if set, is the codec of the audio streams whatever the
+	// program stream map says, e.g. AudioCodecG722 or AudioCodecG726 which
+	// GB28181 has no stream_type for.
+	AudioCodec AudioCodec
+	// G726BitRate is the bit rate of G.726 audio in kbit/s: 16, 24, 32 or
+	// 40. Any other value means 32.
+	G726BitRate int
+
+	// VideoWriter and AudioWriter, when set, receive the payload of every
+	// valid PES packet of stream 0xE0 and 0xC0. StreamWriter is asked once
+	// for the writer of every other stream; it may return nil.
+	VideoWriter  io.Writer
+	AudioWriter  io.Writer
+	StreamWriter func(streamID uint8) io.Writer
+
+	// OnPack is called after every pack header, OnPSM after every program
+	// stream map with a valid CRC and OnPES after every PES packet.
+	OnPack func(*PackHeader)
+	OnPSM  func(*ProgramStreamMap)
+	OnPES  func(*PESPacket)
+}
+
+// PESPacket is a demuxed PES packet.
+type PESPacket struct {
+	Type     int // VideoPES, AudioPES, PrivatePES or OtherPES
+	Header   PESHeader
+	StartPos int64 // offset of the packet start code
+	Payload  []byte
+	// Corrupt is set when PES_packet_length did not lead to the next start
+	// code; Payload then holds the bytes up to the next start code.
+	Corrupt bool
+}
+
+// StreamInfo describes the elementary streams announced by the program
+// stream map.
+type StreamInfo struct {
+	VideoStreamType uint32
+	AudioStreamType uint32
+}
+
+// Stats holds the counters collected while demuxing.
+type Stats struct {
+	PktCnt               int
+	PsmCnt               int
+	TotalVideoFrameCnt   int
+	ErrVideoFrameCnt     int
+	TotalAudioFrameCnt   int
+	ErrAudioFrameCnt     int
+	IFrameCnt            int
+	ErrIFrameCnt         int
+	PFrameCnt            int // non-IDR (non-IRAP for H.265) pictures
+	NonRefFrameCnt       int // of those, with nal_ref_idc 0 or sub-layer non-reference
+	ErrPESHeaderCnt      int
+	PackCnt              int
+	ErrPackHeaderCnt     int
+	MPEG1PackCnt         int
+	ErrSysHeaderCnt      int
+	ErrPsmCRCCnt         int
+	TotalOtherPktCnt     int
+	PaddingCnt           int
+	PaddingBytes         int64
+	H264NalCnt           [32]int // per nal_unit_type
+	H265NalCnt           [64]int // per nal_unit_type
+	ErrNalCnt            int     // NAL units with forbidden_zero_bit set
+	ErrParamSetCnt       int     // SPS/PPS that failed to parse
+	VideoParamsChangeCnt int
+	ErrADTSCnt           int // audio PES of AAC streams not starting with an ADTS header
+	ErrADTSLengthCnt     int // ADTS frame_length not leading to the next frame or the PES end
+	AudioParamsChangeCnt int
+	ResyncCnt            int   // times the demuxer searched for a start code
+	ResyncBytes          int64 // bytes skipped doing so
+}
+
+// Demuxer parses a program stream read from an io.Reader. Only a bounded
+// window of the stream is held in memory.
+type Demuxer struct {
+	br            bitreader.BitReader
+	win           *window
+	pesStartBytes []byte
+	packHeader    PackHeader
+	sysHeader     *SystemHeader
+	psm           *ProgramStreamMap
+	streams       map[uint8]*StreamStats
+	writers       map[uint8]io.Writer
+	videoParams   map[uint8]*VideoParams
+	audioParams   map[uint8]*AudioParams
+	audio         map[uint8]*AudioStats
+	videoAU       map[uint8]*accessUnit
+	handlers      map[int]func() error
+	streamInfo    StreamInfo
+	stats         Stats
+	opts          Options
+}
+
+// NewDemuxer returns a Demuxer reading the program stream from r.
+// opts may be nil.
+func NewDemuxer(r io.Reader, opts *Options) *Demuxer {
+	win := newWindow(r)
+	dec := &Demuxer{
+		br:          bitreader.NewReader(win),
+		win:         win,
+		streams:     make(map[uint8]*StreamStats),
+		writers:     make(map[uint8]io.Writer),
+		videoParams: make(map[uint8]*VideoParams),
+		audioParams: make(map[uint8]*AudioParams),
+		audio:       make(map[uint8]*AudioStats),
+		videoAU:     make(map[uint8]*accessUnit),
+	}
+	if opts != nil {
+		dec.opts = *opts
+	}
+	dec.handlers = map[int]func() error{
+		StartCodePS:  dec.decodePsHeader,
+		StartCodeSYS: dec.decodeSystemHeader,
+		StartCodeMAP: dec.decodeProgramStreamMap,
+		StartCodeEnd: dec.decodeProgramEnd,
+	}
+	for id := StreamIDPrivate1; id <= 0xff; id++ {
+		dec.handlers[0x100|id] = dec.pesHandler(uint8(id))
+	}
+	return dec
+}
+
+// Demux parses packets until the end of the stream.
+func (dec *Demuxer) Demux() error {
+	for dec.more() {
+		startCode, err := dec.br.Peek32(32)
+		if err != nil && !dec.opts.Resync {
+			log.Println(err)
+			return err
+		}
+		handler, ok := dec.handlers[int(startCode)]
+		if err != nil || !ok {
+			if !dec.opts.Resync {
+				log.Printf("check startCode error: 0x%x pos:%d\n", startCode, dec.getPos())
+				return ErrParsePakcet
+			}
+			dec.resync()
+			continue
+		}
+		dec.br.Skip(32)
+		dec.stats.PktCnt++
+		if dec.opts.Verbose {
+			fmt.Println()
+			log.Printf("pkt count: %d pos: %d", dec.stats.PktCnt, dec.getPos())
+		}
+		handler()
+	}
+	for streamID := range dec.videoAU {
+		dec.flushVideo(streamID)
+	}
+	if dec.win.err != io.EOF {
+		return dec.win.err
+	}
+	return nil
+}
+
+// Stats returns the counters collected so far.
+func (dec *Demuxer) Stats() Stats {
+	return dec.stats
+}
+
+// StreamInfo returns the stream types announced by the last program stream map.
+func (dec *Demuxer) StreamInfo() StreamInfo {
+	return dec.streamInfo
+}
+
+func (dec *Demuxer) getPos() int64 {
+	return dec.br.ByteOffset()
+}
+
+// resync skips at least one byte, up to the next start code the demuxer
+// can handle or the end of the stream.
+func (dec *Demuxer) resync() {
+	start := dec.getPos()
+	dec.br.Skip(8)
+	for {
+		pos, found := dec.getNextPackPos()
+		dec.br.Skip(uint(pos-dec.getPos()) * 8)
+		if found || dec.win.err != nil {
+			break
+		}
+	}
+	dec.stats.ResyncCnt++
+	dec.stats.ResyncBytes += dec.getPos() - start
+	if dec.opts.Verbose {
+		log.Printf("resync: skipped %d bytes from pos %d", dec.getPos()-start, start)
+	}
+}
+
+// more reports whether there is at least one unread byte in the stream.
+func (dec *Demuxer) more() bool {
+	_, ok := dec.win.peek(dec.getPos(), 1)
+	return ok
+}
@@ -0,0 +1,267 @@
+package psdemux
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+
+	"mpegps-parser/bitreader"
+)
+
+const (
+	DescriptorVideoStream  = 0x02
+	DescriptorAudioStream  = 0x03
+	DescriptorRegistration = 0x05
+	DescriptorLanguage     = 0x0a
+	DescriptorAVCVideo     = 0x28
+	// private descriptors written by Hikvision cameras and many GB28181
+	// devices derived from them
+	DescriptorHikBasic  = 0x40
+	DescriptorHikDevice = 0x41
+	DescriptorHikVideo  = 0x42
+	DescriptorHikAudio  = 0x43
+)
+
+// Descriptor is a descriptor from a program stream map. Data holds the raw
+// descriptor body; the field matching Tag is filled for known descriptors.
+type Descriptor struct {
+	Tag          uint8
+	Data         []byte
+	Video        *VideoStreamDescriptor
+	Audio        *AudioStreamDescriptor
+	Registration *RegistrationDescriptor
+	Languages    []LanguageDescriptor
+	AVC          *AVCVideoDescriptor
+	HikBasic     *HikBasicDescriptor
+	HikVideo     *HikVideoDescriptor
+}
+
+// VideoStreamDescriptor is a video_stream_descriptor().
+type VideoStreamDescriptor struct {
+	MultipleFrameRateFlag     bool
+	FrameRateCode             uint8
+	MPEG1OnlyFlag             bool
+	ConstrainedParameterFlag  bool
+	StillPictureFlag          bool
+	ProfileAndLevelIndication uint8
+	ChromaFormat              uint8
+	FrameRateExtensionFlag    bool
+}
+
+// AudioStreamDescriptor is an audio_stream_descriptor().
+type AudioStreamDescriptor struct {
+	FreeFormatFlag             bool
+	ID                         bool
+	Layer                      uint8
+	VariableRateAudioIndicator bool
+}
+
+// RegistrationDescriptor is a registration_descriptor().
+type RegistrationDescriptor struct {
+	FormatIdentifier         uint32
+	AdditionalIdentification []byte
+}
+
+// LanguageDescriptor is one entry of an ISO_639_language_descriptor().
+type LanguageDescriptor struct {
+	Language  string
+	AudioType uint8
+}
+
+// AVCVideoDescriptor is an AVC_video_descriptor().
+type AVCVideoDescriptor struct {
+	ProfileIdc           uint8
+	ConstraintFlags      uint8
+	LevelIdc             uint8
+	AVCStillPresent      bool
+	AVC24HourPictureFlag bool
+}
+
+// HikBasicDescriptor is the private basic descriptor found in the
+// program_stream_info of Hikvision streams. It starts with a two byte
+// company mark ("HK").
+type HikBasicDescriptor struct {
+	CompanyMark string
+}
+
+// HikVideoDescriptor is the private video descriptor Hikvision cameras put
+// in the elementary_stream_info of the video stream.
+type HikVideoDescriptor struct {
+	Width  uint16
+	Height uint16
+}
+
+// Name returns a short name for the descriptor tag.
+func (d *Descriptor) Name() string {
+	switch d.Tag {
+	case DescriptorVideoStream:
+		return "video_stream_descriptor"
+	case DescriptorAudioStream:
+		return "audio_stream_descriptor"
+	case DescriptorRegistration:
+		return "registration_descriptor"
+	case DescriptorLanguage:
+		return "ISO_639_language_descriptor"
+	case DescriptorAVCVideo:
+		return "AVC_video_descriptor"
+	case DescriptorHikBasic:
+		return "hik_basic_descriptor"
+	case DescriptorHikDevice:
+		return "hik_device_descriptor"
+	case DescriptorHikVideo:
+		return "hik_video_descriptor"
+	case DescriptorHikAudio:
+		return "hik_audio_descriptor"
+	}
+	return "unknown_descriptor"
+}
+
+// readDescriptors reads length bytes worth of descriptors from br.
+func readDescriptors(br bitreader.BitReader, length int) ([]Descriptor, error) {
+	var descriptors []Descriptor
+	for length > 0 {
+		if length < 2 {
+			return descriptors, ErrFormatPack
+		}
+		tag, err := br.Read8(8)
+		if err != nil {
+			return descriptors, err
+		}
+		descriptorLen, err := br.Read8(8)
+		if err != nil {
+			return descriptors, err
+		}
+		length -= 2
+		if int(descriptorLen) > length {
+			return descriptors, ErrFormatPack
+		}
+		d := Descriptor{Tag: tag, Data: make([]byte, descriptorLen)}
+		if _, err := io.ReadFull(br, d.Data); err != nil {
+			return descriptors, err
+		}
+		d.decode()
+		descriptors = append(descriptors, d)
+		length -= int(descriptorLen)
+	}
+	return descriptors, nil
+}
+
+// decode fills the structured field for known tags. Descriptors too short
+// for their syntax are left undecoded.
+func (d *Descriptor) decode() {
+	data := d.Data
+	switch d.Tag {
+	case DescriptorVideoStream:
+		if len(data) < 1 {
+			return
+		}
+		v := &VideoStreamDescriptor{
+			MultipleFrameRateFlag:    data[0]&0x80 != 0,
+			FrameRateCode:            data[0] >> 3 & 0xf,
+			MPEG1OnlyFlag:            data[0]&0x04 != 0,
+			ConstrainedParameterFlag: data[0]&0x02 != 0,
+			StillPictureFlag:         data[0]&0x01 != 0,
+		}
+		if !v.MPEG1OnlyFlag {
+			if len(data) < 3 {
+				return
+			}
+			v.ProfileAndLevelIndication = data[1]
+			v.ChromaFormat = data[2] >> 6
+			v.FrameRateExtensionFlag = data[2]&0x20 != 0
+		}
+		d.Video = v
+	case DescriptorAudioStream:
+		if len(data) < 1 {
+			return
+		}
+		d.Audio = &AudioStreamDescriptor{
+			FreeFormatFlag:             data[0]&0x80 != 0,
+			ID:                         data[0]&0x40 != 0,
+			Layer:                      data[0] >> 4 & 0x3,
+			VariableRateAudioIndicator: data[0]&0x08 != 0,
+		}
+	case DescriptorRegistration:
+		if len(data) < 4 {
+			return
+		}
+		d.Registration = &RegistrationDescriptor{
+			FormatIdentifier:         binary.BigEndian.Uint32(data),
+			AdditionalIdentification: data[4:],
+		}
+	case DescriptorLanguage:
+		for i := 0; i+4 <= len(data); i += 4 {
+			d.Languages = append(d.Languages, LanguageDescriptor{
+				Language:  string(data[i : i+3]),
+				AudioType: data[i+3],
+			})
+		}
+	case DescriptorAVCVideo:
+		if len(data) < 4 {
+			return
+		}
+		d.AVC = &AVCVideoDescriptor{
+			ProfileIdc:           data[0],
+			ConstraintFlags:      data[1],
+			LevelIdc:             data[2],
+			AVCStillPresent:      data[3]&0x80 != 0,
+			AVC24HourPictureFlag: data[3]&0x40 != 0,
+		}
+	case DescriptorHikBasic:
+		if len(data) < 2 {
+			return
+		}
+		d.HikBasic = &HikBasicDescriptor{CompanyMark: string(data[:2])}
+	case DescriptorHikVideo:
+		if len(data) < 8 {
+			return
+		}
+		d.HikVideo = &HikVideoDescriptor{
+			Width:  binary.BigEndian.Uint16(data[4:]),
+			Height: binary.BigEndian.Uint16(data[6:]),
+		}
+	}
+}
+
+// fourCC formats a registration format_identifier, e.g. "HEVC".
+func fourCC(v uint32) string {
+	b := []byte{byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)}
+	for _, c := range b {
+		if c < 0x20 || c > 0x7e {
+			return fmt.Sprintf("0x%08x", v)
+		}
+	}
+	return string(b)
+}
+
+func showDescriptors(indent string, descriptors []Descriptor) {
+	for _, d := range descriptors {
+		log.Printf("%s%s tag: 0x%x len: %d", indent, d.Name(), d.Tag, len(d.Data))
+		switch {
+		case d.Video != nil:
+			v := d.Video
+			log.Printf("%s\tframe_rate_code: %d MPEG_1_only_flag: %t profile_and_level_indication: 0x%x chroma_format: %d",
+				indent, v.FrameRateCode, v.MPEG1OnlyFlag, v.ProfileAndLevelIndication, v.ChromaFormat)
+		case d.Audio != nil:
+			a := d.Audio
+			log.Printf("%s\tfree_format_flag: %t ID: %t layer: %d variable_rate_audio_indicator: %t",
+				indent, a.FreeFormatFlag, a.ID, a.Layer, a.VariableRateAudioIndicator)
+		case d.Registration != nil:
+			log.Printf("%s\tformat_identifier: %s", indent, fourCC(d.Registration.FormatIdentifier))
+		case d.Languages != nil:
+			for _, l := range d.Languages {
+				log.Printf("%s\tISO_639_language_code: %s audio_type: %d", indent, l.Language, l.AudioType)
+			}
+		case d.AVC != nil:
+			log.Printf("%s\tprofile_idc: %d constraint_flags: 0x%x level_idc: %d",
+				indent, d.AVC.ProfileIdc, d.AVC.ConstraintFlags, d.AVC.LevelIdc)
+		case d.HikBasic != nil:
+			log.Printf("%s\tcompany mark: %q data: % X", indent, d.HikBasic.CompanyMark, d.Data)
+		case d.HikVideo != nil:
+			log.Printf("%s\twidth: %d height: %d data: % X", indent, d.HikVideo.Width, d.HikVideo.Height, d.Data)
+		default:
+			log.Printf("%s\tdata: % X", indent, d.Data)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package psdemux
+
+import "log"
+
+// H.264 nal_unit_type values (ITU-T H.264 Table 7-1)
+const (
+	H264NalSlice       = 1
+	H264NalSliceDPA    = 2
+	H264NalSliceDPB    = 3
+	H264NalSliceDPC    = 4
+	H264NalIDR         = 5
+	H264NalSEI         = 6
+	H264NalSPS         = 7
+	H264NalPPS         = 8
+	H264NalAUD         = 9
+	H264NalEndOfSeq    = 10
+	H264NalEndOfStream = 11
+	H264NalFiller      = 12
+	H264NalSPSExt      = 13
+	H264NalPrefix      = 14
+	H264NalSubsetSPS   = 15
+	H264NalAux         = 19
+	H264NalSliceExt    = 20
+)
+
+// H264NalHeader is the one byte header of an H.264 NAL unit.
+type H264NalHeader struct {
+	ForbiddenBit bool
+	RefIdc       uint8
+	Type         uint8
+}
+
+// ParseH264NalHeader decodes the NAL unit header at the start of nalu.
+func ParseH264NalHeader(nalu []byte) (H264NalHeader, bool) {
+	if len(nalu) < 1 {
+		return H264NalHeader{}, false
+	}
+	return H264NalHeader{
+		ForbiddenBit: nalu[0]&0x80 != 0,
+		RefIdc:       nalu[0] >> 5 & 0x3,
+		Type:         nalu[0] & 0x1f,
+	}, true
+}
+
+// IsSlice reports whether the NAL unit carries a coded slice.
+func (h H264NalHeader) IsSlice() bool {
+	return h.Type >= H264NalSlice && h.Type <= H264NalIDR
+}
+
+// H264NalTypeName returns the name of an H.264 nal_unit_type.
+func H264NalTypeName(t uint8) string {
+	switch t {
+	case H264NalSlice:
+		return "non-IDR slice"
+	case H264NalSliceDPA:
+		return "slice data partition A"
+	case H264NalSliceDPB:
+		return "slice data partition B"
+	case H264NalSliceDPC:
+		return "slice data partition C"
+	case H264NalIDR:
+		return "IDR"
+	case H264NalSEI:
+		return "SEI"
+	case H264NalSPS:
+		return "SPS"
+	case H264NalPPS:
+		return "PPS"
+	case H264NalAUD:
+		return "AUD"
+	case H264NalEndOfSeq:
+		return "end of sequence"
+	case H264NalEndOfStream:
+		return "end of stream"
+	case H264NalFiller:
+		return "filler"
+	case H264NalSPSExt:
+		return "SPS extension"
+	case H264NalPrefix:
+		return "prefix"
+	case H264NalSubsetSPS:
+		return "subset SPS"
+	case H264NalAux:
+		return "auxiliary slice"
+	case H264NalSliceExt:
+		return "slice extension"
+	}
+	return "reserved"
+}
+
+// decodeH264 counts the NAL units and the picture of an access unit.
+func (dec *Demuxer) decodeH264(streamID uint8, data []byte, err bool) error {
+	if dec.opts.Verbose {
+		log.Printf("\t\th264 len : %d", len(data))
+	}
+	idr, slice, nonRef := false, false, false
+	for _, nalu := range SplitNALUnits(data) {
+		hdr, ok := ParseH264NalHeader(nalu)
+		if !ok {
+			continue
+		}
+		dec.stats.H264NalCnt[hdr.Type]++
+		if hdr.ForbiddenBit {
+			dec.stats.ErrNalCnt++
+		}
+		switch {
+		case hdr.Type == H264NalIDR:
+			idr = true
+		case hdr.IsSlice():
+			slice = true
+			nonRef = nonRef || hdr.RefIdc == 0
+		}
+		if dec.opts.Verbose {
+			log.Printf("\t\t%s nal_ref_idc: %d size: %d", H264NalTypeName(hdr.Type), hdr.RefIdc, len(nalu))
+		}
+		if !err {
+			dec.decodeH264ParamSet(streamID, hdr.Type, nalu)
+		}
+	}
+	// an access unit holds one picture, count it once
+	switch {
+	case idr:
+		if err {
+			dec.stats.ErrIFrameCnt++
+		} else {
+			dec.stats.IFrameCnt++
+		}
+	case slice:
+		dec.stats.PFrameCnt++
+		if nonRef {
+			dec.stats.NonRefFrameCnt++
+		}
+	}
+	return nil
+}
+
+func (dec *Demuxer) decodeH264ParamSet(streamID uint8, nalType uint8, nalu []byte) {
+	switch nalType {
+	case H264NalSPS:
+		p, err := ParseH264SPS(nalu)
+		if err != nil {
+			log.Printf("parse h264 sps error: %v", err)
+			dec.stats.ErrParamSetCnt++
+			return
+		}
+		dec.updateVideoParams(streamID, p)
+	case H264NalPPS:
+		pps, err := ParseH264PPS(nalu)
+		if err != nil {
+			log.Printf("parse h264 pps error: %v", err)
+			dec.stats.ErrParamSetCnt++
+			return
+		}
+		if dec.opts.Verbose {
+			log.Printf("\t\t\tpps id: %d sps id: %d cabac: %t", pps.PPSID, pps.SPSID, pps.EntropyCodingModeFlag)
+		}
+	}
+}
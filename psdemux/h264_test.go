@@ -0,0 +1,62 @@
+package psdemux_test
+
+import (
+	"bytes"
+	"testing"
+
+	"mpegps-parser/psdemux"
+	"mpegps-parser/psmux"
+)
+
+// slicedAU returns an access unit of an AUD and two slices of type
+// nalType, the start code of the second one at offset at.
+func slicedAU(nalType byte, at int) []byte {
+	au := []byte{0, 0, 0, 1, 0x09, 0xf0, 0, 0, 0, 1, nalType}
+	au = append(au, bytes.Repeat([]byte{0x88}, at-len(au))...)
+	au = append(au, 0, 0, 0, 1, nalType)
+	return append(au, bytes.Repeat([]byte{0x99}, 200)...)
+}
+
+func TestAccessUnitAcrossPES(t *testing.T) {
+	// the second slice starts with the second PES, or its start code is
+	// split between them
+	for _, at := range []int{1000, 998} {
+		testAccessUnitAcrossPES(t, at)
+	}
+}
+
+func testAccessUnitAcrossPES(t *testing.T, at int) {
+	const split = 1000
+	var ps bytes.Buffer
+	m := psmux.NewMuxer(&ps, &psmux.Options{VideoCodec: psdemux.CodecH264, MaxPESPayload: split})
+	// an IDR and a P picture, each in two PES packets
+	for i, au := range [][]byte{slicedAU(0x65, at), slicedAU(0x41, at)} {
+		pts := uint64(i+1) * 3600
+		if err := m.WriteVideo(au, pts, pts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m.Close()
+	pes := 0
+	dec := psdemux.NewDemuxer(bytes.NewReader(ps.Bytes()), &psdemux.Options{
+		OnPES: func(pkt *psdemux.PESPacket) {
+			if pkt.Type == psdemux.VideoPES {
+				pes++
+			}
+		},
+	})
+	if err := dec.Demux(); err != nil {
+		t.Fatal(err)
+	}
+	if pes != 4 {
+		t.Fatalf("second slice at %d: %d video pes, want 4", at, pes)
+	}
+	stats := dec.Stats()
+	if stats.IFrameCnt != 1 || stats.PFrameCnt != 1 || stats.ErrIFrameCnt != 0 {
+		t.Errorf("second slice at %d: I %d P %d err I %d, want 1 1 0", at, stats.IFrameCnt, stats.PFrameCnt, stats.ErrIFrameCnt)
+	}
+	if n := stats.H264NalCnt; n[psdemux.H264NalIDR] != 2 || n[psdemux.H264NalSlice] != 2 || n[psdemux.H264NalAUD] != 2 {
+		t.Errorf("second slice at %d: IDR %d slice %d AUD %d nal units, want 2 2 2", at,
+			n[psdemux.H264NalIDR], n[psdemux.H264NalSlice], n[psdemux.H264NalAUD])
+	}
+}
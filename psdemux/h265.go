@@ -0,0 +1,196 @@
+package psdemux
+
+import "log"
+
+// H.265 nal_unit_type values (ITU-T H.265 Table 7-1)
+const (
+	H265NalTrailN    = 0
+	H265NalTrailR    = 1
+	H265NalTsaN      = 2
+	H265NalTsaR      = 3
+	H265NalStsaN     = 4
+	H265NalStsaR     = 5
+	H265NalRadlN     = 6
+	H265NalRadlR     = 7
+	H265NalRaslN     = 8
+	H265NalRaslR     = 9
+	H265NalBlaWLp    = 16
+	H265NalBlaWRadl  = 17
+	H265NalBlaNLp    = 18
+	H265NalIdrWRadl  = 19
+	H265NalIdrNLp    = 20
+	H265NalCra       = 21
+	H265NalVps       = 32
+	H265NalSps       = 33
+	H265NalPps       = 34
+	H265NalAud       = 35
+	H265NalEos       = 36
+	H265NalEob       = 37
+	H265NalFd        = 38
+	H265NalPrefixSei = 39
+	H265NalSuffixSei = 40
+)
+
+// H265NalHeader is the two byte nal_unit_header() of an H.265 NAL unit.
+type H265NalHeader struct {
+	Type         uint8
+	LayerID      uint8
+	TemporalID   uint8 // nuh_temporal_id_plus1 - 1
+	ForbiddenBit bool
+}
+
+// ParseH265NalHeader decodes the NAL unit header at the start of nalu. It
+// fails if nalu is too short or nuh_temporal_id_plus1 is 0.
+func ParseH265NalHeader(nalu []byte) (H265NalHeader, bool) {
+	if len(nalu) < 2 || nalu[1]&0x7 == 0 {
+		return H265NalHeader{}, false
+	}
+	return H265NalHeader{
+		ForbiddenBit: nalu[0]&0x80 != 0,
+		Type:         nalu[0] >> 1 & 0x3f,
+		LayerID:      (nalu[0]&0x1)<<5 | nalu[1]>>3,
+		TemporalID:   nalu[1]&0x7 - 1,
+	}, true
+}
+
+// IsSubLayerNonRef reports whether the NAL unit is a slice of a sub-layer
+// non-reference picture (TRAIL_N, TSA_N, ..., RSV_VCL_N14).
+func (h H265NalHeader) IsSubLayerNonRef() bool {
+	return h.Type <= 14 && h.Type%2 == 0
+}
+
+// IsIRAP reports whether the NAL unit is an intra random access point
+// picture (BLA, IDR or CRA).
+func (h H265NalHeader) IsIRAP() bool {
+	return h.Type >= H265NalBlaWLp && h.Type <= 23
+}
+
+// H265NalTypeName returns the name of an H.265 nal_unit_type.
+func H265NalTypeName(t uint8) string {
+	switch t {
+	case H265NalTrailN:
+		return "TRAIL_N"
+	case H265NalTrailR:
+		return "TRAIL_R"
+	case H265NalTsaN:
+		return "TSA_N"
+	case H265NalTsaR:
+		return "TSA_R"
+	case H265NalStsaN:
+		return "STSA_N"
+	case H265NalStsaR:
+		return "STSA_R"
+	case H265NalRadlN:
+		return "RADL_N"
+	case H265NalRadlR:
+		return "RADL_R"
+	case H265NalRaslN:
+		return "RASL_N"
+	case H265NalRaslR:
+		return "RASL_R"
+	case H265NalBlaWLp:
+		return "BLA_W_LP"
+	case H265NalBlaWRadl:
+		return "BLA_W_RADL"
+	case H265NalBlaNLp:
+		return "BLA_N_LP"
+	case H265NalIdrWRadl:
+		return "IDR_W_RADL"
+	case H265NalIdrNLp:
+		return "IDR_N_LP"
+	case H265NalCra:
+		return "CRA_NUT"
+	case H265NalVps:
+		return "VPS"
+	case H265NalSps:
+		return "SPS"
+	case H265NalPps:
+		return "PPS"
+	case H265NalAud:
+		return "AUD"
+	case H265NalEos:
+		return "EOS"
+	case H265NalEob:
+		return "EOB"
+	case H265NalFd:
+		return "FD"
+	case H265NalPrefixSei:
+		return "PREFIX_SEI"
+	case H265NalSuffixSei:
+		return "SUFFIX_SEI"
+	}
+	return "RESERVED"
+}
+
+// decodeH265 counts the NAL units and the picture of an access unit.
+func (dec *Demuxer) decodeH265(streamID uint8, data []byte, err bool) error {
+	if dec.opts.Verbose {
+		log.Printf("\t\th265 len : %d", len(data))
+	}
+	irap, slice, nonRef := false, false, false
+	for _, nalu := range SplitNALUnits(data) {
+		hdr, ok := ParseH265NalHeader(nalu)
+		if !ok {
+			if len(nalu) >= 2 {
+				// nuh_temporal_id_plus1 is 0
+				dec.stats.ErrNalCnt++
+			}
+			continue
+		}
+		dec.stats.H265NalCnt[hdr.Type]++
+		if hdr.ForbiddenBit {
+			dec.stats.ErrNalCnt++
+		}
+		switch {
+		case hdr.IsIRAP():
+			irap = true
+		case hdr.Type < H265NalBlaWLp:
+			slice = true
+			nonRef = nonRef || hdr.IsSubLayerNonRef()
+		}
+		if dec.opts.Verbose {
+			log.Printf("\t\t%s layer: %d tid: %d size: %d", H265NalTypeName(hdr.Type), hdr.LayerID, hdr.TemporalID, len(nalu))
+		}
+		if !err {
+			dec.decodeH265ParamSet(streamID, hdr.Type, nalu)
+		}
+	}
+	// an access unit holds one picture, count it once
+	switch {
+	case irap:
+		if err {
+			dec.stats.ErrIFrameCnt++
+		} else {
+			dec.stats.IFrameCnt++
+		}
+	case slice:
+		dec.stats.PFrameCnt++
+		if nonRef {
+			dec.stats.NonRefFrameCnt++
+		}
+	}
+	return nil
+}
+
+func (dec *Demuxer) decodeH265ParamSet(streamID uint8, nalType uint8, nalu []byte) {
+	switch nalType {
+	case H265NalSps:
+		p, err := ParseH265SPS(nalu)
+		if err != nil {
+			log.Printf("parse h265 sps error: %v", err)
+			dec.stats.ErrParamSetCnt++
+			return
+		}
+		dec.updateVideoParams(streamID, p)
+	case H265NalPps:
+		pps, err := ParseH265PPS(nalu)
+		if err != nil {
+			log.Printf("parse h265 pps error: %v", err)
+			dec.stats.ErrParamSetCnt++
+			return
+		}
+		if dec.opts.Verbose {
+			log.Printf("\t\t\tpps id: %d sps id: %d", pps.PPSID, pps.SPSID)
+		}
+	}
+}
@@ -0,0 +1,314 @@
+package psdemux
+
+import (
+	"log"
+
+	"mpegps-parser/bitreader"
+)
+
+// readProfileTierLevel reads profile_tier_level(1, maxSubLayersMinus1).
+func (p *VideoParams) readProfileTierLevel(br bitreader.BitReader, maxSubLayersMinus1 uint8) error {
+	br.Skip(2) // general_profile_space
+	p.Tier, _ = br.Read8(1)
+	p.ProfileIdc, _ = br.Read8(5)
+	br.Skip(32) // general_profile_compatibility_flag
+	br.Skip(48) // progressive/interlaced/non_packed/frame_only flags, reserved bits
+	var err error
+	if p.LevelIdc, err = br.Read8(8); err != nil {
+		return err
+	}
+	profilePresent := make([]bool, maxSubLayersMinus1)
+	levelPresent := make([]bool, maxSubLayersMinus1)
+	for i := range profilePresent {
+		profilePresent[i], _ = br.Read1()
+		levelPresent[i], _ = br.Read1()
+	}
+	if maxSubLayersMinus1 > 0 {
+		br.Skip(2 * uint(8-maxSubLayersMinus1)) // reserved_zero_2bits
+	}
+	for i := range profilePresent {
+		if profilePresent[i] {
+			br.Skip(88)
+		}
+		if levelPresent[i] {
+			br.Skip(8)
+		}
+	}
+	return nil
+}
+
+// skipH265ScalingListData skips scaling_list_data().
+func skipH265ScalingListData(br bitreader.BitReader) error {
+	for sizeID := 0; sizeID < 4; sizeID++ {
+		step := 1
+		if sizeID == 3 {
+			step = 3
+		}
+		for matrixID := 0; matrixID < 6; matrixID += step {
+			predModeFlag, err := br.Read1()
+			if err != nil {
+				return err
+			}
+			if !predModeFlag {
+				br.ReadUE() // scaling_list_pred_matrix_id_delta
+				continue
+			}
+			coefNum := 1 << (4 + uint(sizeID)<<1)
+			if coefNum > 64 {
+				coefNum = 64
+			}
+			if sizeID > 1 {
+				br.ReadSE() // scaling_list_dc_coef_minus8
+			}
+			for i := 0; i < coefNum; i++ {
+				if _, err := br.ReadSE(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// skipShortTermRefPicSet skips st_ref_pic_set(idx) as found in an SPS and
+// returns NumDeltaPocs[idx]. numDeltaPocs holds the values of the
+// previous sets.
+func skipShortTermRefPicSet(br bitreader.BitReader, idx int, numDeltaPocs []uint32) (uint32, error) {
+	interRefPicSetPrediction := false
+	if idx != 0 {
+		interRefPicSetPrediction, _ = br.Read1()
+	}
+	if interRefPicSetPrediction {
+		br.Skip(1)                             // delta_rps_sign
+		if _, err := br.ReadUE(); err != nil { // abs_delta_rps_minus1
+			return 0, err
+		}
+		// in an SPS delta_idx_minus1 is 0, the reference is the previous set
+		var n uint32
+		for j := uint32(0); j <= numDeltaPocs[idx-1]; j++ {
+			usedByCurrPic, err := br.Read1()
+			if err != nil {
+				return 0, err
+			}
+			useDelta := true
+			if !usedByCurrPic {
+				useDelta, _ = br.Read1()
+			}
+			if usedByCurrPic || useDelta {
+				n++
+			}
+		}
+		return n, nil
+	}
+	numNegative, _ := br.ReadUE()
+	numPositive, err := br.ReadUE()
+	if err != nil {
+		return 0, err
+	}
+	for i := uint32(0); i < numNegative+numPositive; i++ {
+		br.ReadUE()                        // delta_poc_s0/s1_minus1
+		if err := br.Skip(1); err != nil { // used_by_curr_pic_s0/s1_flag
+			return 0, err
+		}
+	}
+	return numNegative + numPositive, nil
+}
+
+// ParseH265SPS decodes an H.265 seq_parameter_set_rbsp(). nalu is the
+// whole NAL unit including its two byte header.
+func ParseH265SPS(nalu []byte) (*VideoParams, error) {
+	if len(nalu) < 16 {
+		return nil, ErrParseSPS
+	}
+	br := bitreader.NewRBSPReader(nalu[2:])
+	p := &VideoParams{Codec: CodecH265}
+	br.Skip(4) // sps_video_parameter_set_id
+	maxSubLayersMinus1, _ := br.Read8(3)
+	br.Skip(1) // sps_temporal_id_nesting_flag
+	if err := p.readProfileTierLevel(br, maxSubLayersMinus1); err != nil {
+		return nil, err
+	}
+	var err error
+	if p.SPSID, err = br.ReadUE(); err != nil {
+		return nil, err
+	}
+	if p.ChromaFormatIdc, err = br.ReadUE(); err != nil {
+		return nil, err
+	}
+	separateColourPlane := false
+	if p.ChromaFormatIdc == 3 {
+		separateColourPlane, _ = br.Read1()
+	}
+	width, _ := br.ReadUE()
+	height, _ := br.ReadUE()
+	p.Width, p.Height = int(width), int(height)
+	conformanceWindow, err := br.Read1()
+	if err != nil {
+		return nil, err
+	}
+	if conformanceWindow {
+		left, _ := br.ReadUE()
+		right, _ := br.ReadUE()
+		top, _ := br.ReadUE()
+		bottom, err := br.ReadUE()
+		if err != nil {
+			return nil, err
+		}
+		subWidthC, subHeightC := 1, 1
+		if !separateColourPlane {
+			subWidthC, subHeightC = chromaSubsampling(p.ChromaFormatIdc)
+		}
+		p.Width -= subWidthC * int(left+right)
+		p.Height -= subHeightC * int(top+bottom)
+	}
+	bitDepthLuma, _ := br.ReadUE()
+	bitDepthChroma, _ := br.ReadUE()
+	p.BitDepthLuma, p.BitDepthChroma = bitDepthLuma+8, bitDepthChroma+8
+	log2MaxPocLsbMinus4, _ := br.ReadUE()
+	subLayerOrderingInfo, err := br.Read1()
+	if err != nil {
+		return nil, err
+	}
+	first := maxSubLayersMinus1
+	if subLayerOrderingInfo {
+		first = 0
+	}
+	for i := first; i <= maxSubLayersMinus1; i++ {
+		// max_dec_pic_buffering, max_num_reorder_pics, max_latency_increase
+		if err := skipUE(br, 3); err != nil {
+			return nil, err
+		}
+	}
+	// coding block and transform sizes, transform hierarchy depths
+	if err := skipUE(br, 6); err != nil {
+		return nil, err
+	}
+	scalingListEnabled, err := br.Read1()
+	if err != nil {
+		return nil, err
+	}
+	if scalingListEnabled {
+		if present, _ := br.Read1(); present {
+			if err := skipH265ScalingListData(br); err != nil {
+				return nil, err
+			}
+		}
+	}
+	br.Skip(2) // amp_enabled_flag, sample_adaptive_offset_enabled_flag
+	pcmEnabled, err := br.Read1()
+	if err != nil {
+		return nil, err
+	}
+	if pcmEnabled {
+		br.Skip(8) // pcm sample bit depths
+		skipUE(br, 2)
+		br.Skip(1) // pcm_loop_filter_disabled_flag
+	}
+	numShortTermRefPicSets, err := br.ReadUE()
+	if err != nil {
+		return nil, err
+	}
+	if numShortTermRefPicSets > 64 {
+		return nil, ErrParseSPS
+	}
+	numDeltaPocs := make([]uint32, numShortTermRefPicSets)
+	for i := range numDeltaPocs {
+		if numDeltaPocs[i], err = skipShortTermRefPicSet(br, i, numDeltaPocs); err != nil {
+			return nil, err
+		}
+	}
+	longTermRefPics, err := br.Read1()
+	if err != nil {
+		return nil, err
+	}
+	if longTermRefPics {
+		n, err := br.ReadUE()
+		if err != nil {
+			return nil, err
+		}
+		for i := uint32(0); i < n; i++ {
+			// lt_ref_pic_poc_lsb_sps, used_by_curr_pic_lt_sps_flag
+			if err := br.Skip(uint(log2MaxPocLsbMinus4) + 4 + 1); err != nil {
+				return nil, err
+			}
+		}
+	}
+	br.Skip(2) // sps_temporal_mvp_enabled_flag, strong_intra_smoothing_enabled_flag
+	vuiPresent, err := br.Read1()
+	if err != nil {
+		return nil, err
+	}
+	if vuiPresent {
+		if err := p.readH265VUI(br); err != nil {
+			log.Printf("parse h265 vui error: %v", err)
+		}
+	}
+	return p, nil
+}
+
+func (p *VideoParams) readH265VUI(br bitreader.BitReader) error {
+	if present, err := br.Read1(); err != nil {
+		return err
+	} else if present {
+		if err := p.readAspectRatio(br); err != nil {
+			return err
+		}
+	}
+	if present, err := br.Read1(); err != nil {
+		return err
+	} else if present {
+		br.Skip(1) // overscan_appropriate_flag
+	}
+	if present, err := br.Read1(); err != nil {
+		return err
+	} else if present {
+		if err := readVideoSignalType(br); err != nil {
+			return err
+		}
+	}
+	if present, err := br.Read1(); err != nil {
+		return err
+	} else if present {
+		if err := skipUE(br, 2); err != nil { // chroma_sample_loc_type
+			return err
+		}
+	}
+	// neutral_chroma_indication_flag, field_seq_flag, frame_field_info_present_flag
+	br.Skip(3)
+	if present, err := br.Read1(); err != nil {
+		return err
+	} else if present {
+		if err := skipUE(br, 4); err != nil { // default display window
+			return err
+		}
+	}
+	if present, err := br.Read1(); err != nil {
+		return err
+	} else if present {
+		return p.readTimingInfo(br)
+	}
+	return nil
+}
+
+// H265PPS holds the leading fields of an H.265 pic_parameter_set_rbsp().
+type H265PPS struct {
+	PPSID uint32
+	SPSID uint32
+}
+
+// ParseH265PPS decodes the start of an H.265 PPS NAL unit.
+func ParseH265PPS(nalu []byte) (*H265PPS, error) {
+	if len(nalu) < 3 {
+		return nil, ErrParseSPS
+	}
+	br := bitreader.NewRBSPReader(nalu[2:])
+	pps := &H265PPS{}
+	var err error
+	if pps.PPSID, err = br.ReadUE(); err != nil {
+		return nil, err
+	}
+	if pps.SPSID, err = br.ReadUE(); err != nil {
+		return nil, err
+	}
+	return pps, nil
+}
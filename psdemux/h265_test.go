@@ -0,0 +1,58 @@
+package psdemux
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestParseH265NalHeader(t *testing.T) {
+	tests := []struct {
+		nalu []byte
+		hdr  H265NalHeader
+		ok   bool
+	}{
+		{[]byte{0x40, 0x01}, H265NalHeader{Type: H265NalVps}, true},
+		{[]byte{0x26, 0x01}, H265NalHeader{Type: H265NalIdrWRadl}, true},
+		{[]byte{0x02, 0x03}, H265NalHeader{Type: H265NalTrailR, TemporalID: 2}, true},
+		{[]byte{0x81, 0x09}, H265NalHeader{Type: H265NalTrailN, LayerID: 33, TemporalID: 0, ForbiddenBit: true}, true},
+		// nuh_temporal_id_plus1 must not be 0
+		{[]byte{0x02, 0x00}, H265NalHeader{}, false},
+		{[]byte{0x02}, H265NalHeader{}, false},
+	}
+	for _, tt := range tests {
+		hdr, ok := ParseH265NalHeader(tt.nalu)
+		if ok != tt.ok || hdr != tt.hdr {
+			t.Errorf("% x: got %+v %t, want %+v %t", tt.nalu, hdr, ok, tt.hdr, tt.ok)
+		}
+	}
+}
+
+func TestH265FrameCounts(t *testing.T) {
+	dec := NewDemuxer(bytes.NewReader(nil), &Options{})
+	sc := []byte{0, 0, 0, 1}
+	au := func(nals ...[]byte) []byte {
+		var b []byte
+		for _, nal := range nals {
+			b = append(append(b, sc...), nal...)
+		}
+		return b
+	}
+	aud := []byte{0x46, 0x01, 0x50}
+	pes := [][]byte{
+		au(aud, []byte{0x26, 0x01, 0xaf}, []byte{0x26, 0x01, 0xbf}), // IDR in two slices
+		au(aud, []byte{0x02, 0x01, 0xd0}),                           // TRAIL_R
+		au(aud, []byte{0x00, 0x01, 0xd0}, []byte{0x00, 0x01, 0xe0}), // TRAIL_N in two slices
+		au(aud, []byte{0x2a, 0x01, 0xaf}),                           // CRA
+		au([]byte{0x12, 0x00, 0x11}),                                // nuh_temporal_id_plus1 0
+	}
+	for _, p := range pes {
+		dec.decodeH265(0xe0, p, false)
+	}
+	stats := dec.Stats()
+	if stats.IFrameCnt != 2 || stats.PFrameCnt != 2 || stats.NonRefFrameCnt != 1 {
+		t.Errorf("I %d P %d non-ref %d, want 2 2 1", stats.IFrameCnt, stats.PFrameCnt, stats.NonRefFrameCnt)
+	}
+	if stats.ErrNalCnt != 1 {
+		t.Errorf("err nal count %d, want 1", stats.ErrNalCnt)
+	}
+}
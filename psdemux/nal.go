@@ -0,0 +1,34 @@
+package psdemux
+
+import "bytes"
+
+var startCodePrefix = []byte{0, 0, 1}
+
+// SplitNALUnits returns the NAL units found in an Annex B byte stream,
+// without their start codes. Both 3 and 4 byte start codes are accepted;
+// bytes before the first start code are ignored.
+func SplitNALUnits(data []byte) [][]byte {
+	var nalus [][]byte
+	i := bytes.Index(data, startCodePrefix)
+	if i < 0 {
+		return nil
+	}
+	data = data[i+3:]
+	for len(data) > 0 {
+		next := bytes.Index(data, startCodePrefix)
+		if next < 0 {
+			nalus = append(nalus, data)
+			break
+		}
+		nalu := data[:next]
+		// the zero byte of a 4 byte start code and trailing_zero_8bits
+		for len(nalu) > 0 && nalu[len(nalu)-1] == 0 {
+			nalu = nalu[:len(nalu)-1]
+		}
+		if len(nalu) > 0 {
+			nalus = append(nalus, nalu)
+		}
+		data = data[next+3:]
+	}
+	return nalus
+}
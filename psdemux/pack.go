@@ -0,0 +1,177 @@
+package psdemux
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+
+	"mpegps-parser/bitreader"
+)
+
+var (
+	ErrPackMarker = errors.New("pack header marker bit error")
+)
+
+// SystemClockFrequency is the frequency of the system clock reference.
+const SystemClockFrequency = 27000000
+
+// PackHeader is a decoded pack_header(). MPEG-1 pack headers carry no SCR
+// extension and no stuffing.
+type PackHeader struct {
+	MPEG1              bool   `json:"mpeg1"`
+	SCRBase            uint64 `json:"system_clock_reference_base"`
+	SCRExtension       uint16 `json:"system_clock_reference_extension"`
+	SCR                uint64 `json:"system_clock_reference"` // 27MHz, SCRBase*300+SCRExtension
+	ProgramMuxRate     uint32 `json:"program_mux_rate"`       // units of 50 bytes/s
+	PackStuffingLength uint8  `json:"pack_stuffing_length"`
+	// MarkerErr is set when a marker bit or the fixed prefix was wrong.
+	MarkerErr bool `json:"marker_error"`
+}
+
+// Seconds returns the SCR in seconds.
+func (h *PackHeader) Seconds() float64 {
+	return float64(h.SCR) / SystemClockFrequency
+}
+
+// readMarkers reads n marker bits and clears *ok if any of them is zero.
+func readMarkers(br bitreader.BitReader, n uint, ok *bool) error {
+	for i := uint(0); i < n; i++ {
+		marker, err := br.Read1()
+		if err != nil {
+			return err
+		}
+		if !marker {
+			*ok = false
+		}
+	}
+	return nil
+}
+
+// readSCRBase reads the three parts of a 33-bit clock base separated by
+// marker bits, as found in both pack header versions.
+func readSCRBase(br bitreader.BitReader, ok *bool) (uint64, error) {
+	var base uint64
+	for i, n := range []uint{3, 15, 15} {
+		v, err := br.Read32(n)
+		if err != nil {
+			return 0, err
+		}
+		base = base<<n | uint64(v)
+		if i < 2 {
+			if err := readMarkers(br, 1, ok); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return base, nil
+}
+
+func (h *PackHeader) readMPEG2(br bitreader.BitReader) error {
+	ok := true
+	fixed, err := br.Read8(2)
+	if err != nil {
+		return err
+	}
+	if fixed != 0x1 {
+		ok = false
+	}
+	if h.SCRBase, err = readSCRBase(br, &ok); err != nil {
+		return err
+	}
+	if err := readMarkers(br, 1, &ok); err != nil {
+		return err
+	}
+	if h.SCRExtension, err = br.Read16(9); err != nil {
+		return err
+	}
+	if err := readMarkers(br, 1, &ok); err != nil {
+		return err
+	}
+	if h.ProgramMuxRate, err = br.Read32(22); err != nil {
+		return err
+	}
+	if err := readMarkers(br, 2, &ok); err != nil {
+		return err
+	}
+	br.Skip(5) // reserved
+	if h.PackStuffingLength, err = br.Read8(3); err != nil {
+		return err
+	}
+	h.SCR = h.SCRBase*300 + uint64(h.SCRExtension)
+	h.MarkerErr = !ok
+	return nil
+}
+
+func (h *PackHeader) readMPEG1(br bitreader.BitReader) error {
+	ok := true
+	h.MPEG1 = true
+	br.Skip(4) // '0010'
+	var err error
+	if h.SCRBase, err = readSCRBase(br, &ok); err != nil {
+		return err
+	}
+	if err := readMarkers(br, 2, &ok); err != nil {
+		return err
+	}
+	if h.ProgramMuxRate, err = br.Read32(22); err != nil {
+		return err
+	}
+	if err := readMarkers(br, 1, &ok); err != nil {
+		return err
+	}
+	h.SCR = h.SCRBase * 300
+	h.MarkerErr = !ok
+	return nil
+}
+
+func (dec *Demuxer) decodePsHeader() error {
+	if dec.opts.Verbose {
+		log.Println("=== pack header ===")
+	}
+	br := dec.br
+	dec.stats.PackCnt++
+	hdr := &dec.packHeader
+	*hdr = PackHeader{}
+	// MPEG-2 pack headers start with '01', MPEG-1 ones with '0010'
+	prefix, err := br.Peek8(4)
+	if err != nil {
+		log.Println("parse pack header error")
+		return err
+	}
+	if prefix == 0x2 {
+		err = hdr.readMPEG1(br)
+	} else {
+		err = hdr.readMPEG2(br)
+	}
+	if err != nil {
+		log.Println("parse pack header error")
+		return err
+	}
+	br.Skip(uint(hdr.PackStuffingLength) * 8)
+	if dec.opts.PrintPackHeader {
+		b, err := json.MarshalIndent(hdr, "", "  ")
+		if err != nil {
+			log.Println("error:", err)
+		}
+		fmt.Print(string(b) + "\n")
+	}
+	if dec.opts.Verbose {
+		log.Printf("\tSCR: %d (%.6fs)", hdr.SCR, hdr.Seconds())
+	}
+	if hdr.MPEG1 {
+		dec.stats.MPEG1PackCnt++
+	}
+	if hdr.MarkerErr {
+		log.Printf("pack header marker error, prefix: 0x%x pos: %d", prefix, dec.getPos())
+		dec.stats.ErrPackHeaderCnt++
+	}
+	if dec.opts.OnPack != nil {
+		pack := *hdr
+		dec.opts.OnPack(&pack)
+	}
+	if hdr.MarkerErr {
+		return ErrPackMarker
+	}
+	return nil
+}
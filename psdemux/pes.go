@@ -0,0 +1,233 @@
+package psdemux
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+)
+
+// errPESHeader is returned by decodePESHeader for a header whose marker or
+// lengths are wrong, the rest of the packet is skipped.
+var errPESHeader = errors.New("pes header error")
+
+func (dec *Demuxer) writeFrame(w io.Writer, frame []byte) error {
+	if _, err := w.Write(frame); err != nil {
+		log.Println(err)
+		return err
+	}
+	return nil
+}
+
+// isStartCodeValid reports whether startCode is one the demuxer can handle:
+// a pack or system header, a program stream map, the end code or any PES.
+func (dec *Demuxer) isStartCodeValid(startCode uint32) bool {
+	_, ok := dec.handlers[int(startCode)]
+	return ok
+}
+
+// 移动到当前位置+payloadLen位置，判断startcode是否正确
+// 如果startcode不正确，说明payloadLen是错误的
+func (dec *Demuxer) isPayloadLenValid(payloadLen uint32, pesType int, pesStartPos int64) bool {
+	pos := dec.getPos() + int64(payloadLen)
+	b, ok := dec.win.peek(pos, 4)
+	if !ok {
+		log.Println("reach file end, quit")
+		return false
+	}
+	packStartCode := binary.BigEndian.Uint32(b)
+	if !dec.isStartCodeValid(packStartCode) {
+		log.Printf("check payload len error, len: %d pes start pos: %d(0x%x), pesType:%d", payloadLen, pesStartPos, pesStartPos, pesType)
+		return false
+	}
+	return true
+}
+
+// getNextPackPos returns the offset of the next start code at or after the
+// current position and whether one was found. The search gives up at the end
+// of the stream or when the window is exhausted, returning the offset of the
+// last byte it looked at.
+func (dec *Demuxer) getNextPackPos() (int64, bool) {
+	pos := dec.getPos()
+	for {
+		b, ok := dec.win.peek(pos, 4)
+		if !ok {
+			if dec.win.err != nil {
+				return dec.win.end(), false
+			}
+			return pos, false
+		}
+		packStartCode := binary.BigEndian.Uint32(b)
+		if dec.isStartCodeValid((packStartCode)) {
+			return pos, true
+		}
+		pos++
+	}
+}
+
+func (dec *Demuxer) skipInvalidBytes(hdr *PESHeader, payloadLen uint32, pesType int, pesStartPos int64) error {
+	switch pesType {
+	case VideoPES:
+		dec.stats.ErrVideoFrameCnt++
+	case AudioPES:
+		dec.stats.ErrAudioFrameCnt++
+	}
+	dec.stream(hdr.StreamID).ErrPktCnt++
+	br := dec.br
+	log.Printf("pes start dump: % X\n", dec.pesStartBytes)
+	// 由于payloadLen是错误的，所以下一个startcode和当前位置之间的字节需要丢弃
+	// 丢弃的数据超过一个窗口时分多次读取, 只保留第一个窗口的数据
+	var skipBuf []byte
+	skipLen := 0
+	for {
+		pos, found := dec.getNextPackPos()
+		n := int(pos - dec.getPos())
+		if n == 0 && !found {
+			break
+		}
+		chunk := make([]byte, n)
+		if _, err := io.ReadAtLeast(br, chunk, n); err != nil {
+			log.Println(err)
+			return err
+		}
+		if skipBuf == nil {
+			skipBuf = chunk
+		}
+		skipLen += n
+		if found {
+			break
+		}
+	}
+	log.Printf("pes payload len err, expect: %d actual: %d", payloadLen, skipLen)
+	log.Printf("skip len: %d, next pack pos:%d", skipLen, dec.getPos())
+	dec.emitPES(hdr, pesType, pesStartPos, skipBuf, true)
+	return nil
+}
+
+func (dec *Demuxer) decodePESHeader(hdr *PESHeader) (uint32, error) {
+	br := dec.br
+	/* payload length */
+	payloadLen, err := br.Read32(16)
+	if err != nil {
+		log.Println(err)
+		return 0, err
+	}
+	hdr.PacketLength = uint16(payloadLen)
+	if !hasPESHeaderFields(hdr.StreamID) {
+		if dec.opts.Verbose {
+			log.Printf("\tPES_packet_length: %d", payloadLen)
+		}
+		return payloadLen, nil
+	}
+
+	// the flags and PES_header_data_length
+	if payloadLen < 3 {
+		log.Printf("PES_packet_length %d too short for the pes header, stream id: 0x%x", payloadLen, hdr.StreamID)
+		dec.stats.ErrPESHeaderCnt++
+		return 0, errPESHeader
+	}
+
+	/* flags: pts_dts_flags ... */
+	if err := hdr.readFlags(br); err != nil {
+		if err != ErrPESMarker {
+			log.Println(err)
+			return 0, err
+		}
+		log.Printf("pes header flags marker error, stream id: 0x%x", hdr.StreamID)
+		dec.stats.ErrPESHeaderCnt++
+		return 0, errPESHeader
+	}
+	payloadLen -= 2
+
+	/* pes header data length */
+	pesHeaderDataLen, err := br.Read32(8)
+	if err != nil {
+		log.Println(err)
+		return 0, err
+	}
+	hdr.HeaderDataLength = uint8(pesHeaderDataLen)
+	payloadLen--
+	if pesHeaderDataLen > payloadLen {
+		log.Printf("PES_packet_length %d too short for pes_header_data_length %d, stream id: 0x%x", payloadLen+3, pesHeaderDataLen, hdr.StreamID)
+		dec.stats.ErrPESHeaderCnt++
+		return 0, errPESHeader
+	}
+
+	/* pes header data */
+	headerData := make([]byte, pesHeaderDataLen)
+	if _, err := io.ReadFull(br, headerData); err != nil {
+		log.Println(err)
+		return 0, err
+	}
+	if err := hdr.readOptionalFields(headerData); err != nil {
+		log.Printf("parse pes header data error: %v, stream id: 0x%x", err, hdr.StreamID)
+		dec.stats.ErrPESHeaderCnt++
+	}
+	if dec.opts.Verbose {
+		log.Printf("\tPES_packet_length: %d", payloadLen)
+		log.Printf("\tpes_header_data_length: %d", pesHeaderDataLen)
+		hdr.show()
+	}
+	payloadLen -= pesHeaderDataLen
+	return payloadLen, nil
+}
+
+func (dec *Demuxer) decodePES(pesType int, streamID uint8) error {
+	br := dec.br
+	pesStartPos := dec.getPos() - 4 // 4为startcode的长度
+	dec.stream(streamID).PktCnt++
+	dec.pesStartBytes = dec.pesStartBytes[:0]
+	if b, ok := dec.win.peek(pesStartPos, 16); ok {
+		dec.pesStartBytes = append(dec.pesStartBytes, b...)
+	}
+	if dec.opts.DumpPesStartBytes {
+		log.Printf("% X\n", dec.pesStartBytes)
+	}
+	hdr := &PESHeader{StreamID: streamID}
+	payloadLen, err := dec.decodePESHeader(hdr)
+	if err == errPESHeader {
+		// the lengths cannot be trusted, drop the packet up to the next
+		// start code
+		return dec.skipInvalidBytes(hdr, payloadLen, pesType, pesStartPos)
+	}
+	if err != nil {
+		return err
+	}
+	if !dec.isPayloadLenValid(payloadLen, pesType, pesStartPos) {
+		return dec.skipInvalidBytes(hdr, payloadLen, pesType, pesStartPos)
+	}
+	payloadData := make([]byte, payloadLen)
+	if _, err := io.ReadAtLeast(br, payloadData, int(payloadLen)); err != nil {
+		return err
+	}
+	dec.emitPES(hdr, pesType, pesStartPos, payloadData, false)
+	return nil
+}
+
+func (dec *Demuxer) emitPES(hdr *PESHeader, pesType int, pesStartPos int64, payload []byte, corrupt bool) {
+	switch pesType {
+	case VideoPES:
+		dec.decodeVideo(hdr, payload, corrupt)
+	case AudioPES:
+		dec.decodeAudio(hdr, payload, corrupt)
+	default:
+		if dec.opts.Verbose {
+			log.Printf("\t\tpayload len : %d", len(payload))
+		}
+	}
+	if !corrupt {
+		dec.stream(hdr.StreamID).Bytes += int64(len(payload))
+		if w := dec.streamWriter(hdr.StreamID); w != nil {
+			dec.writeFrame(w, payload)
+		}
+	}
+	if dec.opts.OnPES != nil {
+		dec.opts.OnPES(&PESPacket{
+			Type:     pesType,
+			Header:   *hdr,
+			StartPos: pesStartPos,
+			Payload:  payload,
+			Corrupt:  corrupt,
+		})
+	}
+}
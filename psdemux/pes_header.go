@@ -0,0 +1,345 @@
+package psdemux
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+
+	"mpegps-parser/bitreader"
+)
+
+var (
+	ErrPESMarker = errors.New("pes header marker bit error")
+)
+
+const (
+	PtsDtsNone    = 0x0
+	PtsDtsPtsOnly = 0x2
+	PtsDtsBoth    = 0x3
+)
+
+// PESHeader holds the fixed part of a PES packet header and the optional
+// fields selected by its flags.
+type PESHeader struct {
+	StreamID               uint8
+	PacketLength           uint16
+	ScramblingControl      uint8
+	Priority               bool
+	DataAlignment          bool
+	Copyright              bool
+	OriginalOrCopy         bool
+	PtsDtsFlags            uint8
+	ESCRFlag               bool
+	ESRateFlag             bool
+	DSMTrickModeFlag       bool
+	AdditionalCopyInfoFlag bool
+	CRCFlag                bool
+	ExtensionFlag          bool
+	HeaderDataLength       uint8
+
+	PTS                uint64 // 90kHz, valid if PtsDtsFlags&0x2 != 0
+	DTS                uint64 // 90kHz, valid if PtsDtsFlags == PtsDtsBoth
+	ESCRBase           uint64
+	ESCRExtension      uint16
+	ESRate             uint32
+	TrickMode          TrickMode
+	AdditionalCopyInfo uint8
+	PreviousPESCRC     uint16
+	Extension          PESExtension
+}
+
+// TrickMode holds the DSM_trick_mode byte. Only the fields that belong to
+// Control are meaningful.
+type TrickMode struct {
+	Control             uint8
+	FieldID             uint8
+	IntraSliceRefresh   bool
+	FrequencyTruncation uint8
+	RepCntrl            uint8
+}
+
+// PESExtension holds the fields following PES_extension_flag.
+type PESExtension struct {
+	PrivateDataFlag      bool
+	PackHeaderFieldFlag  bool
+	SequenceCounterFlag  bool
+	PSTDBufferFlag       bool
+	Extension2Flag       bool
+	PrivateData          []byte
+	PackHeader           []byte
+	SequenceCounter      uint8
+	MPEG1MPEG2Identifier bool
+	OriginalStuffLength  uint8
+	PSTDBufferScale      bool
+	PSTDBufferSize       uint16
+	Extension2           []byte
+}
+
+// HasPTS reports whether the header carries a PTS.
+func (h *PESHeader) HasPTS() bool {
+	return h.PtsDtsFlags&PtsDtsPtsOnly != 0
+}
+
+// HasDTS reports whether the header carries a DTS.
+func (h *PESHeader) HasDTS() bool {
+	return h.PtsDtsFlags == PtsDtsBoth
+}
+
+// readFlags reads the two flag bytes that follow PES_packet_length. Both
+// are read even if the '10' marker is wrong.
+func (h *PESHeader) readFlags(br bitreader.BitReader) error {
+	marker, err := br.Read8(2)
+	if err != nil {
+		return err
+	}
+	h.ScramblingControl, _ = br.Read8(2)
+	h.Priority, _ = br.Read1()
+	h.DataAlignment, _ = br.Read1()
+	h.Copyright, _ = br.Read1()
+	h.OriginalOrCopy, _ = br.Read1()
+	h.PtsDtsFlags, _ = br.Read8(2)
+	h.ESCRFlag, _ = br.Read1()
+	h.ESRateFlag, _ = br.Read1()
+	h.DSMTrickModeFlag, _ = br.Read1()
+	h.AdditionalCopyInfoFlag, _ = br.Read1()
+	h.CRCFlag, _ = br.Read1()
+	if h.ExtensionFlag, err = br.Read1(); err != nil {
+		return err
+	}
+	if marker != 0x2 {
+		return ErrPESMarker
+	}
+	return nil
+}
+
+// readOptionalFields decodes the PES_header_data bytes according to the
+// flags. Stuffing bytes at the end are ignored.
+func (h *PESHeader) readOptionalFields(data []byte) error {
+	br := bitreader.NewReader(bytes.NewReader(data))
+	var err error
+	if h.PtsDtsFlags&PtsDtsPtsOnly != 0 {
+		if h.PTS, err = readTimestamp(br, h.PtsDtsFlags); err != nil {
+			return err
+		}
+		if h.PtsDtsFlags == PtsDtsBoth {
+			if h.DTS, err = readTimestamp(br, 0x1); err != nil {
+				return err
+			}
+		}
+	}
+	if h.ESCRFlag {
+		if err := h.readESCR(br); err != nil {
+			return err
+		}
+	}
+	if h.ESRateFlag {
+		if err := readMarker(br); err != nil {
+			return err
+		}
+		h.ESRate, _ = br.Read32(22)
+		if err := readMarker(br); err != nil {
+			return err
+		}
+	}
+	if h.DSMTrickModeFlag {
+		if err := h.TrickMode.read(br); err != nil {
+			return err
+		}
+	}
+	if h.AdditionalCopyInfoFlag {
+		if err := readMarker(br); err != nil {
+			return err
+		}
+		if h.AdditionalCopyInfo, err = br.Read8(7); err != nil {
+			return err
+		}
+	}
+	if h.CRCFlag {
+		if h.PreviousPESCRC, err = br.Read16(16); err != nil {
+			return err
+		}
+	}
+	if h.ExtensionFlag {
+		if err := h.Extension.read(br); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readTimestamp reads a 33-bit PTS or DTS preceded by the 4-bit prefix.
+func readTimestamp(br bitreader.BitReader, prefix uint8) (uint64, error) {
+	p, err := br.Read8(4)
+	if err != nil {
+		return 0, err
+	}
+	if p != prefix {
+		return 0, ErrPESMarker
+	}
+	var ts uint64
+	for _, n := range []uint{3, 15, 15} {
+		v, err := br.Read32(n)
+		if err != nil {
+			return 0, err
+		}
+		ts = ts<<n | uint64(v)
+		if err := readMarker(br); err != nil {
+			return 0, err
+		}
+	}
+	return ts, nil
+}
+
+func (h *PESHeader) readESCR(br bitreader.BitReader) error {
+	br.Skip(2) // reserved
+	var base uint64
+	for _, n := range []uint{3, 15, 15} {
+		v, err := br.Read32(n)
+		if err != nil {
+			return err
+		}
+		base = base<<n | uint64(v)
+		if err := readMarker(br); err != nil {
+			return err
+		}
+	}
+	h.ESCRBase = base
+	ext, err := br.Read16(9)
+	if err != nil {
+		return err
+	}
+	h.ESCRExtension = ext
+	return readMarker(br)
+}
+
+func (t *TrickMode) read(br bitreader.BitReader) error {
+	var err error
+	if t.Control, err = br.Read8(3); err != nil {
+		return err
+	}
+	switch t.Control {
+	case 0x0, 0x3: // fast forward, fast reverse
+		t.FieldID, _ = br.Read8(2)
+		t.IntraSliceRefresh, _ = br.Read1()
+		t.FrequencyTruncation, err = br.Read8(2)
+	case 0x1, 0x4: // slow motion, slow reverse
+		t.RepCntrl, err = br.Read8(5)
+	case 0x2: // freeze frame
+		t.FieldID, _ = br.Read8(2)
+		err = br.Skip(3)
+	default:
+		err = br.Skip(5)
+	}
+	return err
+}
+
+func (e *PESExtension) read(br bitreader.BitReader) error {
+	e.PrivateDataFlag, _ = br.Read1()
+	e.PackHeaderFieldFlag, _ = br.Read1()
+	e.SequenceCounterFlag, _ = br.Read1()
+	e.PSTDBufferFlag, _ = br.Read1()
+	br.Skip(3) // reserved
+	var err error
+	if e.Extension2Flag, err = br.Read1(); err != nil {
+		return err
+	}
+	if e.PrivateDataFlag {
+		e.PrivateData = make([]byte, 16)
+		if _, err := io.ReadFull(br, e.PrivateData); err != nil {
+			return err
+		}
+	}
+	if e.PackHeaderFieldFlag {
+		packFieldLength, err := br.Read8(8)
+		if err != nil {
+			return err
+		}
+		e.PackHeader = make([]byte, packFieldLength)
+		if _, err := io.ReadFull(br, e.PackHeader); err != nil {
+			return err
+		}
+	}
+	if e.SequenceCounterFlag {
+		if err := readMarker(br); err != nil {
+			return err
+		}
+		e.SequenceCounter, _ = br.Read8(7)
+		if err := readMarker(br); err != nil {
+			return err
+		}
+		e.MPEG1MPEG2Identifier, _ = br.Read1()
+		if e.OriginalStuffLength, err = br.Read8(6); err != nil {
+			return err
+		}
+	}
+	if e.PSTDBufferFlag {
+		if v, _ := br.Read8(2); v != 0x1 {
+			return ErrPESMarker
+		}
+		e.PSTDBufferScale, _ = br.Read1()
+		if e.PSTDBufferSize, err = br.Read16(13); err != nil {
+			return err
+		}
+	}
+	if e.Extension2Flag {
+		if err := readMarker(br); err != nil {
+			return err
+		}
+		fieldLength, err := br.Read8(7)
+		if err != nil {
+			return err
+		}
+		e.Extension2 = make([]byte, fieldLength)
+		if _, err := io.ReadFull(br, e.Extension2); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readMarker(br bitreader.BitReader) error {
+	marker, err := br.Read1()
+	if err != nil {
+		return err
+	}
+	if !marker {
+		return ErrPESMarker
+	}
+	return nil
+}
+
+// formatTimestamp formats a 90kHz timestamp with its value in seconds.
+func formatTimestamp(ts uint64) string {
+	return fmt.Sprintf("%d (%.3fs)", ts, float64(ts)/90000)
+}
+
+func (h *PESHeader) show() {
+	log.Printf("\tstream_id: 0x%x", h.StreamID)
+	log.Printf("\tPTS_DTS_flags: %d", h.PtsDtsFlags)
+	if h.HasPTS() {
+		log.Printf("\tPTS: %s", formatTimestamp(h.PTS))
+	}
+	if h.HasDTS() {
+		log.Printf("\tDTS: %s", formatTimestamp(h.DTS))
+	}
+	if h.ESCRFlag {
+		log.Printf("\tESCR: %d", h.ESCRBase*300+uint64(h.ESCRExtension))
+	}
+	if h.ESRateFlag {
+		log.Printf("\tES_rate: %d", h.ESRate)
+	}
+	if h.DSMTrickModeFlag {
+		log.Printf("\ttrick_mode_control: %d", h.TrickMode.Control)
+	}
+	if h.AdditionalCopyInfoFlag {
+		log.Printf("\tadditional_copy_info: 0x%x", h.AdditionalCopyInfo)
+	}
+	if h.CRCFlag {
+		log.Printf("\tprevious_PES_packet_CRC: 0x%x", h.PreviousPESCRC)
+	}
+	if h.ExtensionFlag && h.Extension.PSTDBufferFlag {
+		log.Printf("\tP-STD_buffer_size: %d", h.Extension.PSTDBufferSize)
+	}
+}
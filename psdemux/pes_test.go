@@ -0,0 +1,55 @@
+package psdemux
+
+import (
+	"bytes"
+	"testing"
+)
+
+// audioPES builds a PES packet of stream 0xC0 with the given
+// PES_packet_length, flag bytes and PES_header_data_length.
+func audioPES(length uint16, flags uint16, headerDataLen uint8, rest []byte) []byte {
+	b := []byte{0, 0, 1, 0xc0, uint8(length >> 8), uint8(length), uint8(flags >> 8), uint8(flags), headerDataLen}
+	return append(b, rest...)
+}
+
+func TestPESHeaderErrors(t *testing.T) {
+	payload := []byte{1, 2, 3, 4, 5}
+	good := audioPES(uint16(3+len(payload)), 0x8000, 0, payload)
+	tests := []struct {
+		name string
+		pes  []byte
+	}{
+		// '01' instead of '10'; read from the middle of the flags the
+		// header data length would be 0x80
+		{"marker", audioPES(8, 0x4080, 0x05, payload)},
+		// shorter than the flags and PES_header_data_length, 2-3 used to
+		// wrap around
+		{"length 2", []byte{0, 0, 1, 0xc0, 0, 2, 0x80, 0}},
+		{"length 0", []byte{0, 0, 1, 0xc0, 0, 0, 0x80, 0, 0}},
+		// PES_header_data_length runs past the packet
+		{"header data length", audioPES(5, 0x8000, 5, payload)},
+	}
+	for _, tt := range tests {
+		var ps []byte
+		ps = append(ps, tt.pes...)
+		ps = append(ps, good...)
+		ps = append(ps, 0, 0, 1, 0xb9)
+		var pkts []*PESPacket
+		dec := NewDemuxer(bytes.NewReader(ps), &Options{
+			OnPES: func(pkt *PESPacket) { pkts = append(pkts, pkt) },
+		})
+		if err := dec.Demux(); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if n := dec.Stats().ErrPESHeaderCnt; n != 1 {
+			t.Errorf("%s: %d pes header errors, want 1", tt.name, n)
+		}
+		if len(pkts) != 2 || !pkts[0].Corrupt || pkts[1].Corrupt || !bytes.Equal(pkts[1].Payload, payload) {
+			t.Errorf("%s: got %d packets, want the bad one corrupt and then % x", tt.name, len(pkts), payload)
+			for _, p := range pkts {
+				t.Logf("corrupt %t payload % x", p.Corrupt, p.Payload)
+			}
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package psdemux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+
+	"mpegps-parser/bitreader"
+	"mpegps-parser/mpegcrc"
+)
+
+var (
+	ErrPsmCRC = errors.New("program stream map crc error")
+)
+
+// ProgramStreamMap is a decoded program_stream_map().
+type ProgramStreamMap struct {
+	CurrentNextIndicator      bool
+	SingleExtensionStreamFlag bool
+	Version                   uint8
+	Descriptors               []Descriptor
+	Streams                   []ElementaryStream
+	CRC                       uint32
+}
+
+// ElementaryStream is one entry of the elementary stream map.
+type ElementaryStream struct {
+	StreamType  uint8
+	StreamID    uint8
+	Descriptors []Descriptor
+}
+
+// StreamType returns the stream_type the map assigns to streamID, and
+// whether the map lists it at all.
+func (m *ProgramStreamMap) StreamType(streamID uint8) (uint8, bool) {
+	for _, es := range m.Streams {
+		if es.StreamID == streamID {
+			return es.StreamType, true
+		}
+	}
+	return 0, false
+}
+
+func (dec *Demuxer) decodePsmNLoop(br bitreader.BitReader, psm *ProgramStreamMap, programStreamMapLen uint32) error {
+	for programStreamMapLen > 0 {
+		var es ElementaryStream
+		streamType, err := br.Read32(8)
+		if err != nil {
+			return err
+		}
+		elementaryStreamID, err := br.Read32(8)
+		if err != nil {
+			return err
+		}
+		es.StreamType = uint8(streamType)
+		es.StreamID = uint8(elementaryStreamID)
+		elementaryStreamInfoLength, err := br.Read32(16)
+		if err != nil {
+			return err
+		}
+		if programStreamMapLen < 4+elementaryStreamInfoLength {
+			return ErrFormatPack
+		}
+		if es.Descriptors, err = readDescriptors(br, int(elementaryStreamInfoLength)); err != nil {
+			return err
+		}
+		if dec.opts.PrintPsm {
+			log.Printf("\t\tstream type: 0x%x", streamType)
+			log.Printf("\t\tstream id: 0x%x", elementaryStreamID)
+			log.Printf("\t\telementary_stream_info_length: %d", elementaryStreamInfoLength)
+			showDescriptors("\t\t\t", es.Descriptors)
+		}
+		psm.Streams = append(psm.Streams, es)
+		programStreamMapLen -= (4 + elementaryStreamInfoLength)
+	}
+	return nil
+}
+
+func (dec *Demuxer) decodeProgramStreamMap() error {
+	dec.stats.PsmCnt++
+	psmLen, err := dec.br.Read32(16)
+	if err != nil {
+		return err
+	}
+	if dec.opts.PrintPsm {
+		log.Println("=== program stream map ===")
+		log.Printf("\tprogram_stream_map_length: %d pos: %d", psmLen, dec.getPos())
+	}
+	// the crc covers the whole packet, starting from packet_start_code_prefix
+	section := make([]byte, 6+psmLen)
+	binary.BigEndian.PutUint32(section, StartCodeMAP)
+	binary.BigEndian.PutUint16(section[4:], uint16(psmLen))
+	if _, err := io.ReadFull(dec.br, section[6:]); err != nil {
+		return err
+	}
+	if psmLen < 10 {
+		return ErrFormatPack
+	}
+
+	br := bitreader.NewReader(bytes.NewReader(section[6:]))
+	psm := &ProgramStreamMap{}
+	psm.CurrentNextIndicator, _ = br.Read1()
+	psm.SingleExtensionStreamFlag, _ = br.Read1()
+	br.Skip(1) // reserved
+	psm.Version, _ = br.Read8(5)
+	br.Skip(8) // reserved, marker_bit
+	psmLen -= 2
+	programStreamInfoLen, err := br.Read32(16)
+	if err != nil {
+		return err
+	}
+	if psmLen < programStreamInfoLen+2 {
+		return ErrFormatPack
+	}
+	if psm.Descriptors, err = readDescriptors(br, int(programStreamInfoLen)); err != nil {
+		return err
+	}
+	psmLen -= (programStreamInfoLen + 2)
+	programStreamMapLen, err := br.Read32(16)
+	if err != nil {
+		return err
+	}
+	if psmLen < programStreamMapLen+2 {
+		return ErrFormatPack
+	}
+	psmLen -= (2 + programStreamMapLen)
+	if dec.opts.PrintPsm {
+		log.Printf("\tcurrent_next_indicator: %t", psm.CurrentNextIndicator)
+		log.Printf("\tprogram_stream_map_version: %d", psm.Version)
+		log.Printf("\tprogram_stream_info_length: %d", programStreamInfoLen)
+		showDescriptors("\t\t", psm.Descriptors)
+		log.Printf("\telementary_stream_map_length: %d", programStreamMapLen)
+	}
+
+	if err := dec.decodePsmNLoop(br, psm, programStreamMapLen); err != nil {
+		return err
+	}
+
+	// crc 32
+	if psmLen != 4 {
+		if dec.opts.PrintPsm {
+			log.Printf("psmLen: 0x%x", psmLen)
+		}
+		return ErrFormatPack
+	}
+	psm.CRC, _ = br.Read32(32)
+	if mpegcrc.Checksum(section) != 0 {
+		// a damaged map must not change the codecs, keep the last one
+		dec.stats.ErrPsmCRCCnt++
+		log.Printf("program stream map crc error, CRC_32: 0x%08x expect: 0x%08x",
+			psm.CRC, mpegcrc.Checksum(section[:len(section)-4]))
+		return ErrPsmCRC
+	}
+	if dec.opts.PrintPsm {
+		log.Printf("\tCRC_32: 0x%08x ok", psm.CRC)
+	}
+	dec.setPSM(psm)
+	if dec.opts.OnPSM != nil {
+		dec.opts.OnPSM(psm)
+	}
+	return nil
+}
+
+// setPSM makes psm the current program stream map.
+func (dec *Demuxer) setPSM(psm *ProgramStreamMap) {
+	dec.psm = psm
+	for _, es := range psm.Streams {
+		switch {
+		case es.StreamID >= 0xe0 && es.StreamID <= 0xef:
+			dec.streamInfo.VideoStreamType = uint32(es.StreamType)
+		case es.StreamID >= 0xc0 && es.StreamID <= 0xdf:
+			dec.streamInfo.AudioStreamType = uint32(es.StreamType)
+		}
+	}
+}
+
+// ProgramStreamMap returns the last program stream map seen with a valid
+// CRC, or nil.
+func (dec *Demuxer) ProgramStreamMap() *ProgramStreamMap {
+	return dec.psm
+}
@@ -0,0 +1,54 @@
+package psdemux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"mpegps-parser/mpegcrc"
+)
+
+// psmPacket builds a program_stream_map() listing a video stream 0xE0 and
+// an audio stream 0xC0, with a wrong CRC_32 if badCRC is set.
+func psmPacket(video, audio uint8, badCRC bool) []byte {
+	esMap := []byte{video, 0xe0, 0, 0, audio, 0xc0, 0, 0}
+	b := []byte{0, 0, 1, 0xbc, 0, 0, 0x80, 0x01, 0, 0}
+	b = append(b, uint8(len(esMap)>>8), uint8(len(esMap)))
+	b = append(b, esMap...)
+	binary.BigEndian.PutUint16(b[4:], uint16(len(b)-6+4))
+	crc := mpegcrc.Checksum(b)
+	if badCRC {
+		crc ^= 1
+	}
+	return append(b, uint8(crc>>24), uint8(crc>>16), uint8(crc>>8), uint8(crc))
+}
+
+func TestPSMCRCError(t *testing.T) {
+	var ps []byte
+	ps = append(ps, psmPacket(StreamTypeH264, StreamTypeG711A, false)...)
+	ps = append(ps, psmPacket(StreamTypeH265, StreamTypeAAC, true)...)
+	ps = append(ps, 0, 0, 1, 0xb9)
+
+	var maps []*ProgramStreamMap
+	dec := NewDemuxer(bytes.NewReader(ps), &Options{
+		OnPSM: func(psm *ProgramStreamMap) { maps = append(maps, psm) },
+	})
+	if err := dec.Demux(); err != nil {
+		t.Fatal(err)
+	}
+	if len(maps) != 1 {
+		t.Fatalf("OnPSM called %d times, want 1", len(maps))
+	}
+	if stats := dec.Stats(); stats.PsmCnt != 2 || stats.ErrPsmCRCCnt != 1 {
+		t.Errorf("%d maps, %d crc errors, want 2 and 1", stats.PsmCnt, stats.ErrPsmCRCCnt)
+	}
+	if dec.ProgramStreamMap() != maps[0] {
+		t.Error("the map with the bad crc replaced the valid one")
+	}
+	if info := dec.StreamInfo(); info.VideoStreamType != StreamTypeH264 || info.AudioStreamType != StreamTypeG711A {
+		t.Errorf("stream types 0x%x/0x%x, want 0x%x/0x%x", info.VideoStreamType, info.AudioStreamType, StreamTypeH264, StreamTypeG711A)
+	}
+	if codec := dec.VideoCodec(); codec != CodecH264 {
+		t.Errorf("video codec %s, want h264", codec)
+	}
+}
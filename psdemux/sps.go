@@ -0,0 +1,380 @@
+package psdemux
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"mpegps-parser/bitreader"
+)
+
+var (
+	ErrParseSPS = errors.New("parse sps error")
+)
+
+// VideoParams holds the stream parameters decoded from an H.264 or H.265
+// sequence parameter set.
+type VideoParams struct {
+	Codec           Codec
+	ProfileIdc      uint8
+	Tier            uint8 // H.265 general_tier_flag
+	LevelIdc        uint8
+	SPSID           uint32
+	ChromaFormatIdc uint32
+	BitDepthLuma    uint32
+	BitDepthChroma  uint32
+	Width           int // after cropping
+	Height          int
+	SarWidth        uint16
+	SarHeight       uint16
+	// timing info from the VUI, zero if not present
+	NumUnitsInTick uint32
+	TimeScale      uint32
+	FixedFrameRate bool
+}
+
+// FrameRate returns the frame rate signalled in the VUI, or 0.
+func (p *VideoParams) FrameRate() float64 {
+	if p.NumUnitsInTick == 0 || p.TimeScale == 0 {
+		return 0
+	}
+	if p.Codec == CodecH264 {
+		// H.264 time_scale counts fields
+		return float64(p.TimeScale) / float64(2*p.NumUnitsInTick)
+	}
+	return float64(p.TimeScale) / float64(p.NumUnitsInTick)
+}
+
+// ChromaFormat returns a name for ChromaFormatIdc.
+func (p *VideoParams) ChromaFormat() string {
+	switch p.ChromaFormatIdc {
+	case 0:
+		return "4:0:0"
+	case 1:
+		return "4:2:0"
+	case 2:
+		return "4:2:2"
+	case 3:
+		return "4:4:4"
+	}
+	return "unknown"
+}
+
+func (p *VideoParams) String() string {
+	s := fmt.Sprintf("%s profile: %d level: %d %dx%d chroma: %s bit depth: %d/%d",
+		p.Codec, p.ProfileIdc, p.LevelIdc, p.Width, p.Height, p.ChromaFormat(), p.BitDepthLuma, p.BitDepthChroma)
+	if p.SarWidth != 0 && p.SarHeight != 0 {
+		s += fmt.Sprintf(" sar: %d:%d", p.SarWidth, p.SarHeight)
+	}
+	if fps := p.FrameRate(); fps != 0 {
+		s += fmt.Sprintf(" fps: %.3f", fps)
+	}
+	return s
+}
+
+// sarTable holds the sample aspect ratios of aspect_ratio_idc 1..16.
+var sarTable = [...][2]uint16{
+	{1, 1}, {12, 11}, {10, 11}, {16, 11}, {40, 33}, {24, 11}, {20, 11}, {32, 11},
+	{80, 33}, {18, 11}, {15, 11}, {64, 33}, {160, 99}, {4, 3}, {3, 2}, {2, 1},
+}
+
+const aspectRatioExtendedSAR = 255
+
+// readAspectRatio reads aspect_ratio_info, shared by the H.264 and H.265 VUI.
+func (p *VideoParams) readAspectRatio(br bitreader.BitReader) error {
+	idc, err := br.Read8(8)
+	if err != nil {
+		return err
+	}
+	if idc == aspectRatioExtendedSAR {
+		p.SarWidth, _ = br.Read16(16)
+		p.SarHeight, err = br.Read16(16)
+		return err
+	}
+	if idc >= 1 && int(idc) <= len(sarTable) {
+		p.SarWidth, p.SarHeight = sarTable[idc-1][0], sarTable[idc-1][1]
+	}
+	return nil
+}
+
+// readTimingInfo reads num_units_in_tick, time_scale and, for H.264,
+// fixed_frame_rate_flag.
+func (p *VideoParams) readTimingInfo(br bitreader.BitReader) error {
+	var err error
+	p.NumUnitsInTick, _ = br.Read32(32)
+	if p.TimeScale, err = br.Read32(32); err != nil {
+		return err
+	}
+	if p.Codec == CodecH264 {
+		p.FixedFrameRate, err = br.Read1()
+	}
+	return err
+}
+
+// readVideoSignalType skips video_signal_type, shared by both codecs.
+func readVideoSignalType(br bitreader.BitReader) error {
+	br.Skip(4) // video_format, video_full_range_flag
+	colourDescription, err := br.Read1()
+	if err != nil {
+		return err
+	}
+	if colourDescription {
+		return br.Skip(24)
+	}
+	return nil
+}
+
+// skipUE skips n ue(v) values.
+func skipUE(br bitreader.BitReader, n int) error {
+	for i := 0; i < n; i++ {
+		if _, err := br.ReadUE(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// skipScalingList skips an H.264 scaling_list() of the given size.
+func skipScalingList(br bitreader.BitReader, size int) error {
+	lastScale, nextScale := int32(8), int32(8)
+	for j := 0; j < size; j++ {
+		if nextScale != 0 {
+			delta, err := br.ReadSE()
+			if err != nil {
+				return err
+			}
+			nextScale = (lastScale + delta + 256) % 256
+		}
+		if nextScale != 0 {
+			lastScale = nextScale
+		}
+	}
+	return nil
+}
+
+func isH264HighProfile(profileIdc uint8) bool {
+	switch profileIdc {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		return true
+	}
+	return false
+}
+
+// ParseH264SPS decodes an H.264 seq_parameter_set_rbsp(). nalu is the
+// whole NAL unit including its header byte.
+func ParseH264SPS(nalu []byte) (*VideoParams, error) {
+	if len(nalu) < 4 {
+		return nil, ErrParseSPS
+	}
+	br := bitreader.NewRBSPReader(nalu[1:])
+	p := &VideoParams{Codec: CodecH264, ChromaFormatIdc: 1, BitDepthLuma: 8, BitDepthChroma: 8}
+	p.ProfileIdc, _ = br.Read8(8)
+	br.Skip(8) // constraint_set flags, reserved_zero_2bits
+	p.LevelIdc, _ = br.Read8(8)
+	var err error
+	if p.SPSID, err = br.ReadUE(); err != nil {
+		return nil, err
+	}
+	separateColourPlane := false
+	if isH264HighProfile(p.ProfileIdc) {
+		if p.ChromaFormatIdc, err = br.ReadUE(); err != nil {
+			return nil, err
+		}
+		if p.ChromaFormatIdc == 3 {
+			separateColourPlane, _ = br.Read1()
+		}
+		bitDepthLuma, _ := br.ReadUE()
+		bitDepthChroma, _ := br.ReadUE()
+		p.BitDepthLuma, p.BitDepthChroma = bitDepthLuma+8, bitDepthChroma+8
+		br.Skip(1) // qpprime_y_zero_transform_bypass_flag
+		scalingMatrixPresent, err := br.Read1()
+		if err != nil {
+			return nil, err
+		}
+		if scalingMatrixPresent {
+			n := 8
+			if p.ChromaFormatIdc == 3 {
+				n = 12
+			}
+			for i := 0; i < n; i++ {
+				present, err := br.Read1()
+				if err != nil {
+					return nil, err
+				}
+				if !present {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				if err := skipScalingList(br, size); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	br.ReadUE() // log2_max_frame_num_minus4
+	picOrderCntType, err := br.ReadUE()
+	if err != nil {
+		return nil, err
+	}
+	switch picOrderCntType {
+	case 0:
+		br.ReadUE() // log2_max_pic_order_cnt_lsb_minus4
+	case 1:
+		br.Skip(1)  // delta_pic_order_always_zero_flag
+		br.ReadSE() // offset_for_non_ref_pic
+		br.ReadSE() // offset_for_top_to_bottom_field
+		n, err := br.ReadUE()
+		if err != nil {
+			return nil, err
+		}
+		for i := uint32(0); i < n; i++ {
+			if _, err := br.ReadSE(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	br.ReadUE() // max_num_ref_frames
+	br.Skip(1)  // gaps_in_frame_num_value_allowed_flag
+	widthInMbsMinus1, _ := br.ReadUE()
+	heightInMapUnitsMinus1, _ := br.ReadUE()
+	frameMbsOnly, err := br.Read1()
+	if err != nil {
+		return nil, err
+	}
+	if !frameMbsOnly {
+		br.Skip(1) // mb_adaptive_frame_field_flag
+	}
+	br.Skip(1) // direct_8x8_inference_flag
+	frameMbsFactor := 2
+	if frameMbsOnly {
+		frameMbsFactor = 1
+	}
+	p.Width = int(widthInMbsMinus1+1) * 16
+	p.Height = frameMbsFactor * int(heightInMapUnitsMinus1+1) * 16
+	cropping, err := br.Read1()
+	if err != nil {
+		return nil, err
+	}
+	if cropping {
+		left, _ := br.ReadUE()
+		right, _ := br.ReadUE()
+		top, _ := br.ReadUE()
+		bottom, err := br.ReadUE()
+		if err != nil {
+			return nil, err
+		}
+		cropUnitX, cropUnitY := 1, frameMbsFactor
+		if p.ChromaFormatIdc != 0 && !separateColourPlane {
+			subWidthC, subHeightC := chromaSubsampling(p.ChromaFormatIdc)
+			cropUnitX, cropUnitY = subWidthC, subHeightC*frameMbsFactor
+		}
+		p.Width -= cropUnitX * int(left+right)
+		p.Height -= cropUnitY * int(top+bottom)
+	}
+	vuiPresent, err := br.Read1()
+	if err != nil {
+		return nil, err
+	}
+	if vuiPresent {
+		if err := p.readH264VUI(br); err != nil {
+			// a truncated VUI still leaves the picture size usable
+			log.Printf("parse h264 vui error: %v", err)
+		}
+	}
+	return p, nil
+}
+
+// chromaSubsampling returns SubWidthC and SubHeightC.
+func chromaSubsampling(chromaFormatIdc uint32) (int, int) {
+	switch chromaFormatIdc {
+	case 1:
+		return 2, 2
+	case 2:
+		return 2, 1
+	}
+	return 1, 1
+}
+
+func (p *VideoParams) readH264VUI(br bitreader.BitReader) error {
+	if present, err := br.Read1(); err != nil {
+		return err
+	} else if present {
+		if err := p.readAspectRatio(br); err != nil {
+			return err
+		}
+	}
+	if present, err := br.Read1(); err != nil {
+		return err
+	} else if present {
+		br.Skip(1) // overscan_appropriate_flag
+	}
+	if present, err := br.Read1(); err != nil {
+		return err
+	} else if present {
+		if err := readVideoSignalType(br); err != nil {
+			return err
+		}
+	}
+	if present, err := br.Read1(); err != nil {
+		return err
+	} else if present {
+		if err := skipUE(br, 2); err != nil { // chroma_sample_loc_type
+			return err
+		}
+	}
+	if present, err := br.Read1(); err != nil {
+		return err
+	} else if present {
+		return p.readTimingInfo(br)
+	}
+	return nil
+}
+
+// H264PPS holds the leading fields of an H.264 pic_parameter_set_rbsp().
+type H264PPS struct {
+	PPSID                 uint32
+	SPSID                 uint32
+	EntropyCodingModeFlag bool // CABAC
+}
+
+// ParseH264PPS decodes the start of an H.264 PPS NAL unit.
+func ParseH264PPS(nalu []byte) (*H264PPS, error) {
+	if len(nalu) < 2 {
+		return nil, ErrParseSPS
+	}
+	br := bitreader.NewRBSPReader(nalu[1:])
+	pps := &H264PPS{}
+	var err error
+	if pps.PPSID, err = br.ReadUE(); err != nil {
+		return nil, err
+	}
+	if pps.SPSID, err = br.ReadUE(); err != nil {
+		return nil, err
+	}
+	if pps.EntropyCodingModeFlag, err = br.Read1(); err != nil {
+		return nil, err
+	}
+	return pps, nil
+}
+
+// updateVideoParams records the parameters of streamID and reports when
+// they change mid-stream.
+func (dec *Demuxer) updateVideoParams(streamID uint8, p *VideoParams) {
+	old, ok := dec.videoParams[streamID]
+	if dec.opts.Verbose {
+		log.Printf("\t\t\t%s", p)
+	}
+	if ok && *old != *p {
+		dec.stats.VideoParamsChangeCnt++
+		log.Printf("stream 0x%x video params changed at pos %d: %s -> %s", streamID, dec.getPos(), old, p)
+	}
+	dec.videoParams[streamID] = p
+}
+
+// VideoParams returns the parameters from the last SPS of streamID, or nil.
+func (dec *Demuxer) VideoParams(streamID uint8) *VideoParams {
+	return dec.videoParams[streamID]
+}
@@ -0,0 +1,176 @@
+package psdemux
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sort"
+)
+
+const (
+	StartCodeEnd = 0x000001b9 // MPEG_program_end_code
+)
+
+// stream_id values from ISO/IEC 13818-1 Table 2-22
+const (
+	StreamIDPrivate1    = 0xbd
+	StreamIDPadding     = 0xbe
+	StreamIDPrivate2    = 0xbf
+	StreamIDECM         = 0xf0
+	StreamIDEMM         = 0xf1
+	StreamIDDSMCC       = 0xf2
+	StreamIDH2221TypeE  = 0xf8
+	StreamIDPSDirectory = 0xff
+)
+
+// StreamStats holds the per stream counters.
+type StreamStats struct {
+	StreamID   uint8
+	StreamType uint8 // from the program stream map, 0 if not listed
+	PktCnt     int
+	ErrPktCnt  int
+	Bytes      int64 // payload bytes of valid packets
+}
+
+// pesTypeOf classifies a stream_id.
+func pesTypeOf(streamID uint8) int {
+	switch {
+	case isVideoStreamID(streamID):
+		return VideoPES
+	case isAudioStreamID(streamID):
+		return AudioPES
+	case streamID == StreamIDPrivate1 || streamID == StreamIDPrivate2:
+		return PrivatePES
+	}
+	return OtherPES
+}
+
+// hasPESHeaderFields reports whether packets of streamID carry the optional
+// PES header (flags, PES_header_data_length...) after PES_packet_length.
+func hasPESHeaderFields(streamID uint8) bool {
+	switch streamID {
+	case StreamIDPadding, StreamIDPrivate2, StreamIDECM, StreamIDEMM,
+		StreamIDPSDirectory, StreamIDDSMCC, StreamIDH2221TypeE:
+		return false
+	}
+	return true
+}
+
+func streamName(streamID uint8) string {
+	switch {
+	case isVideoStreamID(streamID):
+		return fmt.Sprintf("video 0x%x", streamID)
+	case isAudioStreamID(streamID):
+		return fmt.Sprintf("audio 0x%x", streamID)
+	}
+	switch streamID {
+	case StreamIDPrivate1:
+		return "private stream 1"
+	case StreamIDPadding:
+		return "padding"
+	case StreamIDPrivate2:
+		return "private stream 2"
+	case StreamIDECM:
+		return "ECM"
+	case StreamIDEMM:
+		return "EMM"
+	case StreamIDDSMCC:
+		return "DSMCC"
+	case StreamIDPSDirectory:
+		return "program stream directory"
+	}
+	return fmt.Sprintf("stream 0x%x", streamID)
+}
+
+// pesHandler returns the handler for the PES start code of streamID.
+func (dec *Demuxer) pesHandler(streamID uint8) func() error {
+	if streamID == StreamIDPadding {
+		return dec.decodePadding
+	}
+	return func() error {
+		return dec.decodeStreamPes(streamID)
+	}
+}
+
+func (dec *Demuxer) decodeStreamPes(streamID uint8) error {
+	pesType := pesTypeOf(streamID)
+	if dec.opts.Verbose {
+		log.Printf("=== %s ===", streamName(streamID))
+	}
+	switch pesType {
+	case VideoPES:
+		dec.stats.TotalVideoFrameCnt++
+	case AudioPES:
+		dec.stats.TotalAudioFrameCnt++
+	default:
+		dec.stats.TotalOtherPktCnt++
+	}
+	return dec.decodePES(pesType, streamID)
+}
+
+func (dec *Demuxer) decodePadding() error {
+	br := dec.br
+	paddingLen, err := br.Read32(16)
+	if err != nil {
+		return err
+	}
+	if dec.opts.Verbose {
+		log.Println("=== padding ===")
+		log.Printf("\tPES_packet_length: %d", paddingLen)
+	}
+	dec.stats.PaddingCnt++
+	dec.stats.PaddingBytes += int64(paddingLen)
+	return br.Skip(uint(paddingLen) * 8)
+}
+
+func (dec *Demuxer) decodeProgramEnd() error {
+	if dec.opts.Verbose {
+		log.Println("=== program end ===")
+	}
+	return nil
+}
+
+// stream returns the counters of streamID, creating them on first use.
+func (dec *Demuxer) stream(streamID uint8) *StreamStats {
+	s, ok := dec.streams[streamID]
+	if !ok {
+		s = &StreamStats{StreamID: streamID}
+		dec.streams[streamID] = s
+	}
+	if dec.psm != nil {
+		if streamType, ok := dec.psm.StreamType(streamID); ok {
+			s.StreamType = streamType
+		}
+	}
+	return s
+}
+
+// streamWriter returns the writer payloads of streamID go to, or nil.
+func (dec *Demuxer) streamWriter(streamID uint8) io.Writer {
+	if w, ok := dec.writers[streamID]; ok {
+		return w
+	}
+	var w io.Writer
+	switch {
+	case streamID == StartCodeVideo&0xff && dec.opts.VideoWriter != nil:
+		w = dec.opts.VideoWriter
+	case streamID == StartCodeAudio&0xff && dec.opts.AudioWriter != nil:
+		w = dec.opts.AudioWriter
+	case dec.opts.StreamWriter != nil:
+		w = dec.opts.StreamWriter(streamID)
+	}
+	dec.writers[streamID] = w
+	return w
+}
+
+// Streams returns the counters of every stream seen, ordered by stream_id.
+func (dec *Demuxer) Streams() []StreamStats {
+	streams := make([]StreamStats, 0, len(dec.streams))
+	for _, s := range dec.streams {
+		streams = append(streams, *s)
+	}
+	sort.Slice(streams, func(i, j int) bool {
+		return streams[i].StreamID < streams[j].StreamID
+	})
+	return streams
+}
@@ -0,0 +1,216 @@
+package psdemux
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"sort"
+
+	"mpegps-parser/bitreader"
+)
+
+const (
+	// stream_id values that stand for every audio or every video stream in
+	// the system header loop
+	StreamIDAllAudio = 0xb8
+	StreamIDAllVideo = 0xb9
+)
+
+// SystemHeader is a decoded system_header().
+type SystemHeader struct {
+	HeaderLength              uint16
+	RateBound                 uint32 // units of 50 bytes/s
+	AudioBound                uint8
+	FixedFlag                 bool
+	CSPSFlag                  bool
+	SystemAudioLockFlag       bool
+	SystemVideoLockFlag       bool
+	VideoBound                uint8
+	PacketRateRestrictionFlag bool
+	Streams                   []SystemHeaderStream
+	MarkerErr                 bool
+}
+
+// SystemHeaderStream is one entry of the system header stream loop.
+type SystemHeaderStream struct {
+	StreamID             uint8
+	PSTDBufferBoundScale bool
+	PSTDBufferSizeBound  uint16
+}
+
+// PSTDBufferSize returns the buffer bound in bytes.
+func (s *SystemHeaderStream) PSTDBufferSize() int {
+	if s.PSTDBufferBoundScale {
+		return int(s.PSTDBufferSizeBound) * 1024
+	}
+	return int(s.PSTDBufferSizeBound) * 128
+}
+
+func (h *SystemHeader) read(data []byte) error {
+	br := bitreader.NewReader(bytes.NewReader(data))
+	ok := true
+	var err error
+	if err := readMarkers(br, 1, &ok); err != nil {
+		return err
+	}
+	h.RateBound, _ = br.Read32(22)
+	if err := readMarkers(br, 1, &ok); err != nil {
+		return err
+	}
+	h.AudioBound, _ = br.Read8(6)
+	h.FixedFlag, _ = br.Read1()
+	h.CSPSFlag, _ = br.Read1()
+	h.SystemAudioLockFlag, _ = br.Read1()
+	h.SystemVideoLockFlag, _ = br.Read1()
+	if err := readMarkers(br, 1, &ok); err != nil {
+		return err
+	}
+	h.VideoBound, _ = br.Read8(5)
+	h.PacketRateRestrictionFlag, _ = br.Read1()
+	if err := br.Skip(7); err != nil { // reserved_bits
+		return err
+	}
+	for br.Len() > 0 {
+		if next, err := br.Peek1(); err != nil || !next {
+			break
+		}
+		var s SystemHeaderStream
+		if s.StreamID, err = br.Read8(8); err != nil {
+			return err
+		}
+		if v, _ := br.Read8(2); v != 0x3 {
+			ok = false
+		}
+		s.PSTDBufferBoundScale, _ = br.Read1()
+		if s.PSTDBufferSizeBound, err = br.Read16(13); err != nil {
+			return err
+		}
+		h.Streams = append(h.Streams, s)
+	}
+	h.MarkerErr = !ok
+	return nil
+}
+
+func (h *SystemHeader) show() {
+	log.Println("=== ps system header === ")
+	log.Printf("\tsystem_header_length:%d", h.HeaderLength)
+	log.Printf("\trate_bound: %d (%d bytes/s)", h.RateBound, h.RateBound*50)
+	log.Printf("\taudio_bound: %d", h.AudioBound)
+	log.Printf("\tfixed_flag: %t", h.FixedFlag)
+	log.Printf("\tCSPS_flag: %t", h.CSPSFlag)
+	log.Printf("\tsystem_audio_lock_flag: %t", h.SystemAudioLockFlag)
+	log.Printf("\tsystem_video_lock_flag: %t", h.SystemVideoLockFlag)
+	log.Printf("\tvideo_bound: %d", h.VideoBound)
+	log.Printf("\tpacket_rate_restriction_flag: %t", h.PacketRateRestrictionFlag)
+	for _, s := range h.Streams {
+		log.Printf("\t\tstream_id: 0x%x P-STD_buffer_bound_scale: %t P-STD_buffer_size_bound: %d (%d bytes)",
+			s.StreamID, s.PSTDBufferBoundScale, s.PSTDBufferSizeBound, s.PSTDBufferSize())
+	}
+	if h.MarkerErr {
+		log.Println("\tmarker bit error")
+	}
+}
+
+func (dec *Demuxer) decodeSystemHeader() error {
+	br := dec.br
+	syslens, err := br.Read32(16)
+	if err != nil {
+		return err
+	}
+	data := make([]byte, syslens)
+	if _, err := io.ReadFull(br, data); err != nil {
+		return err
+	}
+	hdr := &SystemHeader{HeaderLength: uint16(syslens)}
+	if err := hdr.read(data); err != nil {
+		log.Printf("parse system header error: %v", err)
+		dec.stats.ErrSysHeaderCnt++
+		return err
+	}
+	if dec.opts.PrintSysHeader {
+		hdr.show()
+	}
+	if hdr.MarkerErr {
+		dec.stats.ErrSysHeaderCnt++
+	}
+	dec.sysHeader = hdr
+	return nil
+}
+
+// SystemHeader returns the last system header seen, or nil.
+func (dec *Demuxer) SystemHeader() *SystemHeader {
+	return dec.sysHeader
+}
+
+// SystemHeaderCheck is the result of comparing the system header with the
+// streams found in PES packets.
+type SystemHeaderCheck struct {
+	NotSeen        []uint8 // announced but no PES packet found
+	NotAnnounced   []uint8 // found in PES packets but not announced
+	AudioStreamCnt int
+	VideoStreamCnt int
+	AudioBoundErr  bool // more audio streams than audio_bound
+	VideoBoundErr  bool // more video streams than video_bound
+}
+
+// OK reports whether the system header matched the stream.
+func (c *SystemHeaderCheck) OK() bool {
+	return len(c.NotSeen) == 0 && len(c.NotAnnounced) == 0 &&
+		!c.AudioBoundErr && !c.VideoBoundErr
+}
+
+func isAudioStreamID(id uint8) bool {
+	return id >= 0xc0 && id <= 0xdf
+}
+
+func isVideoStreamID(id uint8) bool {
+	return id >= 0xe0 && id <= 0xef
+}
+
+// CheckSystemHeader compares the last system header with the streams seen
+// so far. It returns nil if no system header was found.
+func (dec *Demuxer) CheckSystemHeader() *SystemHeaderCheck {
+	hdr := dec.sysHeader
+	if hdr == nil {
+		return nil
+	}
+	check := &SystemHeaderCheck{}
+	announced := make(map[uint8]bool)
+	allAudio, allVideo := false, false
+	for _, s := range hdr.Streams {
+		switch s.StreamID {
+		case StreamIDAllAudio:
+			allAudio = true
+		case StreamIDAllVideo:
+			allVideo = true
+		default:
+			announced[s.StreamID] = true
+			if _, ok := dec.streams[s.StreamID]; !ok {
+				check.NotSeen = append(check.NotSeen, s.StreamID)
+			}
+		}
+	}
+	for id := range dec.streams {
+		if isAudioStreamID(id) {
+			check.AudioStreamCnt++
+			if allAudio {
+				continue
+			}
+		}
+		if isVideoStreamID(id) {
+			check.VideoStreamCnt++
+			if allVideo {
+				continue
+			}
+		}
+		if !announced[id] {
+			check.NotAnnounced = append(check.NotAnnounced, id)
+		}
+	}
+	sort.Slice(check.NotAnnounced, func(i, j int) bool {
+		return check.NotAnnounced[i] < check.NotAnnounced[j]
+	})
+	check.AudioBoundErr = check.AudioStreamCnt > int(hdr.AudioBound)
+	check.VideoBoundErr = check.VideoStreamCnt > int(hdr.VideoBound)
+	return check
+}
@@ -0,0 +1,53 @@
+package psdemux
+
+// maxAccessUnit bounds the bytes held for one access unit, in case a
+// stream stops sending PTS and every packet looks like a continuation.
+const maxAccessUnit = 16 << 20
+
+// accessUnit collects the video PES payloads of one picture. A PES packet
+// with a PTS starts a new access unit; GB28181 devices split large frames
+// over several PES packets and only the first carries timestamps. The NAL
+// units are split once the access unit is complete, as start codes and NAL
+// units may straddle the packets.
+type accessUnit struct {
+	data []byte
+	pts  uint64
+	// hasPTS is set when the first packet carried a PTS, only then can
+	// the following packets continue it
+	hasPTS bool
+	err    bool // a packet of it was corrupt
+}
+
+// decodeVideo adds a video PES payload to the access unit of its stream,
+// decoding the pending one when the payload starts a new one. Packets
+// without PTS that follow no PTS are decoded one by one.
+func (dec *Demuxer) decodeVideo(hdr *PESHeader, data []byte, corrupt bool) {
+	au, ok := dec.videoAU[hdr.StreamID]
+	if ok && au.hasPTS && (!hdr.HasPTS() || hdr.PTS == au.pts) && len(au.data) < maxAccessUnit {
+		au.data = append(au.data, data...)
+		au.err = au.err || corrupt
+		return
+	}
+	dec.flushVideo(hdr.StreamID)
+	dec.videoAU[hdr.StreamID] = &accessUnit{
+		data:   append([]byte(nil), data...),
+		pts:    hdr.PTS,
+		hasPTS: hdr.HasPTS(),
+		err:    corrupt,
+	}
+}
+
+// flushVideo decodes the pending access unit of streamID.
+func (dec *Demuxer) flushVideo(streamID uint8) {
+	au, ok := dec.videoAU[streamID]
+	if !ok {
+		return
+	}
+	delete(dec.videoAU, streamID)
+	switch dec.videoCodec(streamID) {
+	case CodecH265:
+		dec.decodeH265(streamID, au.data, au.err)
+	default:
+		dec.decodeH264(streamID, au.data, au.err)
+	}
+}
@@ -0,0 +1,116 @@
+package psdemux
+
+import (
+	"errors"
+	"io"
+)
+
+var errWindowSeek = errors.New("seek outside window")
+
+const (
+	// windowSize bounds the memory held by the demuxer. It must be larger
+	// than the biggest PES packet (64KiB) plus windowHistory.
+	windowSize = 1 << 20
+	// windowHistory is how many already consumed bytes are kept so that
+	// the start of the current packet can still be dumped.
+	windowHistory = 64
+)
+
+// window is a bounded sliding window over an io.Reader. It implements
+// bitreader.ByteReader: Size is the number of bytes loaded from the source
+// so far and Len the loaded bytes not yet consumed, so Size()-Len() is the
+// stream offset of the next unread byte.
+type window struct {
+	r    io.Reader
+	buf  []byte
+	base int64 // stream offset of buf[0]
+	off  int   // read position in buf
+	err  error // sticky error from r
+}
+
+func newWindow(r io.Reader) *window {
+	return &window{
+		r:   r,
+		buf: make([]byte, 0, windowSize),
+	}
+}
+
+// end returns the stream offset just past the last loaded byte.
+func (w *window) end() int64 {
+	return w.base + int64(len(w.buf))
+}
+
+// ensure loads data until the stream offset end is in the window. It
+// returns false if the source ran out or end does not fit in the window.
+func (w *window) ensure(end int64) bool {
+	for w.end() < end {
+		if w.err != nil {
+			return false
+		}
+		if end-w.base > int64(cap(w.buf)) || len(w.buf) == cap(w.buf) {
+			w.compact()
+			if end-w.base > int64(cap(w.buf)) {
+				return false
+			}
+		}
+		n, err := w.r.Read(w.buf[len(w.buf):cap(w.buf)])
+		w.buf = w.buf[:len(w.buf)+n]
+		if err != nil {
+			w.err = err
+		}
+	}
+	return true
+}
+
+// compact drops consumed bytes, keeping windowHistory of them.
+func (w *window) compact() {
+	drop := w.off - windowHistory
+	if drop <= 0 {
+		return
+	}
+	n := copy(w.buf, w.buf[drop:])
+	w.buf = w.buf[:n]
+	w.base += int64(drop)
+	w.off -= drop
+}
+
+// peek returns n bytes starting at stream offset pos without consuming
+// them. The slice is only valid until the next call on w.
+func (w *window) peek(pos int64, n int) ([]byte, bool) {
+	if pos < w.base || !w.ensure(pos+int64(n)) {
+		return nil, false
+	}
+	start := int(pos - w.base)
+	return w.buf[start : start+n], true
+}
+
+func (w *window) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if w.off == len(w.buf) && !w.ensure(w.end()+1) {
+		return 0, w.err
+	}
+	n := copy(p, w.buf[w.off:])
+	w.off += n
+	return n, nil
+}
+
+func (w *window) Len() int {
+	return len(w.buf) - w.off
+}
+
+func (w *window) Size() int64 {
+	return w.end()
+}
+
+// Seek moves the read position within the bytes held by the window, so
+// that the bit reader can skip without copying. Only io.SeekCurrent is
+// supported.
+func (w *window) Seek(offset int64, whence int) (int64, error) {
+	if whence != io.SeekCurrent || offset < -int64(w.off) || offset > int64(w.Len()) {
+		return 0, errWindowSeek
+	}
+	w.off += int(offset)
+	return w.base + int64(w.off), nil
+}
@@ -0,0 +1,171 @@
+// Package psmux writes an MPEG-2 program stream (ISO/IEC 13818-1) from
+// H.264/H.265 access units and AAC/G.711 audio frames, laid out the way
+// GB28181 devices send it: every video frame and every audio frame starts a
+// pack, and key frames are preceded by a system header and a program stream
+// map.
+package psmux
+
+import (
+	"bytes"
+	"errors"
+	"io"
+
+	"mpegps-parser/bitwriter"
+	"mpegps-parser/psdemux"
+)
+
+var (
+	ErrUnsupportedCodec = errors.New("unsupported codec")
+	ErrNoVideoStream    = errors.New("no video stream configured")
+	ErrNoAudioStream    = errors.New("no audio stream configured")
+)
+
+const (
+	// DefaultMuxRate is program_mux_rate in units of 50 bytes/s (8 Mbit/s).
+	DefaultMuxRate = 20000
+	// maxPESPacketLength is the largest PES_packet_length.
+	maxPESPacketLength = 0xffff
+
+	videoStreamID = psdemux.StartCodeVideo & 0xff
+	audioStreamID = psdemux.StartCodeAudio & 0xff
+)
+
+// Options configures a Muxer.
+type Options struct {
+	// VideoCodec is psdemux.CodecH264 or psdemux.CodecH265;
+	// psdemux.CodecUnknown for no video.
+	VideoCodec psdemux.Codec
+	// AudioStreamType is the PSM stream_type of the audio stream, e.g.
+	// psdemux.StreamTypeAAC or psdemux.StreamTypeG711A; 0 for no audio.
+	AudioStreamType uint8
+	// MuxRate is program_mux_rate; 0 means DefaultMuxRate.
+	MuxRate uint32
+	// MaxPESPayload limits the payload of one PES packet; frames larger
+	// than that are split across packets. 0 means as large as
+	// PES_packet_length allows.
+	MaxPESPayload int
+}
+
+// Muxer is the PS muxer. Timestamps are in 90kHz units.
+type Muxer struct {
+	w    io.Writer
+	out  bytes.Buffer
+	bw   bitwriter.BitWriter
+	opts Options
+	// scr is the system_clock_reference_base of the last pack; it never
+	// goes backwards, even when audio and video are interleaved loosely.
+	scr        uint64
+	started    bool
+	psmVersion uint8
+	streams    []stream // in the order of the system header and the map
+	err        error    // of the options, returned by every write
+}
+
+// stream is an elementary stream of the program.
+type stream struct {
+	id         uint8
+	streamType uint8
+}
+
+// NewMuxer returns a Muxer writing to w.
+func NewMuxer(w io.Writer, opts *Options) *Muxer {
+	m := &Muxer{w: w, opts: *opts}
+	if m.opts.MuxRate == 0 {
+		m.opts.MuxRate = DefaultMuxRate
+	}
+	m.bw = bitwriter.NewWriter(&m.out)
+	switch m.opts.VideoCodec {
+	case psdemux.CodecH264:
+		m.streams = append(m.streams, stream{videoStreamID, psdemux.StreamTypeH264})
+	case psdemux.CodecH265:
+		m.streams = append(m.streams, stream{videoStreamID, psdemux.StreamTypeH265})
+	case psdemux.CodecUnknown:
+	default:
+		m.err = ErrUnsupportedCodec
+	}
+	if m.opts.AudioStreamType != 0 {
+		m.streams = append(m.streams, stream{audioStreamID, m.opts.AudioStreamType})
+	}
+	return m
+}
+
+// hasStream reports whether the stream streamID is configured.
+func (m *Muxer) hasStream(streamID uint8) bool {
+	for _, s := range m.streams {
+		if s.id == streamID {
+			return true
+		}
+	}
+	return false
+}
+
+// WriteVideo writes one access unit in Annex B format. Access units with
+// an IDR (H.264) or IRAP (H.265) picture get a system header and a program
+// stream map in front of them, as does the first pack written.
+func (m *Muxer) WriteVideo(au []byte, pts, dts uint64) error {
+	if m.err != nil {
+		return m.err
+	}
+	if !m.hasStream(videoStreamID) {
+		return ErrNoVideoStream
+	}
+	m.writePackHeader(dts)
+	if !m.started || isKeyFrame(m.opts.VideoCodec, au) {
+		m.writeSystemHeader()
+		m.writePSM()
+		m.started = true
+	}
+	m.writePES(videoStreamID, au, pts, dts)
+	return m.flush()
+}
+
+// WriteAudio writes one audio frame, e.g. an ADTS frame or a block of
+// G.711 samples.
+func (m *Muxer) WriteAudio(frame []byte, pts uint64) error {
+	if m.err != nil {
+		return m.err
+	}
+	if !m.hasStream(audioStreamID) {
+		return ErrNoAudioStream
+	}
+	m.writePackHeader(pts)
+	if !m.started {
+		m.writeSystemHeader()
+		m.writePSM()
+		m.started = true
+	}
+	m.writePES(audioStreamID, frame, pts, pts)
+	return m.flush()
+}
+
+// flush hands the packs built in out to the writer.
+func (m *Muxer) flush() error {
+	if err := m.bw.Flush(); err != nil {
+		return err
+	}
+	_, err := m.w.Write(m.out.Bytes())
+	m.out.Reset()
+	return err
+}
+
+// isKeyFrame reports whether au holds an IDR or IRAP picture.
+func isKeyFrame(codec psdemux.Codec, au []byte) bool {
+	for _, nalu := range psdemux.SplitNALUnits(au) {
+		if codec == psdemux.CodecH265 {
+			if hdr, ok := psdemux.ParseH265NalHeader(nalu); ok && hdr.IsIRAP() {
+				return true
+			}
+			continue
+		}
+		if hdr, ok := psdemux.ParseH264NalHeader(nalu); ok && hdr.Type == psdemux.H264NalIDR {
+			return true
+		}
+	}
+	return false
+}
+
+// Close writes the MPEG_program_end_code. It does not close the writer.
+func (m *Muxer) Close() error {
+	m.bw.Write32(32, psdemux.StartCodeEnd)
+	return m.flush()
+}
@@ -0,0 +1,135 @@
+package psmux
+
+import (
+	"bytes"
+	"testing"
+
+	"mpegps-parser/psdemux"
+)
+
+type frame struct {
+	streamID uint8
+	data     []byte
+	pts, dts uint64
+}
+
+// demux returns the frames of ps, joining the PES packets of frames that
+// were split, and the demuxer.
+func demux(t *testing.T, ps []byte) ([]frame, *psdemux.Demuxer) {
+	var frames []frame
+	dec := psdemux.NewDemuxer(bytes.NewReader(ps), &psdemux.Options{
+		OnPES: func(pkt *psdemux.PESPacket) {
+			if pkt.Corrupt {
+				t.Errorf("corrupt pes at %d", pkt.StartPos)
+			}
+			hdr := &pkt.Header
+			if !hdr.HasPTS() {
+				last := &frames[len(frames)-1]
+				last.data = append(last.data, pkt.Payload...)
+				return
+			}
+			f := frame{streamID: hdr.StreamID, data: append([]byte(nil), pkt.Payload...), pts: hdr.PTS, dts: hdr.PTS}
+			if hdr.HasDTS() {
+				f.dts = hdr.DTS
+			}
+			frames = append(frames, f)
+		},
+	})
+	if err := dec.Demux(); err != nil {
+		t.Fatal(err)
+	}
+	return frames, dec
+}
+
+func TestRoundTrip(t *testing.T) {
+	idr := append([]byte{0, 0, 0, 1, 0x09, 0xf0, 0, 0, 0, 1, 0x65}, bytes.Repeat([]byte{0x88}, 3000)...)
+	p := append([]byte{0, 0, 0, 1, 0x09, 0xf0, 0, 0, 0, 1, 0x41}, bytes.Repeat([]byte{0x9a}, 500)...)
+	g711 := bytes.Repeat([]byte{0xd5}, 320)
+	want := []frame{
+		{videoStreamID, idr, 3600 + 3000, 3600},
+		{audioStreamID, g711, 3600, 3600},
+		{videoStreamID, p, 3600 + 6600, 7200},
+		{audioStreamID, g711, 7200, 7200},
+		{videoStreamID, p, 1<<33 - 100, 1<<33 - 3700},
+	}
+	var ps bytes.Buffer
+	m := NewMuxer(&ps, &Options{
+		VideoCodec:      psdemux.CodecH264,
+		AudioStreamType: psdemux.StreamTypeG711A,
+		MaxPESPayload:   1000,
+	})
+	for _, f := range want {
+		var err error
+		if f.streamID == videoStreamID {
+			err = m.WriteVideo(f.data, f.pts, f.dts)
+		} else {
+			err = m.WriteAudio(f.data, f.pts)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	got, dec := demux(t, ps.Bytes())
+	if len(got) != len(want) {
+		t.Fatalf("%d frames, want %d", len(got), len(want))
+	}
+	for i := range want {
+		g, w := got[i], want[i]
+		if g.streamID != w.streamID || g.pts != w.pts || g.dts != w.dts {
+			t.Errorf("frame %d: stream 0x%x pts %d dts %d, want 0x%x %d %d", i, g.streamID, g.pts, g.dts, w.streamID, w.pts, w.dts)
+		}
+		if !bytes.Equal(g.data, w.data) {
+			t.Errorf("frame %d: %d bytes differ from the %d written", i, len(g.data), len(w.data))
+		}
+	}
+	info := dec.StreamInfo()
+	if info.VideoStreamType != psdemux.StreamTypeH264 || info.AudioStreamType != psdemux.StreamTypeG711A {
+		t.Errorf("stream types 0x%x/0x%x", info.VideoStreamType, info.AudioStreamType)
+	}
+	stats := dec.Stats()
+	if stats.ErrPsmCRCCnt != 0 || stats.IFrameCnt != 1 || stats.PFrameCnt != 2 {
+		t.Errorf("psm crc errors %d, I %d P %d", stats.ErrPsmCRCCnt, stats.IFrameCnt, stats.PFrameCnt)
+	}
+	if check := dec.CheckSystemHeader(); check == nil || !check.OK() {
+		t.Errorf("system header does not match the streams: %+v", check)
+	}
+}
+
+func TestAudioOnly(t *testing.T) {
+	adts := []byte{0xff, 0xf1, 0x50, 0x80, 0x02, 0x1f, 0xfc, 1, 2, 3, 4, 5, 6, 7, 8, 9}
+	var ps bytes.Buffer
+	m := NewMuxer(&ps, &Options{AudioStreamType: psdemux.StreamTypeAAC})
+	for i := 0; i < 3; i++ {
+		if err := m.WriteAudio(adts, uint64(i)*1920); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.WriteVideo([]byte{0, 0, 0, 1, 0x65}, 0, 0); err != ErrNoVideoStream {
+		t.Errorf("video on an audio only muxer: %v, want %v", err, ErrNoVideoStream)
+	}
+	m.Close()
+
+	got, dec := demux(t, ps.Bytes())
+	if len(got) != 3 {
+		t.Fatalf("%d frames, want 3", len(got))
+	}
+	for i, f := range got {
+		if f.streamID != audioStreamID || f.pts != uint64(i)*1920 || !bytes.Equal(f.data, adts) {
+			t.Errorf("frame %d: stream 0x%x pts %d % x", i, f.streamID, f.pts, f.data)
+		}
+	}
+	psm := dec.ProgramStreamMap()
+	if psm == nil || len(psm.Streams) != 1 || psm.Streams[0].StreamType != psdemux.StreamTypeAAC {
+		t.Errorf("program stream map %+v, want only the aac stream", psm)
+	}
+	if sys := dec.SystemHeader(); sys == nil || sys.VideoBound != 0 || sys.AudioBound != 1 {
+		t.Errorf("system header %+v, want no video and one audio stream", sys)
+	}
+	if check := dec.CheckSystemHeader(); check == nil || !check.OK() {
+		t.Errorf("system header does not match the streams: %+v", check)
+	}
+}
@@ -0,0 +1,161 @@
+package psmux
+
+import (
+	"encoding/binary"
+
+	"mpegps-parser/bitwriter"
+	"mpegps-parser/mpegcrc"
+	"mpegps-parser/psdemux"
+)
+
+const (
+	// P-STD buffer bounds announced in the system header: 400KiB for video
+	// (scale 1, units of 1024 bytes), 4KiB for audio (scale 0, 128 bytes)
+	videoPSTDBufferSizeBound = 400
+	audioPSTDBufferSizeBound = 32
+)
+
+// writeTimestamp writes a 33 bit PTS, DTS or SCR base split by marker
+// bits, after a prefix of prefixBits bits.
+func writeTimestamp(bw bitwriter.BitWriter, prefix uint8, prefixBits uint, ts uint64) {
+	bw.Write8(prefixBits, prefix)
+	bw.Write64(3, ts>>30)
+	bw.Write1(true)
+	bw.Write64(15, ts>>15)
+	bw.Write1(true)
+	bw.Write64(15, ts)
+	bw.Write1(true)
+}
+
+// writePackHeader writes an MPEG-2 pack_header() whose SCR is ts, or the
+// previous SCR if ts is earlier.
+func (m *Muxer) writePackHeader(ts uint64) {
+	ts &= 1<<33 - 1
+	if ts > m.scr || !m.started {
+		m.scr = ts
+	}
+	bw := m.bw
+	bw.Write32(32, psdemux.StartCodePS)
+	writeTimestamp(bw, 0x1, 2, m.scr) // '01'
+	bw.Write16(9, 0)                  // system_clock_reference_extension
+	bw.Write1(true)
+	bw.Write32(22, m.opts.MuxRate)
+	bw.Write8(2, 0x3)  // marker_bits
+	bw.Write8(5, 0x1f) // reserved
+	bw.Write8(3, 0)    // pack_stuffing_length
+}
+
+// writeSystemHeader writes a system_header() announcing the configured
+// streams.
+func (m *Muxer) writeSystemHeader() {
+	audioBound, videoBound := uint8(0), uint8(0)
+	for _, s := range m.streams {
+		if s.id == videoStreamID {
+			videoBound++
+		} else {
+			audioBound++
+		}
+	}
+	bw := m.bw
+	bw.Write32(32, psdemux.StartCodeSYS)
+	bw.Write16(16, uint16(6+3*len(m.streams))) // header_length
+	bw.Write1(true)
+	bw.Write32(22, m.opts.MuxRate) // rate_bound
+	bw.Write1(true)
+	bw.Write8(6, audioBound)
+	bw.Write1(false) // fixed_flag
+	bw.Write1(false) // CSPS_flag
+	bw.Write1(true)  // system_audio_lock_flag
+	bw.Write1(true)  // system_video_lock_flag
+	bw.Write1(true)
+	bw.Write8(5, videoBound)
+	bw.Write1(false) // packet_rate_restriction_flag
+	bw.Write8(7, 0x7f)
+	for _, s := range m.streams {
+		if s.id == videoStreamID {
+			writeStreamBound(bw, s.id, true, videoPSTDBufferSizeBound)
+		} else {
+			writeStreamBound(bw, s.id, false, audioPSTDBufferSizeBound)
+		}
+	}
+}
+
+func writeStreamBound(bw bitwriter.BitWriter, streamID uint8, scale bool, sizeBound uint16) {
+	bw.Write8(8, streamID)
+	bw.Write8(2, 0x3)
+	bw.Write1(scale) // P-STD_buffer_bound_scale
+	bw.Write16(13, sizeBound)
+}
+
+// writePSM writes a program_stream_map() listing the configured streams.
+func (m *Muxer) writePSM() {
+	var esMap []byte
+	for _, s := range m.streams {
+		esMap = append(esMap, s.streamType, s.id, 0, 0)
+	}
+	psm := bitwriter.NewBuffer()
+	psm.Write32(32, psdemux.StartCodeMAP)
+	psm.Write16(16, uint16(10+len(esMap))) // program_stream_map_length
+	psm.Write1(true)                       // current_next_indicator
+	psm.Write1(false)                      // single_extension_stream_flag
+	psm.Write1(true)                       // reserved
+	psm.Write8(5, m.psmVersion)
+	psm.Write8(7, 0x7f)
+	psm.Write1(true)
+	psm.Write16(16, 0) // program_stream_info_length
+	psm.Write16(16, uint16(len(esMap)))
+	psm.Write(esMap)
+	data := psm.Bytes()
+	var crc [4]byte
+	binary.BigEndian.PutUint32(crc[:], mpegcrc.Checksum(data))
+	m.bw.Write(data)
+	m.bw.Write(crc[:])
+}
+
+// writePES writes frame as one or more PES packets. The first carries the
+// timestamps and data_alignment_indicator; dts is only written when it
+// differs from pts.
+func (m *Muxer) writePES(streamID uint8, frame []byte, pts, dts uint64) {
+	pts &= 1<<33 - 1
+	dts &= 1<<33 - 1
+	first := true
+	for first || len(frame) > 0 {
+		flags, headerLen := uint8(psdemux.PtsDtsNone), 0
+		if first {
+			flags, headerLen = psdemux.PtsDtsPtsOnly, 5
+			if dts != pts {
+				flags, headerLen = psdemux.PtsDtsBoth, 10
+			}
+		}
+		n := maxPESPacketLength - 3 - headerLen
+		if m.opts.MaxPESPayload > 0 && m.opts.MaxPESPayload < n {
+			n = m.opts.MaxPESPayload
+		}
+		if n > len(frame) {
+			n = len(frame)
+		}
+		bw := m.bw
+		bw.Write32(24, 1) // packet_start_code_prefix
+		bw.Write8(8, streamID)
+		bw.Write16(16, uint16(3+headerLen+n))
+		bw.Write8(2, 0x2)
+		bw.Write8(2, 0)  // PES_scrambling_control
+		bw.Write1(false) // PES_priority
+		bw.Write1(first) // data_alignment_indicator
+		bw.Write1(false) // copyright
+		bw.Write1(false) // original_or_copy
+		bw.Write8(2, flags)
+		bw.Write8(6, 0) // ESCR, ES_rate, DSM_trick_mode, additional_copy_info, PES_CRC, PES_extension
+		bw.Write8(8, uint8(headerLen))
+		switch flags {
+		case psdemux.PtsDtsPtsOnly:
+			writeTimestamp(bw, 0x2, 4, pts)
+		case psdemux.PtsDtsBoth:
+			writeTimestamp(bw, 0x3, 4, pts)
+			writeTimestamp(bw, 0x1, 4, dts)
+		}
+		bw.Write(frame[:n])
+		frame = frame[n:]
+		first = false
+	}
+}
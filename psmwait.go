@@ -0,0 +1,32 @@
+package main
+
+import "mpegps-parser/psdemux"
+
+// maxPendingPES is how many PES packets psmWait holds before it gives up
+// on a program stream map and lets the muxer start with the defaults.
+const maxPendingPES = 256
+
+// psmWait holds the PES packets that arrive before the program stream map,
+// so a muxer created at the first packet does not miss the codecs a map
+// following the first pack announces.
+type psmWait struct {
+	pending []*psdemux.PESPacket
+}
+
+// ready reports whether the codecs are known. If not, pkt is held and
+// returned by flush later.
+func (w *psmWait) ready(dec *psdemux.Demuxer, pkt *psdemux.PESPacket) bool {
+	if dec.ProgramStreamMap() != nil || len(w.pending) >= maxPendingPES {
+		return true
+	}
+	held := *pkt
+	w.pending = append(w.pending, &held)
+	return false
+}
+
+// flush returns the held packets.
+func (w *psmWait) flush() []*psdemux.PESPacket {
+	pending := w.pending
+	w.pending = nil
+	return pending
+}
@@ -0,0 +1,296 @@
+package rtp
+
+import (
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// sequence number jumps beyond these are taken as a restart of the
+	// sender rather than loss or reordering (RFC 3550 A.1)
+	maxDropout  = 3000
+	maxMisorder = 100
+)
+
+// Options configures a Depacketizer.
+type Options struct {
+	// PayloadType accepted; 0 accepts any.
+	PayloadType uint8
+	// SSRC accepted, packets of other senders are ignored; 0 accepts any.
+	SSRC uint32
+	// KeepBrokenFrames passes frames that lost packets on to the writer
+	// instead of dropping them, so the demuxer sees and counts the damage.
+	KeepBrokenFrames bool
+	Verbose          bool
+}
+
+// Stats are the reception statistics of one SSRC.
+type Stats struct {
+	SSRC           uint32
+	PayloadType    uint8
+	Packets        int
+	Bytes          int64 // payload bytes
+	Frames         int
+	DroppedFrames  int // frames dropped because packets were lost
+	Gaps           int // sequence number gaps
+	Late           int // duplicate or reordered packets, dropped
+	Restarts       int // sequence number jumps taken as a sender restart
+	OtherPTPackets int // packets with another payload type, dropped
+	Expected       int // from the extended sequence numbers
+	// Jitter is the RFC 3550 interarrival jitter in timestamp units.
+	Jitter float64
+}
+
+// Lost returns the number of packets lost.
+func (s *Stats) Lost() int {
+	if lost := s.Expected - s.Packets; lost > 0 {
+		return lost
+	}
+	return 0
+}
+
+// JitterMs returns Jitter in milliseconds.
+func (s *Stats) JitterMs() float64 {
+	return s.Jitter * 1000 / ClockRate
+}
+
+type source struct {
+	Stats
+	baseSeq     uint32
+	maxSeq      uint16
+	cycles      uint32
+	lastTransit float64
+	hasTransit  bool
+	resync      bool
+}
+
+// Depacketizer reassembles the PS payload of RTP packets into frames and
+// writes each complete frame to w. A frame ends at a packet with the
+// marker bit or when the RTP timestamp changes; frames with lost packets
+// are dropped unless Options.KeepBrokenFrames is set.
+//
+// WritePacket and Flush must be called from one goroutine; Stats may be
+// called from any.
+type Depacketizer struct {
+	w     io.Writer
+	opts  Options
+	ready [][]byte // frames to write once mu is released
+
+	mu      sync.Mutex // guards the fields below
+	sources map[uint32]*source
+	order   []uint32
+	cur     *source
+	frame   []byte
+	frameTS uint32
+	broken  bool
+}
+
+// NewDepacketizer returns a Depacketizer writing PS to w.
+func NewDepacketizer(w io.Writer, opts *Options) *Depacketizer {
+	return &Depacketizer{
+		w:       w,
+		opts:    *opts,
+		sources: make(map[uint32]*source),
+	}
+}
+
+// WritePacket handles one RTP packet received at arrival, which may be
+// zero if it is unknown.
+func (d *Depacketizer) WritePacket(data []byte, arrival time.Time) error {
+	pkt, err := ParsePacket(data)
+	if err != nil {
+		return err
+	}
+	d.mu.Lock()
+	d.handle(pkt, arrival)
+	d.mu.Unlock()
+	return d.writeReady()
+}
+
+func (d *Depacketizer) handle(pkt *Packet, arrival time.Time) {
+	if d.opts.SSRC != 0 && pkt.SSRC != d.opts.SSRC {
+		return
+	}
+	s := d.source(pkt.SSRC, pkt.PayloadType)
+	if d.opts.PayloadType != 0 && pkt.PayloadType != d.opts.PayloadType {
+		s.OtherPTPackets++
+		return
+	}
+	if s != d.cur {
+		if d.cur != nil && d.opts.Verbose {
+			log.Printf("rtp ssrc changed: 0x%08x -> 0x%08x", d.cur.SSRC, s.SSRC)
+		}
+		// the frame of the old sender can't be completed, and the new
+		// one may have been joined in the middle of a frame
+		d.dropFrame()
+		d.broken = !isPackStart(pkt.Payload)
+		d.cur = s
+	}
+	ok, gap := d.updateSeq(s, pkt.SequenceNumber)
+	if !ok {
+		return
+	}
+	s.Packets++
+	s.Bytes += int64(len(pkt.Payload))
+	s.updateJitter(pkt.Timestamp, arrival)
+
+	switch {
+	case gap && isPackStart(pkt.Payload):
+		// the lost packets ended the frame being assembled
+		d.dropFrame()
+	case gap:
+		// the lost packets may have ended the frame being assembled or
+		// started this one, either way the data up to the next frame is
+		// broken
+		d.broken = true
+	case len(d.frame) > 0 && pkt.Timestamp != d.frameTS:
+		d.endFrame()
+	}
+	d.frameTS = pkt.Timestamp
+	d.frame = append(d.frame, pkt.Payload...)
+	if pkt.Marker {
+		d.endFrame()
+	}
+}
+
+func (d *Depacketizer) source(ssrc uint32, pt uint8) *source {
+	s, ok := d.sources[ssrc]
+	if !ok {
+		s = &source{Stats: Stats{SSRC: ssrc, PayloadType: pt}}
+		d.sources[ssrc] = s
+		d.order = append(d.order, ssrc)
+	}
+	return s
+}
+
+// updateSeq tracks the extended sequence number and reports whether the
+// packet is to be used and whether packets were lost before it.
+func (d *Depacketizer) updateSeq(s *source, seq uint16) (ok, gap bool) {
+	if s.Packets == 0 && s.Expected == 0 {
+		s.baseSeq, s.maxSeq = uint32(seq), seq
+		s.Expected = 1
+		return true, false
+	}
+	delta := seq - s.maxSeq
+	switch {
+	case !s.resync && (delta == 0 || delta > 0xffff-maxMisorder):
+		s.Late++
+		return false, false
+	case s.resync || delta > maxDropout:
+		s.resync = false
+		s.Restarts++
+		if d.opts.Verbose {
+			log.Printf("rtp ssrc 0x%08x sequence restart: %d -> %d", s.SSRC, s.maxSeq, seq)
+		}
+		gap = true
+		s.baseSeq, s.maxSeq, s.cycles = uint32(seq)-uint32(s.Packets), seq, 0
+	default:
+		if delta > 1 {
+			s.Gaps++
+			gap = true
+			if d.opts.Verbose {
+				log.Printf("rtp ssrc 0x%08x lost %d packets after seq %d", s.SSRC, delta-1, s.maxSeq)
+			}
+		}
+		if seq < s.maxSeq {
+			s.cycles += 1 << 16
+		}
+		s.maxSeq = seq
+	}
+	s.Expected = int(s.cycles + uint32(s.maxSeq) - s.baseSeq + 1)
+	return true, gap
+}
+
+func isPackStart(payload []byte) bool {
+	return len(payload) >= 4 && payload[0] == 0 && payload[1] == 0 && payload[2] == 1 && payload[3] == 0xba
+}
+
+// updateJitter implements the interarrival jitter estimate of RFC 3550
+// 6.4.1.
+func (s *source) updateJitter(ts uint32, arrival time.Time) {
+	if arrival.IsZero() {
+		return
+	}
+	transit := float64(arrival.UnixNano())*ClockRate/1e9 - float64(ts)
+	if s.hasTransit {
+		diff := transit - s.lastTransit
+		if diff < 0 {
+			diff = -diff
+		}
+		s.Jitter += (diff - s.Jitter) / 16
+	}
+	s.lastTransit, s.hasTransit = transit, true
+}
+
+// endFrame queues the assembled frame for writing, or drops it if it is
+// broken.
+func (d *Depacketizer) endFrame() {
+	if len(d.frame) == 0 {
+		d.broken = false
+		return
+	}
+	if d.broken && !d.opts.KeepBrokenFrames {
+		d.dropFrame()
+		return
+	}
+	d.cur.Frames++
+	d.ready = append(d.ready, d.frame)
+	d.frame = nil
+	d.broken = false
+}
+
+func (d *Depacketizer) dropFrame() {
+	if len(d.frame) > 0 && d.cur != nil {
+		d.cur.DroppedFrames++
+	}
+	d.frame = d.frame[:0]
+	d.broken = false
+}
+
+// writeReady writes the queued frames. Writing may block on a slow
+// reader, so it is done without holding mu.
+func (d *Depacketizer) writeReady() error {
+	for len(d.ready) > 0 {
+		frame := d.ready[0]
+		d.ready = d.ready[1:]
+		if _, err := d.w.Write(frame); err != nil {
+			d.ready = nil
+			return err
+		}
+	}
+	return nil
+}
+
+// Resync takes the next packet of every SSRC as a restart of its sequence
+// numbers, e.g. when the sender reconnected, and drops the frame being
+// assembled.
+func (d *Depacketizer) Resync() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, s := range d.sources {
+		s.resync = true
+	}
+	d.dropFrame()
+}
+
+// Flush writes the frame still being assembled, e.g. at the end of the
+// input.
+func (d *Depacketizer) Flush() error {
+	d.mu.Lock()
+	d.endFrame()
+	d.mu.Unlock()
+	return d.writeReady()
+}
+
+// Stats returns the statistics of every SSRC seen, in order of appearance.
+func (d *Depacketizer) Stats() []Stats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	stats := make([]Stats, 0, len(d.order))
+	for _, ssrc := range d.order {
+		stats = append(stats, d.sources[ssrc].Stats)
+	}
+	return stats
+}
@@ -0,0 +1,80 @@
+// Package rtp reassembles an MPEG program stream carried over RTP, as sent
+// by GB28181 devices (payload type 96, RFC 3550), and keeps per-SSRC
+// reception statistics.
+package rtp
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+var (
+	ErrPacketTooShort = errors.New("rtp packet too short")
+	ErrVersion        = errors.New("rtp version error")
+)
+
+const (
+	// PayloadTypePS is the dynamic payload type GB28181 assigns to PS.
+	PayloadTypePS = 96
+	// ClockRate of the PS payload.
+	ClockRate = 90000
+
+	headerSize = 12
+)
+
+// Packet is a parsed RTP packet. Payload aliases the input.
+type Packet struct {
+	Marker         bool
+	PayloadType    uint8
+	SequenceNumber uint16
+	Timestamp      uint32
+	SSRC           uint32
+	CSRC           []uint32
+	Payload        []byte
+}
+
+// ParsePacket parses an RTP packet, skipping CSRCs, the header extension
+// and padding.
+func ParsePacket(data []byte) (*Packet, error) {
+	if len(data) < headerSize {
+		return nil, ErrPacketTooShort
+	}
+	if data[0]>>6 != 2 {
+		return nil, ErrVersion
+	}
+	padding := data[0]&0x20 != 0
+	extension := data[0]&0x10 != 0
+	csrcCount := int(data[0] & 0x0f)
+	p := &Packet{
+		Marker:         data[1]&0x80 != 0,
+		PayloadType:    data[1] & 0x7f,
+		SequenceNumber: binary.BigEndian.Uint16(data[2:]),
+		Timestamp:      binary.BigEndian.Uint32(data[4:]),
+		SSRC:           binary.BigEndian.Uint32(data[8:]),
+	}
+	off := headerSize + 4*csrcCount
+	if len(data) < off {
+		return nil, ErrPacketTooShort
+	}
+	for i := 0; i < csrcCount; i++ {
+		p.CSRC = append(p.CSRC, binary.BigEndian.Uint32(data[headerSize+4*i:]))
+	}
+	if extension {
+		if len(data) < off+4 {
+			return nil, ErrPacketTooShort
+		}
+		off += 4 + 4*int(binary.BigEndian.Uint16(data[off+2:]))
+		if len(data) < off {
+			return nil, ErrPacketTooShort
+		}
+	}
+	end := len(data)
+	if padding {
+		end -= int(data[end-1])
+		if end < off {
+			return nil, ErrPacketTooShort
+		}
+	}
+	p.Payload = data[off:end]
+	return p, nil
+}
@@ -0,0 +1,173 @@
+package rtp
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"time"
+)
+
+// Framer splits a TCP stream that arrives in pieces into the RTP packets
+// of its RFC 4571 framing (a two byte length before each packet) and hands
+// them to a Depacketizer. When a length does not lead to an RTP header, or
+// after Skip, it hunts for the next frame whose header carries the SSRC
+// seen before.
+type Framer struct {
+	d       *Depacketizer
+	buf     []byte
+	hunting bool
+	ssrc    uint32
+	hasSSRC bool
+
+	Resyncs      int
+	SkippedBytes int64
+}
+
+// NewFramer returns a Framer feeding d.
+func NewFramer(d *Depacketizer) *Framer {
+	return &Framer{d: d}
+}
+
+// Write adds the next piece of the stream, received at arrival.
+func (f *Framer) Write(p []byte, arrival time.Time) error {
+	f.buf = append(f.buf, p...)
+	off := 0
+	defer func() {
+		f.buf = f.buf[:copy(f.buf, f.buf[off:])]
+	}()
+	for {
+		if f.hunting {
+			i := f.hunt(f.buf[off:])
+			f.SkippedBytes += int64(i)
+			off += i
+			if f.hunting {
+				return nil
+			}
+		}
+		// the length and the first byte of the RTP header
+		if len(f.buf)-off < 3 {
+			return nil
+		}
+		n := int(binary.BigEndian.Uint16(f.buf[off:]))
+		if n < headerSize || f.buf[off+2]>>6 != 2 {
+			f.lostSync()
+			continue
+		}
+		if len(f.buf)-off < 2+n {
+			return nil
+		}
+		pkt := f.buf[off+2 : off+2+n]
+		off += 2 + n
+		f.ssrc, f.hasSSRC = binary.BigEndian.Uint32(pkt[8:]), true
+		if err := writePacket(f.d, pkt, arrival); err != nil {
+			return err
+		}
+	}
+}
+
+// Skip tells the Framer that bytes of the stream were lost before the next
+// Write.
+func (f *Framer) Skip() {
+	f.SkippedBytes += int64(len(f.buf))
+	f.buf = f.buf[:0]
+	f.lostSync()
+}
+
+func (f *Framer) lostSync() {
+	if !f.hunting {
+		f.hunting = true
+		f.Resyncs++
+	}
+}
+
+// hunt returns the offset of the first plausible frame in b and clears
+// hunting if there is one. Otherwise it returns how many bytes can be
+// dropped without missing a frame that starts near the end.
+func (f *Framer) hunt(b []byte) int {
+	const need = 2 + headerSize
+	for i := 0; i+need <= len(b); i++ {
+		n := int(binary.BigEndian.Uint16(b[i:]))
+		if n < headerSize || b[i+2]>>6 != 2 {
+			continue
+		}
+		if f.hasSSRC && binary.BigEndian.Uint32(b[i+10:]) != f.ssrc {
+			continue
+		}
+		if f.d.opts.PayloadType != 0 && b[i+3]&0x7f != f.d.opts.PayloadType {
+			continue
+		}
+		f.hunting = false
+		return i
+	}
+	if len(b) < need {
+		return 0
+	}
+	return len(b) - need + 1
+}
+
+// Reset drops a partial frame, for a stream that starts over on a new
+// connection. The counters are kept.
+func (f *Framer) Reset() {
+	f.buf = f.buf[:0]
+	f.hunting = false
+}
+
+// ReadStream reads RTP packets framed with a two byte length (RFC 4571),
+// as sent over TCP by GB28181 devices, and hands them to d. now stamps the
+// arrival of each packet for the jitter estimate; pass nil when reading a
+// recording. It returns nil at a clean end of r.
+func ReadStream(r io.Reader, d *Depacketizer, now func() time.Time) error {
+	return NewFramer(d).ReadStream(r, now)
+}
+
+// ReadStream writes what it reads from r to f, as the ReadStream function
+// does, so that the caller can look at the counters of f.
+func (f *Framer) ReadStream(r io.Reader, now func() time.Time) error {
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			var arrival time.Time
+			if now != nil {
+				arrival = now()
+			}
+			if err := f.Write(buf[:n], arrival); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// ReadDatagrams reads one RTP packet per datagram from conn, as sent over
+// UDP, and hands them to d until conn fails or is closed.
+func ReadDatagrams(conn net.PacketConn, d *Depacketizer, now func() time.Time) error {
+	buf := make([]byte, 0xffff)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		var arrival time.Time
+		if now != nil {
+			arrival = now()
+		}
+		if err := writePacket(d, buf[:n], arrival); err != nil {
+			return err
+		}
+	}
+}
+
+// writePacket hands a packet to d, skipping ones that don't parse.
+func writePacket(d *Depacketizer, pkt []byte, arrival time.Time) error {
+	err := d.WritePacket(pkt, arrival)
+	if err == ErrPacketTooShort || err == ErrVersion {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,110 @@
+package rtp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// framedPacket builds a PS/RTP packet of ssrc 1 with a two byte RFC 4571
+// length before it.
+func framedPacket(seq uint16, ts uint32, marker bool, payload []byte) []byte {
+	b := make([]byte, 2+headerSize, 2+headerSize+len(payload))
+	binary.BigEndian.PutUint16(b, uint16(headerSize+len(payload)))
+	b[2] = 0x80
+	b[3] = PayloadTypePS
+	if marker {
+		b[3] |= 0x80
+	}
+	binary.BigEndian.PutUint16(b[4:], seq)
+	binary.BigEndian.PutUint32(b[6:], ts)
+	binary.BigEndian.PutUint32(b[10:], 1)
+	return append(b, payload...)
+}
+
+func TestFramerSplit(t *testing.T) {
+	frames := [][]byte{
+		{0, 0, 1, 0xba, 1, 2, 3},
+		{0, 0, 1, 0xba, 4, 5},
+		{0, 0, 1, 0xba, 6, 7, 8, 9},
+	}
+	var stream, want []byte
+	for i, frame := range frames {
+		// the first frame spans two packets
+		if i == 0 {
+			stream = append(stream, framedPacket(0, 0, false, frame[:5])...)
+			stream = append(stream, framedPacket(1, 0, true, frame[5:])...)
+		} else {
+			stream = append(stream, framedPacket(uint16(i+1), uint32(i*3600), true, frame)...)
+		}
+		want = append(want, frame...)
+	}
+	for split := 0; split <= len(stream); split++ {
+		var out bytes.Buffer
+		f := NewFramer(NewDepacketizer(&out, &Options{PayloadType: PayloadTypePS}))
+		if err := f.Write(stream[:split], time.Time{}); err != nil {
+			t.Fatalf("split %d: %v", split, err)
+		}
+		if err := f.Write(stream[split:], time.Time{}); err != nil {
+			t.Fatalf("split %d: %v", split, err)
+		}
+		if err := f.d.Flush(); err != nil {
+			t.Fatalf("split %d: %v", split, err)
+		}
+		if !bytes.Equal(out.Bytes(), want) {
+			t.Errorf("split %d: got % x, want % x", split, out.Bytes(), want)
+		}
+		if f.Resyncs != 0 || f.SkippedBytes != 0 {
+			t.Errorf("split %d: %d resyncs, %d bytes skipped", split, f.Resyncs, f.SkippedBytes)
+		}
+	}
+}
+
+func TestFramerByteAtATime(t *testing.T) {
+	stream := append(framedPacket(0, 0, true, []byte{0, 0, 1, 0xba, 1}),
+		framedPacket(1, 3600, true, []byte{0, 0, 1, 0xba, 2})...)
+	var out bytes.Buffer
+	f := NewFramer(NewDepacketizer(&out, &Options{}))
+	for i := range stream {
+		if err := f.Write(stream[i:i+1], time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []byte{0, 0, 1, 0xba, 1, 0, 0, 1, 0xba, 2}
+	if !bytes.Equal(out.Bytes(), want) {
+		t.Errorf("got % x, want % x", out.Bytes(), want)
+	}
+}
+
+func TestFramerReadStream(t *testing.T) {
+	// a connection that loses sync, then ends in the middle of a packet
+	first := append(framedPacket(0, 0, true, []byte{0, 0, 1, 0xba, 1}), 0xde, 0xad)
+	first = append(first, framedPacket(1, 3600, true, []byte{0, 0, 1, 0xba, 2})...)
+	partial := framedPacket(2, 7200, true, []byte{0, 0, 1, 0xba, 3})
+	first = append(first, partial[:len(partial)-2]...)
+	// the device reconnects and starts over with whole packets
+	second := framedPacket(3, 10800, true, []byte{0, 0, 1, 0xba, 4})
+
+	var out bytes.Buffer
+	d := NewDepacketizer(&out, &Options{})
+	f := NewFramer(d)
+	if err := f.ReadStream(bytes.NewReader(first), nil); err != nil {
+		t.Fatal(err)
+	}
+	f.Reset()
+	if err := f.ReadStream(bytes.NewReader(second), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{0, 0, 1, 0xba, 1, 0, 0, 1, 0xba, 2, 0, 0, 1, 0xba, 4}
+	if !bytes.Equal(out.Bytes(), want) {
+		t.Errorf("got % x, want % x", out.Bytes(), want)
+	}
+	// the counters cover both connections
+	if f.Resyncs != 1 || f.SkippedBytes != 2 {
+		t.Errorf("%d resyncs, %d bytes skipped, want 1 and 2", f.Resyncs, f.SkippedBytes)
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"mpegps-parser/pcap"
+	"mpegps-parser/rtp"
+)
+
+// streamInput receives the program stream from a file of RTP, a capture or
+// the network, with or without RTP, and serves it through an io.Reader for
+// the demuxer.
+type streamInput struct {
+	// depacketizer is nil when the input carries bare PS
+	depacketizer *rtp.Depacketizer
+	pr           *io.PipeReader
+	pw           *io.PipeWriter
+
+	mu      sync.Mutex
+	closers []io.Closer
+	stopped bool
+	// set when reading a TCP flow of a capture
+	tcp *pcap.Reassembler
+	// set when reading RTP over TCP, from a recording, a capture or the
+	// network
+	framer *rtp.Framer
+}
+
+// newStreamInput returns an input depacketizing RTP with opts, or passing
+// the data on as it is if opts is nil.
+func newStreamInput(opts *rtp.Options) *streamInput {
+	pr, pw := io.Pipe()
+	in := &streamInput{pr: pr, pw: pw}
+	if opts != nil {
+		in.depacketizer = rtp.NewDepacketizer(pw, opts)
+	}
+	return in
+}
+
+// readStream reads RTP framed as in RFC 4571 (the GB28181 TCP transport)
+// from a recording.
+func (in *streamInput) readStream(r io.Reader) {
+	in.run(func() error {
+		return in.streamFramer().ReadStream(r, nil)
+	})
+}
+
+// listenUDP receives datagrams on addr.
+func (in *streamInput) listenUDP(addr string) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	log.Printf("listening on udp %s", conn.LocalAddr())
+	in.track(conn)
+	in.run(func() error {
+		if in.depacketizer != nil {
+			return rtp.ReadDatagrams(conn, in.depacketizer, time.Now)
+		}
+		// packs split across datagrams are joined again by the pipe
+		buf := make([]byte, 0xffff)
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				return err
+			}
+			if _, err := in.pw.Write(buf[:n]); err != nil {
+				return err
+			}
+		}
+	})
+	return nil
+}
+
+// listenTCP waits on addr for the device to connect and send over TCP
+// (GB28181 passive mode). Connections are served one after the other, so
+// the device may reconnect.
+func (in *streamInput) listenTCP(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	log.Printf("listening on tcp %s", ln.Addr())
+	in.track(ln)
+	in.run(func() error {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return err
+			}
+			log.Printf("connection from %s", conn.RemoteAddr())
+			in.track(conn)
+			err = in.readConn(conn)
+			conn.Close()
+			if err != nil && !in.isStopped() {
+				log.Printf("connection from %s: %v", conn.RemoteAddr(), err)
+			} else {
+				log.Printf("connection from %s closed", conn.RemoteAddr())
+			}
+		}
+	})
+	return nil
+}
+
+// connectTCP connects to the device at addr and receives over TCP
+// (GB28181 active mode) until the device closes the connection.
+func (in *streamInput) connectTCP(addr string) error {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return err
+	}
+	log.Printf("connected to %s", conn.RemoteAddr())
+	in.track(conn)
+	in.run(func() error {
+		return in.readConn(conn)
+	})
+	return nil
+}
+
+// readConn reads one TCP connection until the peer closes it.
+func (in *streamInput) readConn(conn net.Conn) error {
+	if in.depacketizer == nil {
+		_, err := io.Copy(in.pw, conn)
+		return err
+	}
+	// the sender may have restarted its sequence numbers
+	in.depacketizer.Resync()
+	framer := in.streamFramer()
+	framer.Reset()
+	return framer.ReadStream(conn, time.Now)
+}
+
+// streamFramer returns the Framer of the input, kept across connections so
+// that showStats counts the resyncs of all of them.
+func (in *streamInput) streamFramer() *rtp.Framer {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if in.framer == nil {
+		in.framer = rtp.NewFramer(in.depacketizer)
+	}
+	return in.framer
+}
+
+// run feeds the depacketizer with serve in the background. The reader
+// sees io.EOF once serve returns nil or the input is stopped.
+func (in *streamInput) run(serve func() error) {
+	go func() {
+		err := serve()
+		if in.isStopped() {
+			err = nil
+		}
+		if err == nil && in.depacketizer != nil {
+			err = in.depacketizer.Flush()
+		}
+		in.pw.CloseWithError(err)
+	}()
+}
+
+func (in *streamInput) track(c io.Closer) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if in.stopped {
+		c.Close()
+		return
+	}
+	in.closers = append(in.closers, c)
+}
+
+func (in *streamInput) isStopped() bool {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	return in.stopped
+}
+
+// stop closes the sockets, which ends the stream for the reader.
+func (in *streamInput) stop() {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.stopped = true
+	for _, c := range in.closers {
+		c.Close()
+	}
+	in.closers = nil
+}
+
+func (in *streamInput) Read(p []byte) (int, error) {
+	return in.pr.Read(p)
+}
+
+func (in *streamInput) showStats() {
+	in.mu.Lock()
+	tcp, framer := in.tcp, in.framer
+	in.mu.Unlock()
+	if tcp != nil {
+		log.Printf("tcp retransmits: %d lost bytes: %d", tcp.Retransmits, tcp.LostBytes)
+	}
+	if framer != nil && framer.Resyncs > 0 {
+		log.Printf("rtp over tcp resync count: %d skipped bytes: %d", framer.Resyncs, framer.SkippedBytes)
+	}
+	if in.depacketizer != nil {
+		showRTPStats(in.depacketizer.Stats())
+	}
+}
+
+func showRTPStats(stats []rtp.Stats) {
+	for _, s := range stats {
+		log.Printf("rtp ssrc 0x%08x pt %d packets: %d bytes: %d", s.SSRC, s.PayloadType, s.Packets, s.Bytes)
+		log.Printf("\texpected: %d lost: %d gaps: %d late: %d restarts: %d", s.Expected, s.Lost(), s.Gaps, s.Late, s.Restarts)
+		log.Printf("\tframes: %d dropped frames: %d jitter: %.2fms", s.Frames, s.DroppedFrames, s.JitterMs())
+		if s.OtherPTPackets > 0 {
+			log.Printf("\tother payload type packets: %d", s.OtherPTPackets)
+		}
+	}
+}
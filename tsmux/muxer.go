@@ -0,0 +1,345 @@
+// Package tsmux writes an MPEG-2 transport stream (ISO/IEC 13818-1) with a
+// single program from PES packets, e.g. the ones taken out of a program
+// stream by psdemux.
+package tsmux
+
+import (
+	"errors"
+	"io"
+
+	"mpegps-parser/bitwriter"
+	"mpegps-parser/mpegcrc"
+	"mpegps-parser/psdemux"
+)
+
+var (
+	ErrUnknownStream = errors.New("stream not in program map")
+)
+
+const (
+	PacketSize = 188
+	syncByte   = 0x47
+
+	PIDPAT         = 0x0000
+	PIDPMT         = 0x1000
+	PIDFirstStream = 0x0100
+	ProgramNumber  = 1
+
+	tableIDPAT = 0x00
+	tableIDPMT = 0x02
+
+	// The PAT and PMT are repeated so that a reader joining mid-stream can
+	// decode it: before the first PCR 100ms after the last ones, and after
+	// psiPacketInterval packets if the PCR does not advance.
+	psiPCRInterval    = 27000000 / 10
+	psiPacketInterval = 1000
+)
+
+// Stream is one elementary stream of the program.
+type Stream struct {
+	StreamID   uint8
+	StreamType uint8
+}
+
+type stream struct {
+	Stream
+	pid uint16
+	cc  uint8
+}
+
+// Muxer packetizes PES packets into 188 byte TS packets. The PAT and PMT
+// are written every time SetStreams is called and repeated periodically.
+type Muxer struct {
+	w          io.Writer
+	streams    []*stream
+	pcrPID     uint16
+	patCC      uint8
+	pmtCC      uint8
+	pmtVersion uint8
+	pcr        uint64
+	pcrPending bool
+	nextPID    uint16
+	pkt        [PacketSize]byte
+	// PCR at the last PAT and PMT and the packets written since
+	psiPCR     uint64
+	hasPSIPCR  bool
+	psiPackets int
+}
+
+// NewMuxer returns a Muxer writing to w.
+func NewMuxer(w io.Writer) *Muxer {
+	return &Muxer{w: w, nextPID: PIDFirstStream}
+}
+
+// SetStreams sets the streams of the program and writes the PAT and PMT.
+// Streams keep their PID and continuity counter across calls; the PMT
+// version changes when the list does. The first video stream carries the
+// PCR, or the first stream if there is no video.
+func (m *Muxer) SetStreams(streams []Stream) error {
+	changed := len(streams) != len(m.streams)
+	next := make([]*stream, 0, len(streams))
+	for _, s := range streams {
+		old := m.stream(s.StreamID)
+		if old == nil {
+			old = &stream{pid: m.nextPID}
+			m.nextPID++
+		}
+		if old.Stream != s {
+			changed = true
+		}
+		old.Stream = s
+		next = append(next, old)
+	}
+	if changed && m.streams != nil {
+		m.pmtVersion = (m.pmtVersion + 1) & 0x1f
+	}
+	m.streams = next
+	m.pcrPID = 0x1fff
+	for _, s := range m.streams {
+		if s.StreamID&0xf0 == psdemux.StartCodeVideo&0xf0 {
+			m.pcrPID = s.pid
+			break
+		}
+	}
+	if m.pcrPID == 0x1fff && len(m.streams) > 0 {
+		m.pcrPID = m.streams[0].pid
+	}
+	return m.writePSI()
+}
+
+// writePSI writes the PAT and PMT.
+func (m *Muxer) writePSI() error {
+	if err := m.writeSection(PIDPAT, &m.patCC, m.pat()); err != nil {
+		return err
+	}
+	if err := m.writeSection(PIDPMT, &m.pmtCC, m.pmt()); err != nil {
+		return err
+	}
+	m.psiPackets = 0
+	if m.pcrPending {
+		m.psiPCR, m.hasPSIPCR = m.pcr, true
+	}
+	return nil
+}
+
+// psiDue reports whether the PAT and PMT should be repeated before a PES
+// packet of s.
+func (m *Muxer) psiDue(s *stream) bool {
+	if m.psiPackets >= psiPacketInterval {
+		return true
+	}
+	if s.pid != m.pcrPID || !m.pcrPending {
+		return false
+	}
+	// a PCR going back starts over
+	return !m.hasPSIPCR || m.pcr < m.psiPCR || m.pcr-m.psiPCR >= psiPCRInterval
+}
+
+// Streams returns the streams of the program.
+func (m *Muxer) Streams() []Stream {
+	streams := make([]Stream, len(m.streams))
+	for i, s := range m.streams {
+		streams[i] = s.Stream
+	}
+	return streams
+}
+
+func (m *Muxer) stream(streamID uint8) *stream {
+	for _, s := range m.streams {
+		if s.StreamID == streamID {
+			return s
+		}
+	}
+	return nil
+}
+
+// SetPCR sets the program clock reference, in 27MHz units, written with
+// the next packet of the PCR stream.
+func (m *Muxer) SetPCR(pcr uint64) {
+	m.pcr = pcr
+	m.pcrPending = true
+}
+
+// WritePES writes a PES packet of streamID. Only the timestamps and
+// data_alignment_indicator of hdr are kept.
+func (m *Muxer) WritePES(streamID uint8, hdr *psdemux.PESHeader, payload []byte) error {
+	s := m.stream(streamID)
+	if s == nil {
+		return ErrUnknownStream
+	}
+	if m.psiDue(s) {
+		if err := m.writePSI(); err != nil {
+			return err
+		}
+	}
+	data := m.buildPES(streamID, hdr, payload)
+	start := true
+	for start || len(data) > 0 {
+		pcr := int64(-1)
+		if s.pid == m.pcrPID && m.pcrPending && start {
+			pcr = int64(m.pcr)
+			m.pcrPending = false
+		}
+		n, err := m.writePacket(s.pid, &s.cc, start, pcr, data)
+		if err != nil {
+			return err
+		}
+		data = data[n:]
+		start = false
+	}
+	return nil
+}
+
+// buildPES rebuilds the PES packet header with just its timestamps.
+func (m *Muxer) buildPES(streamID uint8, hdr *psdemux.PESHeader, payload []byte) []byte {
+	flags, headerLen := uint8(psdemux.PtsDtsNone), 0
+	if hdr.HasPTS() {
+		flags, headerLen = psdemux.PtsDtsPtsOnly, 5
+		if hdr.HasDTS() {
+			flags, headerLen = psdemux.PtsDtsBoth, 10
+		}
+	}
+	packetLength := 3 + headerLen + len(payload)
+	if packetLength > 0xffff {
+		// only allowed for video: unbounded PES_packet_length
+		packetLength = 0
+	}
+	bw := bitwriter.NewBuffer()
+	bw.Write32(24, 1)
+	bw.Write8(8, streamID)
+	bw.Write16(16, uint16(packetLength))
+	bw.Write8(2, 0x2)
+	bw.Write8(4, 0) // scrambling, priority
+	bw.Write1(hdr.DataAlignment)
+	bw.Write8(2, 0) // copyright, original_or_copy
+	bw.Write8(2, flags)
+	bw.Write8(6, 0)
+	bw.Write8(8, uint8(headerLen))
+	switch flags {
+	case psdemux.PtsDtsPtsOnly:
+		writeTimestamp(bw, 0x2, hdr.PTS)
+	case psdemux.PtsDtsBoth:
+		writeTimestamp(bw, 0x3, hdr.PTS)
+		writeTimestamp(bw, 0x1, hdr.DTS)
+	}
+	bw.Write(payload)
+	return bw.Bytes()
+}
+
+func writeTimestamp(bw bitwriter.BitWriter, prefix uint8, ts uint64) {
+	bw.Write8(4, prefix)
+	bw.Write64(3, ts>>30)
+	bw.Write1(true)
+	bw.Write64(15, ts>>15)
+	bw.Write1(true)
+	bw.Write64(15, ts)
+	bw.Write1(true)
+}
+
+// writePacket writes one TS packet carrying as much of data as fits and
+// returns how much that was. A PCR is added when pcr is not negative; the
+// adaptation field is stuffed when data is short.
+func (m *Muxer) writePacket(pid uint16, cc *uint8, start bool, pcr int64, data []byte) (int, error) {
+	pkt := m.pkt[:4]
+	pkt[0] = syncByte
+	pkt[1] = uint8(pid>>8) & 0x1f
+	if start {
+		pkt[1] |= 0x40 // payload_unit_start_indicator
+	}
+	pkt[2] = uint8(pid)
+	var af []byte
+	if pcr >= 0 {
+		base, ext := uint64(pcr)/300, uint64(pcr)%300
+		af = append(af, 0x10, // PCR_flag
+			uint8(base>>25), uint8(base>>17), uint8(base>>9), uint8(base>>1),
+			uint8(base&1)<<7|0x7e|uint8(ext>>8), uint8(ext))
+	}
+	room := PacketSize - 4
+	if af != nil {
+		room -= 1 + len(af)
+	}
+	n := len(data)
+	if n < room {
+		stuffing := room - n
+		if af == nil {
+			// the adaptation_field_length byte alone stuffs one byte
+			af = []byte{}
+			stuffing--
+			if stuffing > 0 {
+				af = append(af, 0x00)
+				stuffing--
+			}
+		}
+		for ; stuffing > 0; stuffing-- {
+			af = append(af, 0xff)
+		}
+	} else {
+		n = room
+	}
+	control := uint8(0x10) // payload only
+	if af != nil {
+		control = 0x30
+		pkt = append(pkt, uint8(len(af)))
+		pkt = append(pkt, af...)
+	}
+	pkt[3] = control | *cc
+	*cc = (*cc + 1) & 0xf
+	pkt = append(pkt, data[:n]...)
+	m.psiPackets++
+	_, err := m.w.Write(pkt)
+	return n, err
+}
+
+// writeSection writes a PSI section in one packet, padded with 0xff.
+func (m *Muxer) writeSection(pid uint16, cc *uint8, section []byte) error {
+	var payload [PacketSize - 4]byte
+	payload[0] = 0 // pointer_field
+	n := copy(payload[1:], section)
+	for i := 1 + n; i < len(payload); i++ {
+		payload[i] = 0xff
+	}
+	_, err := m.writePacket(pid, cc, true, -1, payload[:])
+	return err
+}
+
+// psiSection wraps the body of a long form section with its header and
+// CRC_32.
+func psiSection(tableID uint8, tableIDExtension uint16, version uint8, body []byte) []byte {
+	bw := bitwriter.NewBuffer()
+	bw.Write8(8, tableID)
+	bw.Write1(true)  // section_syntax_indicator
+	bw.Write1(false) // '0'
+	bw.Write8(2, 0x3)
+	bw.Write16(12, uint16(5+len(body)+4)) // section_length
+	bw.Write16(16, tableIDExtension)
+	bw.Write8(2, 0x3)
+	bw.Write8(5, version)
+	bw.Write1(true) // current_next_indicator
+	bw.Write8(8, 0) // section_number
+	bw.Write8(8, 0) // last_section_number
+	bw.Write(body)
+	section := bw.Bytes()
+	crc := mpegcrc.Checksum(section)
+	return append(section, uint8(crc>>24), uint8(crc>>16), uint8(crc>>8), uint8(crc))
+}
+
+func (m *Muxer) pat() []byte {
+	body := []byte{0, ProgramNumber, 0xe0 | PIDPMT>>8, PIDPMT & 0xff}
+	return psiSection(tableIDPAT, 1, 0, body)
+}
+
+func (m *Muxer) pmt() []byte {
+	bw := bitwriter.NewBuffer()
+	bw.Write8(3, 0x7)
+	bw.Write16(13, m.pcrPID)
+	bw.Write8(4, 0xf)
+	bw.Write16(12, 0) // program_info_length
+	for _, s := range m.streams {
+		bw.Write8(8, s.StreamType)
+		bw.Write8(3, 0x7)
+		bw.Write16(13, s.pid)
+		bw.Write8(4, 0xf)
+		bw.Write16(12, 0) // ES_info_length
+	}
+	return psiSection(tableIDPMT, ProgramNumber, m.pmtVersion, bw.Bytes())
+}
@@ -0,0 +1,228 @@
+package tsmux
+
+import (
+	"bytes"
+	"testing"
+
+	"mpegps-parser/mpegcrc"
+	"mpegps-parser/psdemux"
+)
+
+type packet struct {
+	pid     uint16
+	start   bool
+	cc      uint8
+	af      []byte // adaptation field after its length byte, nil if absent
+	payload []byte
+}
+
+// parsePackets splits b into TS packets.
+func parsePackets(t *testing.T, b []byte) []packet {
+	if len(b)%PacketSize != 0 {
+		t.Fatalf("%d bytes, not a multiple of %d", len(b), PacketSize)
+	}
+	var pkts []packet
+	for ; len(b) > 0; b = b[PacketSize:] {
+		p := b[:PacketSize]
+		if p[0] != syncByte {
+			t.Fatalf("packet %d: sync byte 0x%x", len(pkts), p[0])
+		}
+		pkt := packet{
+			pid:   uint16(p[1]&0x1f)<<8 | uint16(p[2]),
+			start: p[1]&0x40 != 0,
+			cc:    p[3] & 0xf,
+		}
+		rest := p[4:]
+		if p[3]&0x20 != 0 {
+			n := int(rest[0])
+			pkt.af = rest[1 : 1+n]
+			rest = rest[1+n:]
+		}
+		if p[3]&0x10 != 0 {
+			pkt.payload = rest
+		}
+		pkts = append(pkts, pkt)
+	}
+	return pkts
+}
+
+// pcrOf decodes the PCR of an adaptation field, or -1.
+func pcrOf(af []byte) int64 {
+	if len(af) < 7 || af[0]&0x10 == 0 {
+		return -1
+	}
+	base := uint64(af[1])<<25 | uint64(af[2])<<17 | uint64(af[3])<<9 | uint64(af[4])<<1 | uint64(af[5])>>7
+	ext := uint64(af[5]&1)<<8 | uint64(af[6])
+	return int64(base*300 + ext)
+}
+
+var testStreams = []Stream{
+	{StreamID: 0xe0, StreamType: psdemux.StreamTypeH264},
+	{StreamID: 0xc0, StreamType: psdemux.StreamTypeAAC},
+}
+
+func ptsHeader(pts uint64) *psdemux.PESHeader {
+	return &psdemux.PESHeader{PtsDtsFlags: psdemux.PtsDtsPtsOnly, PTS: pts}
+}
+
+func TestPSISections(t *testing.T) {
+	var b bytes.Buffer
+	m := NewMuxer(&b)
+	if err := m.SetStreams(testStreams); err != nil {
+		t.Fatal(err)
+	}
+	pkts := parsePackets(t, b.Bytes())
+	if len(pkts) != 2 || pkts[0].pid != PIDPAT || pkts[1].pid != PIDPMT {
+		t.Fatalf("got %d packets, want PAT and PMT", len(pkts))
+	}
+	for _, p := range pkts {
+		if !p.start || p.payload[0] != 0 {
+			t.Errorf("pid 0x%x: no section start", p.pid)
+			continue
+		}
+		section := p.payload[1:]
+		n := 3 + (int(section[1]&0xf)<<8 | int(section[2]))
+		if mpegcrc.Checksum(section[:n]) != 0 {
+			t.Errorf("pid 0x%x: CRC_32 mismatch % x", p.pid, section[:n])
+		}
+		for _, c := range section[n:] {
+			if c != 0xff {
+				t.Errorf("pid 0x%x: stuffing 0x%x after the section", p.pid, c)
+				break
+			}
+		}
+	}
+	pmt := pkts[1].payload[1:]
+	if pcrPID := uint16(pmt[8]&0x1f)<<8 | uint16(pmt[9]); pcrPID != PIDFirstStream {
+		t.Errorf("PCR_PID 0x%x, want the video stream", pcrPID)
+	}
+	// the elementary streams follow program_info_length
+	es := pmt[12:]
+	for i, s := range testStreams {
+		pid := uint16(es[1]&0x1f)<<8 | uint16(es[2])
+		if es[0] != s.StreamType || pid != PIDFirstStream+uint16(i) {
+			t.Errorf("stream %d: type 0x%x pid 0x%x", i, es[0], pid)
+		}
+		es = es[5:]
+	}
+}
+
+func TestPacketization(t *testing.T) {
+	var b bytes.Buffer
+	m := NewMuxer(&b)
+	if err := m.SetStreams(testStreams); err != nil {
+		t.Fatal(err)
+	}
+	m.SetPCR(27000000)
+	// PES of 14 header bytes and these payloads: one that fills packets
+	// exactly, and ones leaving 1, 2 and many bytes to stuff
+	sizes := []int{184*3 - 14, 184 - 14 - 1, 184 - 14 - 2, 100, 5000}
+	var want [][]byte
+	for i, n := range sizes {
+		payload := bytes.Repeat([]byte{uint8(i + 1)}, n)
+		if err := m.WritePES(0xe0, ptsHeader(uint64(i)*3600), payload); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, m.buildPES(0xe0, ptsHeader(uint64(i)*3600), payload))
+	}
+	if err := m.WritePES(0xc0, ptsHeader(0), []byte{1, 2, 3}); err != nil {
+		t.Fatal(err)
+	}
+
+	cc := map[uint16]int{}
+	var got [][]byte
+	pcrs := 0
+	for i, p := range parsePackets(t, b.Bytes()) {
+		if last, ok := cc[p.pid]; ok && int(p.cc) != (last+1)&0xf {
+			t.Errorf("packet %d pid 0x%x: continuity_counter %d after %d", i, p.pid, p.cc, last)
+		}
+		cc[p.pid] = int(p.cc)
+		if pcr := pcrOf(p.af); pcr >= 0 {
+			pcrs++
+			if p.pid != PIDFirstStream || pcr != 27000000 || !p.start {
+				t.Errorf("packet %d: PCR %d on pid 0x%x", i, pcr, p.pid)
+			}
+		}
+		for j, c := range p.af {
+			// flags byte, PCR, then 0xff stuffing
+			if j > 0 && !(pcrOf(p.af) >= 0 && j < 7) && c != 0xff {
+				t.Errorf("packet %d: adaptation field % x", i, p.af)
+				break
+			}
+		}
+		if p.pid != PIDFirstStream {
+			continue
+		}
+		if p.start {
+			got = append(got, nil)
+		}
+		got[len(got)-1] = append(got[len(got)-1], p.payload...)
+	}
+	if pcrs != 1 {
+		t.Errorf("%d PCRs, want 1", pcrs)
+	}
+	if len(cc) != 4 {
+		t.Errorf("%d pids, want PAT, PMT and 2 streams", len(cc))
+	}
+	if len(got) != len(want) {
+		t.Fatalf("%d PES, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if !bytes.Equal(got[i], want[i]) {
+			t.Errorf("PES %d: %d bytes, want %d", i, len(got[i]), len(want[i]))
+		}
+	}
+}
+
+func TestPSIRepeat(t *testing.T) {
+	var b bytes.Buffer
+	m := NewMuxer(&b)
+	if err := m.SetStreams(testStreams); err != nil {
+		t.Fatal(err)
+	}
+	// 1s of 25fps video with a PCR per frame: PAT/PMT at least 100ms apart
+	for i := 0; i < 25; i++ {
+		m.SetPCR(uint64(i) * 27000000 / 25)
+		if err := m.WritePES(0xe0, ptsHeader(uint64(i)*3600), make([]byte, 1000)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pats := 0
+	for _, p := range parsePackets(t, b.Bytes()) {
+		if p.pid == PIDPAT {
+			pats++
+		}
+	}
+	// SetStreams, then the first PCR and every third frame after it
+	if pats != 1+9 {
+		t.Errorf("%d PATs with the PCR, want 10", pats)
+	}
+
+	// no PCR at all: every psiPacketInterval packets
+	b.Reset()
+	m = NewMuxer(&b)
+	if err := m.SetStreams(testStreams); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 30; i++ {
+		if err := m.WritePES(0xc0, ptsHeader(0), make([]byte, 184*100)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pkts := parsePackets(t, b.Bytes())
+	last := 0
+	pats = 0
+	for i, p := range pkts {
+		if p.pid != PIDPAT {
+			continue
+		}
+		pats++
+		if i-last > psiPacketInterval+101 {
+			t.Errorf("PAT at packet %d, %d after the last one", i, i-last)
+		}
+		last = i
+	}
+	if pats < 2 {
+		t.Errorf("%d PATs without PCR, want them repeated", pats)
+	}
+}
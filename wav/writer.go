@@ -0,0 +1,146 @@
+// Package wav writes RIFF WAVE files.
+package wav
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Format tags
+const (
+	FormatPCM   = 0x0001
+	FormatALaw  = 0x0006
+	FormatMuLaw = 0x0007
+	FormatG726  = 0x0064 // G.726 ADPCM
+	FormatG722  = 0x0065 // G.722 ADPCM
+)
+
+var ErrClosed = errors.New("wav writer closed")
+
+// Format describes the samples of a WAVE file.
+type Format struct {
+	Tag           uint16
+	Channels      uint16
+	SampleRate    uint32
+	BitsPerSample uint16
+}
+
+// blockAlign is the size of a sample frame. ADPCM packs samples of less
+// than a byte, there it is 1.
+func (f *Format) blockAlign() uint32 {
+	if align := uint32(f.Channels) * uint32(f.BitsPerSample) / 8; align > 0 {
+		return align
+	}
+	return 1
+}
+
+func (f *Format) byteRate() uint32 {
+	return f.SampleRate * uint32(f.Channels) * uint32(f.BitsPerSample) / 8
+}
+
+// Writer writes the samples of a WAVE file. The sizes in the header are
+// only known at the end, so Close seeks back to fill them in.
+type Writer struct {
+	w      io.WriteSeeker
+	format Format
+	// offsets of the sizes to fill in
+	factPos int64
+	dataPos int64
+	size    int64 // bytes of sample data
+	closed  bool
+}
+
+// NewWriter writes the header of a WAVE file with samples in format to w.
+// Formats other than PCM get the fact chunk they require.
+func NewWriter(w io.WriteSeeker, format Format) (*Writer, error) {
+	wr := &Writer{w: w, format: format}
+	var hdr []byte
+	u16 := func(v uint16) { hdr = append(hdr, uint8(v), uint8(v>>8)) }
+	u32 := func(v uint32) { hdr = append(hdr, uint8(v), uint8(v>>8), uint8(v>>16), uint8(v>>24)) }
+	hdr = append(hdr, "RIFF"...)
+	u32(0)
+	hdr = append(hdr, "WAVEfmt "...)
+	pcm := format.Tag == FormatPCM
+	if pcm {
+		u32(16)
+	} else {
+		u32(18)
+	}
+	u16(format.Tag)
+	u16(format.Channels)
+	u32(format.SampleRate)
+	u32(format.byteRate())
+	u16(uint16(format.blockAlign()))
+	u16(format.BitsPerSample)
+	if !pcm {
+		u16(0) // cbSize
+		hdr = append(hdr, "fact"...)
+		u32(4)
+		wr.factPos = int64(len(hdr))
+		u32(0)
+	}
+	hdr = append(hdr, "data"...)
+	wr.dataPos = int64(len(hdr))
+	u32(0)
+	if _, err := w.Write(hdr); err != nil {
+		return nil, err
+	}
+	return wr, nil
+}
+
+// Write appends sample data.
+func (wr *Writer) Write(p []byte) (int, error) {
+	if wr.closed {
+		return 0, ErrClosed
+	}
+	n, err := wr.w.Write(p)
+	wr.size += int64(n)
+	return n, err
+}
+
+// Samples returns the number of samples per channel written so far.
+func (wr *Writer) Samples() int64 {
+	if bits := int64(wr.format.Channels) * int64(wr.format.BitsPerSample); bits != 0 {
+		return wr.size * 8 / bits
+	}
+	return 0
+}
+
+// Close pads the data chunk to an even size and fills in the sizes of the
+// header. It does not close the underlying writer.
+func (wr *Writer) Close() error {
+	if wr.closed {
+		return nil
+	}
+	wr.closed = true
+	riffSize := wr.dataPos + 4 + wr.size - 8
+	if wr.size%2 != 0 {
+		if _, err := wr.w.Write([]byte{0}); err != nil {
+			return err
+		}
+		riffSize++
+	}
+	patch := func(pos int64, v uint32) error {
+		if _, err := wr.w.Seek(pos, io.SeekStart); err != nil {
+			return err
+		}
+		var b [4]byte
+		binary.LittleEndian.PutUint32(b[:], v)
+		_, err := wr.w.Write(b[:])
+		return err
+	}
+	if err := patch(4, uint32(riffSize)); err != nil {
+		return err
+	}
+	if wr.factPos != 0 {
+		if err := patch(wr.factPos, uint32(wr.Samples())); err != nil {
+			return err
+		}
+	}
+	if err := patch(wr.dataPos, uint32(wr.size)); err != nil {
+		return err
+	}
+	_, err := wr.w.Seek(0, io.SeekEnd)
+	return err
+}
@@ -0,0 +1,91 @@
+package wav
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+)
+
+// seekBuffer is an in-memory io.WriteSeeker.
+type seekBuffer struct {
+	b   []byte
+	pos int
+}
+
+func (s *seekBuffer) Write(p []byte) (int, error) {
+	if n := s.pos + len(p); n > len(s.b) {
+		s.b = append(s.b, make([]byte, n-len(s.b))...)
+	}
+	copy(s.b[s.pos:], p)
+	s.pos += len(p)
+	return len(p), nil
+}
+
+func (s *seekBuffer) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += int64(s.pos)
+	case io.SeekEnd:
+		offset += int64(len(s.b))
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	s.pos = int(offset)
+	return offset, nil
+}
+
+func TestFormats(t *testing.T) {
+	tests := []struct {
+		name       string
+		format     Format
+		data       int
+		byteRate   uint32
+		blockAlign uint16
+		samples    int64
+	}{
+		{"pcm", Format{FormatPCM, 1, 8000, 16}, 320, 16000, 2, 160},
+		{"alaw", Format{FormatALaw, 1, 8000, 8}, 160, 8000, 1, 160},
+		{"g722", Format{FormatG722, 1, 16000, 4}, 160, 8000, 1, 320},
+		{"g726-32", Format{FormatG726, 1, 8000, 4}, 160, 4000, 1, 320},
+		{"g726-24", Format{FormatG726, 1, 8000, 3}, 150, 3000, 1, 400},
+	}
+	for _, tt := range tests {
+		buf := &seekBuffer{}
+		w, err := NewWriter(buf, tt.format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(make([]byte, tt.data))
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		b := buf.b
+		le16 := func(off int) uint16 { return binary.LittleEndian.Uint16(b[off:]) }
+		le32 := func(off int) uint32 { return binary.LittleEndian.Uint32(b[off:]) }
+		if string(b[:4]) != "RIFF" || le32(4) != uint32(len(b)-8) || string(b[8:16]) != "WAVEfmt " {
+			t.Errorf("%s: bad RIFF header % x", tt.name, b[:16])
+			continue
+		}
+		fmtSize := int(le32(16))
+		if le16(20) != tt.format.Tag || le32(28) != tt.byteRate || le16(32) != tt.blockAlign || le16(34) != tt.format.BitsPerSample {
+			t.Errorf("%s: tag 0x%04x byte rate %d block align %d bits %d, want 0x%04x %d %d %d", tt.name,
+				le16(20), le32(28), le16(32), le16(34), tt.format.Tag, tt.byteRate, tt.blockAlign, tt.format.BitsPerSample)
+		}
+		off := 20 + fmtSize
+		if tt.format.Tag != FormatPCM {
+			if string(b[off:off+4]) != "fact" || int64(le32(off+8)) != tt.samples {
+				t.Errorf("%s: fact chunk % x, want %d samples", tt.name, b[off:off+12], tt.samples)
+			}
+			off += 12
+		}
+		if string(b[off:off+4]) != "data" || int(le32(off+4)) != tt.data {
+			t.Errorf("%s: data chunk % x, want %d bytes", tt.name, b[off:off+8], tt.data)
+		}
+		if w.Samples() != tt.samples {
+			t.Errorf("%s: %d samples, want %d", tt.name, w.Samples(), tt.samples)
+		}
+	}
+}